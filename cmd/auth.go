@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/config"
+)
+
+var errNoPeerCred = errors.New("peer credentials are not available")
+
+const handshakeTimeout = 10 * time.Second
+
+// peer is the sender of a request, client restricts what a remote peer may
+// do and is nil for local peers.
+type peer struct {
+	name   string
+	client *config.Client
+}
+
+func (p peer) allows(command string) bool {
+	if p.client == nil {
+		return true
+	}
+	if len(p.client.Commands) == 0 {
+		return command != "shutdown"
+	}
+
+	return slices.Contains(p.client.Commands, command)
+}
+
+func (p peer) allowsAccount(account string) bool {
+	if p.client == nil || len(p.client.Accounts) == 0 {
+		return true
+	}
+
+	return slices.Contains(p.client.Accounts, account)
+}
+
+// authorize identifies the peer of c. Remote peers are known by the common
+// name of their certificate, which must be listed in daemon.clients. Local
+// peers must run as the owner of the daemon or belong to an allowed group,
+// they are rejected where their credentials cannot be read.
+func (d *daemon) authorize(c net.Conn) (peer, error) {
+	if tc, ok := c.(*tls.Conn); ok {
+		return d.authorizeCert(tc)
+	}
+
+	uid, gid, err := peerCred(c)
+	if errors.Is(err, errNoPeerCred) && runtime.GOOS == "windows" {
+		// the daemon only listens on a loopback port there, see listen
+		return peer{name: "local"}, nil
+	}
+	if err != nil {
+		return peer{}, fmt.Errorf("failed to read peer credentials: %w", err)
+	}
+
+	p := peer{name: fmt.Sprintf("uid %d", uid)}
+	if int(uid) == os.Getuid() {
+		return p, nil
+	}
+
+	d.mu.Lock()
+	allowed := d.conf.Daemon.AllowGroups
+	d.mu.Unlock()
+	if len(allowed) == 0 {
+		return peer{}, fmt.Errorf("uid %d is not allowed", uid)
+	}
+
+	groups := []string{strconv.FormatUint(uint64(gid), 10)}
+	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+		if ids, err := u.GroupIds(); err == nil {
+			groups = append(groups, ids...)
+		}
+	}
+
+	for _, name := range allowed {
+		want, err := config.LookupGroup(name)
+		if err != nil {
+			continue
+		}
+		if slices.Contains(groups, want) {
+			return p, nil
+		}
+	}
+
+	return peer{}, fmt.Errorf("uid %d is not in an allowed group", uid)
+}
+
+// authorizeCert expects the handshake to be done.
+func (d *daemon) authorizeCert(c *tls.Conn) (peer, error) {
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return peer{}, errors.New("no client certificate")
+	}
+	name := certs[0].Subject.CommonName
+
+	d.mu.Lock()
+	cl, ok := d.conf.Daemon.Client(name)
+	d.mu.Unlock()
+	if !ok {
+		return peer{}, fmt.Errorf("certificate %q is not listed in daemon.clients", name)
+	}
+
+	return peer{name: "cert " + name, client: &cl}, nil
+}
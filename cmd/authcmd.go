@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/secret"
+	"github.com/thesoulless/watchmyback/services/email"
+	"golang.org/x/oauth2"
+)
+
+const authTimeout = 5 * time.Minute
+
+func authLogin(ctx context.Context, account string) error {
+	conf, err := readConfig(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	e, ok := conf.Email(account)
+	if !ok {
+		return fmt.Errorf("unknown account %q", account)
+	}
+	if e.OAuth == nil {
+		return fmt.Errorf("account %q has no oauth section", account)
+	}
+
+	ctx, cancel := context.WithTimeout(email.OAuthContext(ctx), authTimeout)
+	defer cancel()
+
+	var tok *oauth2.Token
+	if device {
+		tok, err = deviceLogin(ctx, e.OAuth)
+	} else {
+		tok, err = loopbackLogin(ctx, e.OAuth)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = email.SaveToken(secret.New(secret.DefaultPath()), account, tok)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("logged in to %s\n", account)
+	return nil
+}
+
+// deviceLogin runs the device authorization grant (RFC 8628), useful on
+// headless machines.
+func deviceLogin(ctx context.Context, o *email.OAuthConf) (*oauth2.Token, error) {
+	cfg, err := o.Config("")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Endpoint.DeviceAuthURL == "" {
+		return nil, errors.New("oauth2 device_auth_url is required for the device flow")
+	}
+
+	resp, err := cfg.DeviceAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start device authorization: %w", err)
+	}
+
+	uri := resp.VerificationURIComplete
+	if uri == "" {
+		uri = resp.VerificationURI
+	}
+	fmt.Printf("Open %s and enter the code %s\n", uri, resp.UserCode)
+
+	tok, err := cfg.DeviceAccessToken(ctx, resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device access token: %w", err)
+	}
+
+	return tok, nil
+}
+
+// loopbackLogin runs the authorization code flow with PKCE, receiving the
+// redirect on a local http listener.
+func loopbackLogin(ctx context.Context, o *email.OAuthConf) (*oauth2.Token, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start loopback listener: %w", err)
+	}
+	defer l.Close()
+
+	cfg, err := o.Config(fmt.Sprintf("http://%s/callback", l.Addr()))
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	state := hex.EncodeToString(b)
+	verifier := oauth2.GenerateVerifier()
+
+	type result struct {
+		code string
+		err  error
+	}
+	ch := make(chan result, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		res := result{code: q.Get("code")}
+		switch {
+		case q.Get("state") != state:
+			res.err = errors.New("oauth2 state mismatch")
+		case q.Get("error") != "":
+			res.err = fmt.Errorf("oauth2 authorization failed: %s %s", q.Get("error"), q.Get("error_description"))
+		case res.code == "":
+			res.err = errors.New("oauth2 redirect without code")
+		}
+
+		if res.err != nil {
+			http.Error(w, res.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "wmb is authorized, you can close this window.")
+		}
+
+		select {
+		case ch <- res:
+		default:
+		}
+	})
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	url := cfg.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	fmt.Printf("Open the following URL in your browser:\n%s\n", url)
+
+	var res result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for oauth2 redirect: %w", ctx.Err())
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	tok, err := cfg.Exchange(ctx, res.code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange oauth2 code: %w", err)
+	}
+
+	return tok, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/thesoulless/watchmyback/services/email"
+)
+
+func TestDeviceLogin(t *testing.T) {
+	var polls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /device", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("client_id") != "id" {
+			t.Errorf("unexpected client_id %q", r.PostFormValue("client_id"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"device_code":      "dc",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": "https://example.com/device",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("device_code") != "dc" {
+			t.Errorf("unexpected device_code %q", r.PostFormValue("device_code"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// the user approves after the first poll
+		if polls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"authorization_pending"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "at",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"refresh_token": "rt",
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tok, err := deviceLogin(ctx, &email.OAuthConf{
+		ClientID:      "id",
+		TokenURL:      srv.URL + "/token",
+		DeviceAuthURL: srv.URL + "/device",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tok.AccessToken != "at" || tok.RefreshToken != "rt" {
+		t.Errorf("unexpected token %q and %q", tok.AccessToken, tok.RefreshToken)
+	}
+	if polls.Load() != 2 {
+		t.Errorf("expected 2 polls, got %d", polls.Load())
+	}
+
+	// the device flow needs its own endpoint
+	_, err = deviceLogin(ctx, &email.OAuthConf{ClientID: "id", TokenURL: srv.URL + "/token"})
+	if err == nil {
+		t.Error("expected an error without device_auth_url")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+)
+
+// bulkCommands act on a single email, --read runs them once for every uid
+// read from stdin.
+var bulkCommands = []string{"inbox", "archive", "trash", "delete", "read", "mark", "label"}
+
+// bulkItem is the result of the command on one uid, or a line or record of
+// stdin without one.
+type bulkItem struct {
+	UID    uint32 `json:"uid,omitempty" yaml:"uid,omitempty"`
+	Input  string `json:"input,omitempty" yaml:"input,omitempty"`
+	Code   int    `json:"code" yaml:"code"`
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+	Error  string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func (i bulkItem) name() string {
+	if i.UID == 0 {
+		return fmt.Sprintf("input %q", i.Input)
+	}
+
+	return fmt.Sprintf("uid %d", i.UID)
+}
+
+type bulkResult struct {
+	Items     []bulkItem `json:"items" yaml:"items"`
+	Succeeded int        `json:"succeeded" yaml:"succeeded"`
+	Failed    int        `json:"failed" yaml:"failed"`
+	Skipped   int        `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+}
+
+func (r bulkResult) table(w io.Writer) {
+	fmt.Fprintln(w, "UID\tCODE\tRESULT")
+	for _, i := range r.Items {
+		uid := strconv.FormatUint(uint64(i.UID), 10)
+		if i.UID == 0 {
+			uid = "-"
+		}
+		res := i.Output
+		if i.Code != int(exitcode.OK) {
+			res = i.Error
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", uid, i.Code, strings.ReplaceAll(res, "\n", " "))
+	}
+	fmt.Fprintf(w, "\n%s\n", r.summary())
+}
+
+func (r bulkResult) summary() string {
+	s := fmt.Sprintf("%d succeeded, %d failed", r.Succeeded, r.Failed)
+	if r.Skipped > 0 {
+		s += fmt.Sprintf(", %d skipped", r.Skipped)
+	}
+
+	return s
+}
+
+func (r bulkResult) String() string {
+	lines := make([]string, 0, len(r.Items)+1)
+	for _, i := range r.Items {
+		res := i.Output
+		if i.Code != int(exitcode.OK) {
+			res = i.Error
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", i.name(), res))
+	}
+
+	return strings.Join(append(lines, r.summary()), "\n")
+}
+
+// code is OK when every item succeeded, the code shared by the failures,
+// or Error when they failed differently.
+func (r bulkResult) code() exitcode.Code {
+	code := exitcode.OK
+	for _, i := range r.Items {
+		switch {
+		case i.Code == int(exitcode.OK):
+		case code == exitcode.OK:
+			code = exitcode.Code(i.Code)
+		case code != exitcode.Code(i.Code):
+			return exitcode.Error
+		}
+	}
+
+	return code
+}
+
+// readItems reads the uids given to --read: one per line, or the json
+// records printed by --output json, alone or in arrays. Lines and records
+// without a valid uid become failed items.
+func readItems(r io.Reader) ([]bulkItem, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to read stdin: %w", err)
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			break
+		}
+		br.ReadByte()
+	}
+
+	b, _ := br.Peek(1)
+	if b[0] == '{' || b[0] == '[' {
+		return readRecords(br)
+	}
+
+	var items []bulkItem
+	sc := bufio.NewScanner(br)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		items = append(items, parseItem(line))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stdin: %w", err)
+	}
+
+	return items, nil
+}
+
+func parseItem(s string) bulkItem {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return bulkItem{Input: s, Code: int(exitcode.Usage), Error: "invalid uid"}
+	}
+
+	return bulkItem{UID: uint32(n)}
+}
+
+func readRecords(r io.Reader) ([]bulkItem, error) {
+	var items []bulkItem
+	dec := json.NewDecoder(r)
+	for {
+		var v json.RawMessage
+		err := dec.Decode(&v)
+		if errors.Is(err, io.EOF) {
+			return items, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode stdin: %w", err)
+		}
+
+		items = append(items, recordItems(v)...)
+	}
+}
+
+func recordItems(v json.RawMessage) []bulkItem {
+	var list []json.RawMessage
+	if json.Unmarshal(v, &list) == nil {
+		var items []bulkItem
+		for _, r := range list {
+			items = append(items, recordItems(r)...)
+		}
+		return items
+	}
+
+	var record struct {
+		UID *uint32 `json:"uid"`
+	}
+	err := json.Unmarshal(v, &record)
+	if err == nil && (record.UID == nil || *record.UID == 0) {
+		err = errors.New("no uid")
+	}
+	if err != nil {
+		return []bulkItem{{Input: string(v), Code: int(exitcode.Usage), Error: "invalid record: " + err.Error()}}
+	}
+
+	return []bulkItem{{UID: *record.UID}}
+}
+
+// runItems runs each uid of items with run, the output of which is text.
+// An error of run itself, such as the daemon going away, or ctx being
+// done skips the remaining items.
+func runItems(ctx context.Context, opts emailOptions, items []bulkItem, run func(ctx context.Context, uid string) (string, int, error)) (string, int) {
+	var res bulkResult
+	for n, item := range items {
+		if ctx.Err() != nil {
+			res.Skipped = len(items) - n
+			break
+		}
+
+		var err error
+		if item.UID != 0 {
+			var out string
+			out, item.Code, err = run(ctx, strconv.FormatUint(uint64(item.UID), 10))
+			out = strings.TrimSpace(out)
+			switch {
+			case err != nil:
+				item.Code, item.Error = int(exitcode.Of(err)), err.Error()
+			case item.Code != int(exitcode.OK):
+				item.Error = out
+			default:
+				item.Output = out
+			}
+		}
+
+		res.Items = append(res.Items, item)
+		if item.Code == int(exitcode.OK) {
+			res.Succeeded++
+		} else {
+			res.Failed++
+		}
+		if err != nil {
+			res.Skipped = len(items) - n - 1
+			break
+		}
+	}
+
+	code := res.code()
+	if code == exitcode.OK && res.Skipped > 0 {
+		code = exitcode.Of(ctx.Err())
+	}
+
+	return opts.done(code, res, res.String())
+}
+
+// runBulk runs `email <account> <command> --read`, one request for each
+// uid so a failure only affects its email, and exits.
+func runBulk(cmd *cobra.Command, args []string) {
+	if len(args) != 2 || !slices.Contains(bulkCommands, args[1]) {
+		fmt.Fprintf(os.Stderr, "usage: email <account> <%s> --read, the uids are read from stdin\n", strings.Join(bulkCommands, "|"))
+		os.Exit(int(exitcode.Usage))
+	}
+
+	items, err := readItems(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(int(exitcode.Usage))
+	}
+
+	opts := localOptions()
+	// every item is run with text output and summed up in the requested one
+	item := opts
+	item.uids, item.output, item.status = true, outputText, false
+
+	if inProcess() {
+		runLocal(cmd.Context(), func(ctx context.Context) (string, int) {
+			srv, res, ex := openEmail(opts, args[0])
+			if srv == nil {
+				return res, ex
+			}
+			defer srv.Close()
+
+			return runItems(ctx, opts, items, func(ctx context.Context, uid string) (string, int, error) {
+				res, ex := runEmail(ctx, srv, item, args[1], uid)
+				return res, ex, nil
+			})
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	forward := forwardArgs(cmd, args)
+	if emailOpts.yes {
+		forward = append(forward, "--yes")
+	}
+	forward = append(forward, "--uids", "--output="+outputText, "--status=false")
+
+	res, ex := runItems(ctx, opts, items, func(ctx context.Context, uid string) (string, int, error) {
+		return send(ctx, append(slices.Clone(forward), uid))
+	})
+	if !emailOpts.status {
+		if output != outputText {
+			fmt.Print(res)
+		} else {
+			fmt.Println(res)
+		}
+	}
+	os.Exit(ex)
+}
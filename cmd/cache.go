@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+	"github.com/thesoulless/watchmyback/services/email"
+)
+
+const (
+	// cacheMailbox is the mailbox of the local copies, the one commands
+	// run on
+	cacheMailbox         = "INBOX"
+	defaultCacheInterval = 5 * time.Minute
+)
+
+// cacheDir returns the wmb directory of the user cache, $XDG_CACHE_HOME on
+// Linux, it holds the local copies of the accounts.
+func cacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "wmb")
+}
+
+func storePath(account string) string {
+	return filepath.Join(cacheDir(), account, cacheMailbox+".json")
+}
+
+func cacheInterval(conf email.Conf) time.Duration {
+	if conf.CacheInterval == 0 {
+		return defaultCacheInterval
+	}
+
+	return conf.CacheInterval
+}
+
+type syncResult email.SyncStats
+
+func (r syncResult) table(w io.Writer) {
+	fmt.Fprintln(w, "MAILBOX\tADDED\tUPDATED\tREMOVED\tTOTAL\tRESET")
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%t\n", r.Mailbox, r.Added, r.Updated, r.Removed, r.Total, r.Reset)
+}
+
+func (r syncResult) String() string {
+	s := fmt.Sprintf("%s: %d added, %d updated, %d removed, %d email(s)", r.Mailbox, r.Added, r.Updated, r.Removed, r.Total)
+	if r.Reset {
+		s += ", the mailbox was recreated and synced again"
+	}
+
+	return s
+}
+
+// syncStore syncs s over srv and saves it, also when the sync fails
+// halfway so the next one goes on from there.
+func syncStore(ctx context.Context, srv *email.Core, s *email.Store) (email.SyncStats, error) {
+	stats, err := srv.Sync(ctx, s)
+	serr := s.Save()
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, serr
+}
+
+// synced reports the result of the sync command.
+func (o emailOptions) synced(query string, sync func() (email.SyncStats, error)) (string, int) {
+	if query != cacheMailbox {
+		return o.fail(exitcode.Usage, fmt.Sprintf("only %s has a local copy", cacheMailbox), nil)
+	}
+
+	stats, err := sync()
+	if err != nil {
+		return o.fail(exitcode.Of(err), "failed to sync", err)
+	}
+
+	if o.status {
+		return fmt.Sprintf("status%v\n", "OK"), int(exitcode.OK)
+	}
+
+	return o.done(exitcode.OK, syncResult(stats), syncResult(stats).String())
+}
+
+// sync syncs the local copy of the account, which is read on first use.
+func (s *session) sync(ctx context.Context) (email.SyncStats, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if s.store == nil {
+		store, err := email.OpenStore(storePath(s.conf.Name), cacheMailbox)
+		if err != nil {
+			return email.SyncStats{}, err
+		}
+		s.store = store
+	}
+
+	srv, ctx, release, err := s.Lease(ctx, cacheMailbox, email.Shared)
+	if err != nil {
+		return email.SyncStats{}, err
+	}
+	defer release()
+
+	return syncStore(ctx, srv, s.store)
+}
+
+// startCache syncs the local copy of s every cache interval until the
+// returned func is called.
+func (d *daemon) startCache(ctx context.Context, s *session) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(cacheInterval(s.conf))
+		defer ticker.Stop()
+
+		for {
+			stats, err := s.sync(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Error("failed to sync the local copy", "account", s.conf.Name, "error", err)
+			} else if err == nil {
+				log.Debug("synced the local copy", "account", s.conf.Name, "added", stats.Added, "updated", stats.Updated, "removed", stats.Removed)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// localCommand runs search and read for --local on the copy of the account
+// kept by sync, without connecting to the server.
+func localCommand(args []string) (string, int) {
+	opts := localOptions()
+	if len(args) < 3 {
+		return opts.fail(exitcode.Usage, "usage: email <account> <search|read> <query> --local", nil)
+	}
+	service, command, query := args[0], args[1], args[2]
+
+	conf, err := readConfig(cfgFile)
+	if err != nil {
+		return opts.fail(exitcode.ConfigError, "failed to read config", err)
+	}
+	if _, ok := conf.Email(service); !ok {
+		return opts.fail(exitcode.ConfigError, fmt.Sprintf("%s %q", "unknown account", service), nil)
+	}
+
+	switch {
+	case opts.read || opts.archive || opts.gmail:
+		return opts.fail(exitcode.Usage, "--local only searches and reads, it cannot be used with --read, --archive or --gmail", nil)
+	case command != "search" && command != "read":
+		return opts.fail(exitcode.Usage, "--local only works with search and read", nil)
+	}
+
+	s, err := email.OpenStore(storePath(service), cacheMailbox)
+	if err != nil {
+		return opts.fail(exitcode.Error, "failed to open the local copy", err)
+	}
+	if s.Synced.IsZero() {
+		msg := fmt.Sprintf("%s has no local copy, run `wmb email %s sync` or set cache: true", service, service)
+		return opts.fail(exitcode.Error, msg, nil)
+	}
+
+	if command == "read" {
+		return opts.readLocal(s, query)
+	}
+
+	if opts.limit < 0 || opts.offset < 0 {
+		return opts.fail(exitcode.Usage, "--limit and --offset must not be negative", nil)
+	}
+
+	set, unset, err := opts.flags()
+	if err != nil {
+		return opts.fail(exitcode.Usage, "invalid flags", err)
+	}
+
+	q := email.Query{Subject: query, From: opts.from, Flags: set, NotFlags: unset}
+	res, err := s.Search(q, email.Page{Limit: opts.limit, Offset: opts.offset})
+	if err != nil {
+		if errors.Is(err, email.ErrNotFound) {
+			return opts.fail(exitcode.NotFound, "not found", err)
+		}
+
+		return opts.fail(exitcode.Of(err), "failed to search", err)
+	}
+
+	return opts.messages(res)
+}
+
+// readLocal prints the email query, a sequence number as of the last sync
+// or with --uids a uid, from s.
+func (o emailOptions) readLocal(s *email.Store, query string) (string, int) {
+	n, err := strconv.ParseUint(query, 10, 32)
+	if err != nil || n == 0 {
+		return o.fail(exitcode.Usage, "failed to find the email", fmt.Errorf("invalid sequence number or uid %q", query))
+	}
+
+	uid := uint32(n)
+	if !o.uids {
+		if int(n) > len(s.Messages) {
+			return o.fail(exitcode.NotFound, "not found", email.ErrNotFound)
+		}
+		uid = s.Messages[n-1].UID
+	}
+
+	res, err := s.Message(uid)
+	if err != nil {
+		return o.fail(exitcode.NotFound, "not found", err)
+	}
+
+	if o.status {
+		return fmt.Sprintf("status%v\n", res.Body), int(exitcode.OK)
+	}
+
+	return o.done(exitcode.OK, message(*res), readText(*res))
+}
@@ -1,61 +1,218 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+	"github.com/thesoulless/watchmyback/services/email"
 )
 
+// runClient forwards args to the daemon, starting it first when it is not
+// running and --spawn is set, prints the output and exits with its code.
+// The first Ctrl-C asks the daemon to cancel the command, a second one
+// exits right away.
 func runClient(args []string) {
-	conn, err := dial()
+	printResult(call(args))
+}
+
+// call sends args to the daemon and returns its output and exit code, it
+// exits when the daemon cannot be talked to.
+func call(args []string) (string, int) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	res, ex, err := send(ctx, args)
+	var derr daemonError
+	if errors.As(err, &derr) && derr.dial {
+		fmt.Println("Error talking to daemon:", err)
+		fmt.Println("start it with `wmb daemon start -d`, or use --spawn or --no-daemon")
+		os.Exit(int(exitcode.DaemonUnavailable))
+	}
 	if err != nil {
-		fmt.Println("Error connecting to daemon:", err)
-		return
+		fmt.Println("Error talking to daemon:", err)
+		os.Exit(int(exitcode.Of(err)))
 	}
-	defer conn.Close()
 
-	Write(conn, strings.Join(args, "\x00"))
-	// fmt.Fprintf(conn, strings.Join(args, " ")+"\n")
+	return res, ex
+}
 
-	headerLen := make([]byte, 8)
-	_, err = io.ReadFull(conn, headerLen)
-	if err != nil {
-		fmt.Println("Error reading header:", err)
-		// @TODO: use a named status code
-		os.Exit(200)
+// printResult prints the output of the daemon and exits with its code.
+func printResult(res string, ex int) {
+	if !emailOpts.status {
+		fmt.Print(res)
 	}
+	os.Exit(ex)
+}
 
-	lengthBytes := make([]byte, 4)
-	_, err = io.ReadFull(conn, lengthBytes)
-	if err != nil {
-		fmt.Println("Error reading length:", err)
-		// @TODO: use a named status code
-		os.Exit(200)
+// send is request, starting the daemon first for --spawn when it is not
+// running.
+func send(ctx context.Context, args []string) (string, int, error) {
+	res, ex, err := request(ctx, args)
+	var derr daemonError
+	if errors.As(err, &derr) && derr.dial && spawn && remote() == "" {
+		err = spawnDaemon()
+		if err == nil {
+			res, ex, err = request(ctx, args)
+		}
 	}
 
-	// Convert the length prefix to an integer
-	length := binary.BigEndian.Uint32(lengthBytes)
+	return res, ex, err
+}
 
-	response := make([]byte, length)
-	_, err = io.ReadFull(conn, response)
+// inProcess tells whether a command runs in the client instead of the
+// daemon: with --no-daemon, or when no daemon listens on the local socket
+// and --spawn is not set.
+func inProcess() bool {
+	return noDaemon || remote() == "" && !spawn && !reachable()
+}
+
+// runLocal runs a command in-process, see inProcess, it prints like
+// runClient.
+func runLocal(ctx context.Context, command func(context.Context) (string, int)) {
+	ctx, cancel := commandContext(ctx)
+	defer cancel()
+	if showProgress {
+		ctx = email.WithProgress(ctx, func(op string, done, total int) {
+			fmt.Fprintln(os.Stderr, progressLine(op, done, total))
+		})
+	}
+
+	res, ex := command(ctx)
+	cancel()
+	if !emailOpts.status {
+		if output != outputText {
+			fmt.Print(res)
+		} else {
+			fmt.Println(res)
+		}
+	}
+	os.Exit(ex)
+}
+
+// commandContext applies --timeout and is canceled by Ctrl-C.
+func commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	if cmdTimeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cmdTimeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// forwardArgs returns the command line of cmd as sent to the daemon: its
+// name, the flags of the email flag set given to it and args. Of the global
+// flags only --output, --timeout and --progress are forwarded, the others
+// are for the client.
+func forwardArgs(cmd *cobra.Command, args []string) []string {
+	known := emailFlags(&emailOptions{})
+	local := cmd.LocalFlags()
+	forward := []string{cmd.Name()}
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if local.Lookup(f.Name) == nil || known.Lookup(f.Name) == nil {
+			return
+		}
+		if s, ok := f.Value.(pflag.SliceValue); ok {
+			for _, v := range s.GetSlice() {
+				forward = append(forward, "--"+f.Name+"="+v)
+			}
+			return
+		}
+		forward = append(forward, "--"+f.Name+"="+f.Value.String())
+	})
+	args = append(forward, args...)
+
+	if output != outputText {
+		args = append(args, "--output", output)
+	}
+	if cmdTimeout > 0 {
+		args = append(args, "--timeout="+cmdTimeout.String())
+	}
+	if showProgress {
+		args = append(args, "--progress")
+	}
+
+	return args
+}
+
+// daemonError is returned when the daemon cannot be reached, dial is set
+// when nothing listens on the socket.
+type daemonError struct {
+	err  error
+	dial bool
+}
+
+func (e daemonError) Error() string {
+	return e.err.Error()
+}
+
+func (e daemonError) Unwrap() error {
+	return e.err
+}
+
+func (e daemonError) ExitCode() exitcode.Code {
+	return exitcode.DaemonUnavailable
+}
+
+// request sends args to the daemon and returns its output and exit code,
+// progress frames sent before the response are printed on stderr. When ctx
+// is done a cancel frame is sent and the daemon answers with the
+// result of the interrupted command, unless it does not answer within
+// cancelGrace.
+func request(ctx context.Context, args []string) (string, int, error) {
+	conn, err := dial()
 	if err != nil {
-		fmt.Println("Error reading response:", err)
-		// @TODO: use a named status code
-		os.Exit(200)
+		return "", 0, daemonError{err: fmt.Errorf("failed to connect: %w", err), dial: true}
 	}
+	defer conn.Close()
 
-	if status {
-		ex, err := strconv.Atoi(strings.TrimSpace(string(response)))
+	err = Write(conn, strings.Join(args, "\x00"))
+	if err != nil {
+		return "", 0, daemonError{err: fmt.Errorf("failed to send request: %w", err)}
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		Write(conn, cancelFrame)
+		conn.SetReadDeadline(time.Now().Add(cancelGrace))
+	})
+	defer stop()
+
+	var response []byte
+	for {
+		response, err = Read(conn)
 		if err != nil {
-			// @TODO: use a named status code
-			os.Exit(200)
+			var perr protocolError
+			if errors.As(err, &perr) {
+				return "", 0, perr
+			}
+			return "", 0, daemonError{err: fmt.Errorf("failed to read response: %w", err)}
+		}
+
+		line, ok := strings.CutPrefix(string(response), progressFrame)
+		if !ok {
+			break
 		}
-		os.Exit(ex)
-		return
+		fmt.Fprintln(os.Stderr, line)
+	}
+
+	code, res, ok := strings.Cut(string(response), "\x00")
+	ex, err := strconv.Atoi(code)
+	if !ok || err != nil {
+		return "", 0, protocolError{msg: "malformed response"}
 	}
 
-	fmt.Print(string(response))
+	return res, ex, nil
 }
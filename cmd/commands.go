@@ -1,26 +1,53 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/thesoulless/watchmyback/internal/exitcode"
 )
 
 var (
 	cfgFile string
-	from    string
-	status  bool
 	debug   bool
-	seqs    bool
-	archive bool
-	read    bool
+	device  bool
+	redact  bool
+	output  string
+
+	// emailOpts is set by the flags of emailCmd, see localOptions
+	emailOpts emailOptions
+
+	showProgress bool
+
+	noDaemon     bool
+	spawn        bool
+	spawnTimeout time.Duration
+	cmdTimeout   time.Duration
+
+	socketFile string
+	remoteAddr string
+	tlsCert    string
+	tlsKey     string
+	tlsCA      string
+	certHosts  []string
+	certOut    string
+
+	httpAddr   string
+	detach     bool
+	activation bool
+	install    bool
 
 	rootCmd = &cobra.Command{
 		Use:              "wmb",
 		TraverseChildren: true,
 		Short:            "A tool to automate some of my tasks",
 		Long:             `By default, it will run the daemon command`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return validOutput(output)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			cmd.Help()
 		},
@@ -31,11 +58,31 @@ var (
 		Short: "Print the version number of Hugo",
 		Long:  `All software has versions. This is Hugo's`,
 		Run: func(cmd *cobra.Command, args []string) {
-			res, exit := emailCommand(args)
-			if !status {
-				fmt.Println(res)
+			confirmExpunge(args)
+			if emailOpts.local {
+				runLocal(cmd.Context(), func(context.Context) (string, int) {
+					return localCommand(args)
+				})
+			}
+			if emailOpts.read {
+				runBulk(cmd, args)
+			}
+			// the files of export and import are on this machine
+			if inProcess() || len(args) > 1 && (args[1] == "export" || args[1] == "import") {
+				runLocal(cmd.Context(), func(ctx context.Context) (string, int) {
+					return emailCommand(ctx, args)
+				})
 			}
-			os.Exit(exit)
+			forward := forwardArgs(cmd, args)
+			if emailOpts.yes {
+				forward = append(forward, "--yes")
+			}
+			// the clipboard is the one of this machine, the code is copied
+			// from the json of the daemon
+			if emailOpts.clip && len(args) > 1 && args[1] == "otp" {
+				printResult(clipOTP(call(append(forward, "--output", outputJSON))))
+			}
+			runClient(forward)
 		},
 	}
 
@@ -43,20 +90,196 @@ var (
 		Use:   "slack",
 		Short: "Interact with slack api",
 		Run: func(cmd *cobra.Command, args []string) {
-			runClient(os.Args[1:])
+			if inProcess() {
+				runLocal(cmd.Context(), func(ctx context.Context) (string, int) {
+					return runSlack(ctx, forwardArgs(cmd, args)[1:])
+				})
+			}
+			runClient(forwardArgs(cmd, args))
+		},
+	}
+
+	exitCodesCmd = &cobra.Command{
+		Use:   "exit-codes",
+		Short: "Exit codes shared by the CLI, the client and the daemon",
+		Long: "wmb, and commands forwarded to the daemon, exit with one of the following codes.\n" +
+			"With --status nothing is printed and the code is the only result.\n\n" + exitcode.Help(),
+	}
+
+	daemonCmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "Run the daemon in the foreground, or manage it with a subcommand",
+		Long:  `The daemon holds the email sessions, runs the rules and reloads the config on SIGHUP or when the file changes`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDaemon(cmd.Context())
+		},
+	}
+
+	daemonStartCmd = &cobra.Command{
+		Use:   "start",
+		Short: "Start the daemon, in the background with --detach",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return daemonStart(cmd.Context(), detach)
+		},
+	}
+
+	daemonStopCmd = &cobra.Command{
+		Use:   "stop",
+		Short: "Stop the running daemon",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return daemonStop()
+		},
+	}
+
+	daemonRestartCmd = &cobra.Command{
+		Use:   "restart",
+		Short: "Stop the running daemon and start it again in the background",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return daemonRestart(cmd.Context())
+		},
+	}
+
+	daemonStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Report whether the daemon is running",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return daemonState()
+		},
+	}
+
+	daemonSystemdCmd = &cobra.Command{
+		Use:   "systemd",
+		Short: "Print or install systemd user units for the daemon",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return daemonSystemd(activation, install)
+		},
+	}
+
+	statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the state of the daemon and its services",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if noDaemon {
+				return daemonError{err: errors.New("status reports on the daemon, it cannot be used with --no-daemon")}
+			}
+			runClient(forwardArgs(cmd, args))
+			return nil
+		},
+	}
+
+	authCmd = &cobra.Command{
+		Use:   "auth",
+		Short: "Manage OAuth2 credentials of email accounts",
+	}
+
+	authLoginCmd = &cobra.Command{
+		Use:   "login <account>",
+		Short: "Authorize an account and store its OAuth2 token",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return authLogin(cmd.Context(), args[0])
+		},
+	}
+
+	certsCmd = &cobra.Command{
+		Use:   "certs",
+		Short: "Manage the certificates of the TLS listener",
+	}
+
+	certsInitCmd = &cobra.Command{
+		Use:   "init",
+		Short: "Create the CA and the server certificate",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return certsInit(certHosts)
+		},
+	}
+
+	certsIssueCmd = &cobra.Command{
+		Use:   "issue <name>",
+		Short: "Issue a client certificate, name is matched against daemon.clients",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return certsIssue(args[0], certOut)
+		},
+	}
+
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the config file",
+	}
+
+	configCheckCmd = &cobra.Command{
+		Use:   "check",
+		Short: "Validate the config file and report every problem",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return configCheck()
+		},
+	}
+
+	configShowCmd = &cobra.Command{
+		Use:   "show",
+		Short: "Print the loaded config",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return configShow()
 		},
 	}
 )
 
 func Init() {
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cobra.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $XDG_CONFIG_HOME/wmb/config.yaml)")
+	rootCmd.PersistentFlags().StringVarP(&output, "output", "o", outputText, "output format: text, json, yaml or table")
+	rootCmd.PersistentFlags().StringVar(&socketFile, "socket", "", "daemon socket (default is $WMB_SOCKET, daemon.socket of the config or $XDG_RUNTIME_DIR/wmb/wmb.sock)")
+	rootCmd.PersistentFlags().StringVar(&remoteAddr, "remote", "", "address of a remote daemon, reached over mutual TLS (default is $WMB_REMOTE)")
+	rootCmd.PersistentFlags().StringVar(&tlsCert, "tls-cert", "", "client certificate for --remote (default is client.pem in the pki dir)")
+	rootCmd.PersistentFlags().StringVar(&tlsKey, "tls-key", "", "client key for --remote (default is client-key.pem in the pki dir)")
+	rootCmd.PersistentFlags().StringVar(&tlsCA, "tls-ca", "", "CA of the remote daemon (default is ca.pem in the pki dir)")
+	rootCmd.PersistentFlags().DurationVar(&cmdTimeout, "timeout", 0, "abort the command after this long, 0 waits as long as it takes")
+	rootCmd.PersistentFlags().BoolVar(&showProgress, "progress", false, "report the progress of long operations on stderr")
+	rootCmd.PersistentFlags().BoolVar(&noDaemon, "no-daemon", false, "run the command in-process even when the daemon is running, which is the default when it is not and --spawn is not set")
+	rootCmd.PersistentFlags().BoolVar(&spawn, "spawn", os.Getenv("WMB_SPAWN") != "", "start the daemon in the background when it is not running (default true when $WMB_SPAWN is set)")
+	rootCmd.PersistentFlags().DurationVar(&spawnTimeout, "spawn-timeout", startTimeout, "how long to wait for a spawned daemon to accept connections")
+
+	emailCmd.Flags().AddFlagSet(emailFlags(&emailOpts))
+	emailCmd.Flags().BoolVar(&emailOpts.clip, "clip", false, "otp: also copy the code, or the link, to the clipboard")
+
+	daemonCmd.PersistentFlags().StringVar(&httpAddr, "http", "", "serve /healthz, /readyz and /metrics on this address, e.g. 127.0.0.1:9464")
+	daemonStartCmd.Flags().BoolVarP(&detach, "detach", "d", false, "run the daemon in the background")
+	daemonSystemdCmd.Flags().BoolVar(&activation, "activation", false, "also generate a socket unit, the daemon is started on the first connection")
+	daemonSystemdCmd.Flags().BoolVar(&install, "install", false, "write the units to $XDG_CONFIG_HOME/systemd/user")
+	daemonCmd.AddCommand(daemonStartCmd)
+	daemonCmd.AddCommand(daemonStopCmd)
+	daemonCmd.AddCommand(daemonRestartCmd)
+	daemonCmd.AddCommand(daemonStatusCmd)
+	daemonCmd.AddCommand(daemonSystemdCmd)
+
+	authLoginCmd.Flags().BoolVar(&device, "device", false, "use the device code flow instead of a local browser redirect")
+	authCmd.AddCommand(authLoginCmd)
+
+	certsInitCmd.Flags().StringSliceVar(&certHosts, "host", nil, "host names and addresses of the server certificate (default is localhost and the host name)")
+	certsIssueCmd.Flags().StringVar(&certOut, "out", "", "directory to write the client files to (default is ./<name>)")
+	certsCmd.AddCommand(certsInitCmd)
+	certsCmd.AddCommand(certsIssueCmd)
 
-	emailCmd.Flags().BoolVarP(&status, "status", "s", false, "just exit with status code")
-	emailCmd.Flags().BoolVar(&seqs, "seqs", false, "print sequence numbers")
-	emailCmd.Flags().BoolVarP(&archive, "archive", "a", false, "archive the affected email(s)")
-	emailCmd.Flags().StringVarP(&from, "from", "f", "", "from email address")
-	emailCmd.Flags().BoolVarP(&read, "read", "r", false, "read from stdin")
+	configShowCmd.Flags().BoolVar(&redact, "redact", false, "hide passwords, client secrets and webhook urls")
+	configCmd.AddCommand(configCheckCmd)
+	configCmd.AddCommand(configShowCmd)
 
 	rootCmd.AddCommand(slackCmd)
 	rootCmd.AddCommand(emailCmd)
+	rootCmd.AddCommand(exitCodesCmd)
+	rootCmd.AddCommand(daemonCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(authCmd)
+	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(certsCmd)
 }
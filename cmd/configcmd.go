@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/thesoulless/watchmyback/internal/config"
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+)
+
+type configProblem struct {
+	Line    int    `json:"line" yaml:"line"`
+	Path    string `json:"path,omitempty" yaml:"path,omitempty"`
+	Message string `json:"message" yaml:"message"`
+}
+
+type configCheckResult struct {
+	Path     string          `json:"path" yaml:"path"`
+	Problems []configProblem `json:"problems" yaml:"problems"`
+}
+
+func configCheck() error {
+	path, err := config.Find(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	_, problems, err := config.Check(path)
+	if err != nil {
+		return err
+	}
+
+	if output != outputText {
+		res := configCheckResult{Path: path, Problems: []configProblem{}}
+		for _, p := range problems {
+			res.Problems = append(res.Problems, configProblem{Line: p.Line, Path: p.Path, Message: p.Msg})
+		}
+		out, err := render(output, res)
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		if len(problems) > 0 {
+			os.Exit(int(exitcode.ConfigError))
+		}
+		return nil
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s: OK\n", path)
+		return nil
+	}
+
+	for _, p := range problems {
+		msg := p.Msg
+		if p.Path != "" {
+			msg = p.Path + ": " + msg
+		}
+		fmt.Printf("%s:%d: %s\n", path, p.Line, msg)
+	}
+	os.Exit(int(exitcode.ConfigError))
+	return nil
+}
+
+func configShow() error {
+	conf, err := readConfig(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	if redact {
+		conf = conf.Redacted()
+	}
+
+	format := output
+	if format == outputText {
+		format = outputYAML
+	}
+	out, err := render(format, conf)
+	if err != nil {
+		return fmt.Errorf("failed to configShow: %w", err)
+	}
+
+	fmt.Print(string(out))
+	return nil
+}
@@ -1,49 +1,101 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/thesoulless/watchmyback/internal/config"
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+	"github.com/thesoulless/watchmyback/internal/metrics"
+	"github.com/thesoulless/watchmyback/internal/secret"
+	"github.com/thesoulless/watchmyback/services/email"
 )
 
-type ExitCode int
+// protocolError is returned when a frame does not start with the magic
+// and version of this build.
+type protocolError struct {
+	header []byte
+	msg    string
+}
 
-const (
-	ExitCodeOK ExitCode = iota
-	ExitCodeError
-)
+func (e protocolError) Error() string {
+	if e.msg != "" {
+		return "protocol mismatch: " + e.msg
+	}
+	return fmt.Sprintf("protocol mismatch: got header %q, want %s %s", e.header, Magic, Version)
+}
 
-var (
-	mu   = sync.Mutex{}
-	conn net.Conn
+func (e protocolError) ExitCode() exitcode.Code {
+	return exitcode.ProtocolMismatch
+}
+
+const (
+	// cancelFrame is sent by the client after its request to abort it, the
+	// daemon still answers with the result of the interrupted command.
+	cancelFrame = "\x18"
+	cancelGrace = 5 * time.Second
+	// progressFrame starts the frames reporting the progress of a request
+	// sent with --progress, the response is the first frame without it.
+	progressFrame = "\x16"
+	// maxRequestSize caps the frames of clients, which are arguments and
+	// never come near it, they are read within requestTimeout
+	maxRequestSize = 1 << 20
+	requestTimeout = 10 * time.Second
 )
 
 func Read(conn net.Conn) ([]byte, error) {
-	headerLen := make([]byte, 8)
-	_, err := io.ReadFull(conn, headerLen)
+	return readFrame(conn, 0)
+}
+
+// ReadRequest is Read for the frames sent by clients, which are refused
+// above maxRequestSize before anything is allocated for them.
+func ReadRequest(conn net.Conn) ([]byte, error) {
+	return readFrame(conn, maxRequestSize)
+}
+
+// readFrame reads a frame of at most limit bytes, 0 is no limit.
+func readFrame(conn net.Conn, limit uint32) ([]byte, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(conn, header)
 	if err != nil {
-		// @TODO: use a named status code
 		return nil, err
 	}
 
+	if !bytes.Equal(header[:3], Magic) || !bytes.Equal(bytes.TrimRight(header[3:], "\x00"), Version) {
+		return nil, protocolError{header: header}
+	}
+
 	lengthBytes := make([]byte, 4)
 	_, err = io.ReadFull(conn, lengthBytes)
 	if err != nil {
-		fmt.Println("Error reading length (Read):", err)
-		// @TODO: use a named status code
 		return nil, err
 	}
 
 	// Convert the length prefix to an integer
 	length := binary.BigEndian.Uint32(lengthBytes)
+	if limit > 0 && length > limit {
+		return nil, protocolError{msg: fmt.Sprintf("frame of %d bytes is larger than %d", length, limit)}
+	}
 
 	response := make([]byte, length)
 	_, err = io.ReadFull(conn, response)
 	if err != nil {
-		fmt.Println("Error reading:", err)
-		// @TODO: use a named status code
 		return nil, err
 	}
 
@@ -75,3 +127,568 @@ func Write(conn net.Conn, response string) error {
 
 	return nil
 }
+
+const reloadDelay = 500 * time.Millisecond
+
+// session is the connection pool of an account held by the daemon,
+// requests and rules lease a connection for the commands they send.
+type session struct {
+	*email.Pool
+	conf email.Conf
+	undo *undoLog
+
+	// cacheMu guards store, the local copy of the account, see sync
+	cacheMu   sync.Mutex
+	store     *email.Store
+	stopCache context.CancelFunc
+
+	pollMu sync.Mutex
+	poll   time.Time
+}
+
+// Close stops syncing the local copy and closes the connections.
+func (s *session) Close() error {
+	if s.stopCache != nil {
+		s.stopCache()
+	}
+
+	return s.Pool.Close()
+}
+
+// polled records a successful rule evaluation.
+func (s *session) polled() {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+
+	s.poll = time.Now()
+}
+
+func (s *session) lastPoll() time.Time {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+
+	return s.poll
+}
+
+type daemon struct {
+	mu            sync.Mutex
+	path          string
+	started       time.Time
+	conf          *config.Config
+	sessions      *List[*session]
+	rules         map[string]*ruleRunner
+	secrets       *secret.Store
+	notifications chan notification
+	stop          context.CancelFunc
+}
+
+func runDaemon(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the lock is taken before listen removes a stale socket, so a second
+	// daemon cannot steal the socket of the running one
+	pid, err := acquirePIDFile(pidPath())
+	if err != nil {
+		return err
+	}
+	defer pid.Release()
+
+	path, err := config.Find(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	conf, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	d := &daemon{
+		path:          path,
+		started:       time.Now(),
+		conf:          &config.Config{},
+		sessions:      NewList[*session](),
+		rules:         make(map[string]*ruleRunner),
+		secrets:       secret.New(secret.DefaultPath()),
+		notifications: make(chan notification, notificationQueueSize),
+		stop:          stop,
+	}
+	go d.sendNotifications(ctx)
+	d.apply(ctx, conf)
+	defer d.shutdown()
+
+	l, err := listen(len(conf.Daemon.AllowGroups) > 0)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	log.Info("daemon started", "address", getAddress(), "config", path, "pid", os.Getpid())
+
+	if conf.Daemon.TLS != nil {
+		tl, err := listenTLS(conf.Daemon.TLS)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("failed to listen for remote clients: %w", err)
+		}
+		log.Info("listening for remote clients", "address", tl.Addr().String())
+		go d.serve(ctx, tl)
+	}
+
+	if httpAddr != "" {
+		err = d.serveHTTP(ctx, httpAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	go d.watch(ctx)
+	d.serve(ctx, l)
+	log.Info("daemon stopping")
+
+	return nil
+}
+
+// serve accepts connections on l until ctx is done.
+func (d *daemon) serve(ctx context.Context, l net.Listener) {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error("failed to accept connection", "address", l.Addr().String(), "error", err)
+			continue
+		}
+		go d.handle(ctx, c)
+	}
+}
+
+func (d *daemon) handle(ctx context.Context, c net.Conn) {
+	defer c.Close()
+
+	if tc, ok := c.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tc.Handshake()
+		if err != nil {
+			log.Warn("tls handshake failed", "remote", c.RemoteAddr().String(), "error", err)
+			return
+		}
+		tc.SetDeadline(time.Time{})
+	}
+
+	p, err := d.authorize(c)
+	if err != nil {
+		log.Warn("rejecting connection", "remote", c.RemoteAddr().String(), "error", err)
+		code := exitcode.AuthFailure
+		metrics.Request("", int(code))
+		Write(c, fmt.Sprintf("%d\x00permission denied: %s\n", code, err.Error()))
+		// the request is discarded unread so the client gets the answer
+		// instead of a reset connection
+		c.SetReadDeadline(time.Now().Add(requestTimeout))
+		io.CopyN(io.Discard, c, maxRequestSize+12)
+		return
+	}
+
+	c.SetReadDeadline(time.Now().Add(requestTimeout))
+	req, err := ReadRequest(c)
+	if errors.Is(err, io.EOF) {
+		// a liveness probe, see reachable
+		return
+	}
+	if err != nil {
+		log.Error("failed to read request", "error", err)
+		var perr protocolError
+		if errors.As(err, &perr) {
+			code := exitcode.ProtocolMismatch
+			metrics.Request("", int(code))
+			Write(c, fmt.Sprintf("%d\x00%s\n", code, err.Error()))
+		}
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	args := strings.Split(string(req), "\x00")
+	if !p.allows(args[0]) {
+		log.Warn("rejecting command", "peer", p.name, "command", args[0])
+		code := int(exitcode.AuthFailure)
+		metrics.Request(commandLabel(args[0]), code)
+		msg := fmt.Sprintf("%s may not run %q", p.name, args[0])
+		Write(c, fmt.Sprintf("%d\x00%s", code, renderError(outputFromArgs(args[1:]), msg, code)))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if t := timeoutFromArgs(args[1:]); t > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, t)
+		defer cancelTimeout()
+	}
+	go watchCancel(ctx, c, cancel)
+	if progressFromArgs(args[1:]) {
+		ctx = email.WithProgress(ctx, func(op string, done, total int) {
+			Write(c, progressFrame+progressLine(op, done, total))
+		})
+	}
+
+	res, code := d.dispatch(ctx, p, args)
+	metrics.Request(commandLabel(args[0]), code)
+
+	err = Write(c, fmt.Sprintf("%d\x00%s", code, res))
+	if err != nil {
+		log.Error("failed to write response", "error", err)
+	}
+
+	// stop only once the client got its answer
+	if args[0] == "shutdown" {
+		d.stop()
+	}
+}
+
+// commandLabel is the metrics label of a requested command, anything the
+// daemon does not serve is counted as unknown so clients cannot add label
+// values.
+func commandLabel(command string) string {
+	if !config.Commands[command] {
+		return "unknown"
+	}
+
+	return command
+}
+
+// watchCancel cancels the request when the client sends a cancel frame or
+// goes away.
+func watchCancel(ctx context.Context, c net.Conn, cancel context.CancelFunc) {
+	frame, err := ReadRequest(c)
+	if ctx.Err() != nil {
+		// the request is already done
+		return
+	}
+
+	switch {
+	case err != nil:
+		log.Info("client disconnected, aborting request", "error", err)
+	case string(frame) == cancelFrame:
+		log.Info("request canceled by the client")
+	default:
+		log.Warn("unexpected frame, aborting request")
+	}
+	cancel()
+}
+
+func (d *daemon) dispatch(ctx context.Context, p peer, args []string) (string, int) {
+	log.Debug("request", "peer", p.name, "args", args)
+
+	switch args[0] {
+	case "email":
+		opts := emailOptions{}
+		flags := emailFlags(&opts)
+		flags.StringVarP(&opts.output, "output", "o", outputText, "output format: text, json, yaml or table")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return opts.fail(exitcode.Usage, "invalid flags", err)
+		}
+
+		rest := defaultQuery(flags.Args())
+		if len(rest) < 3 {
+			return opts.fail(exitcode.Usage, "usage: email <account> <command> <query>", nil)
+		}
+
+		if !p.allowsAccount(rest[0]) {
+			return opts.fail(exitcode.AuthFailure, fmt.Sprintf("%s may not use account %q", p.name, rest[0]), nil)
+		}
+
+		s, ok := d.session(rest[0])
+		if !ok {
+			return opts.fail(exitcode.ConfigError, fmt.Sprintf("%s %q", "unknown account", rest[0]), nil)
+		}
+
+		if rest[1] == "export" || rest[1] == "import" {
+			msg := fmt.Sprintf("%s runs in the client, its files are on the client's machine", rest[1])
+			return opts.fail(exitcode.Usage, msg, nil)
+		}
+
+		if rest[1] == "sync" {
+			res, code := opts.synced(rest[2], func() (email.SyncStats, error) {
+				return s.sync(ctx)
+			})
+			if opts.output == outputText {
+				res += "\n"
+			}
+			return res, code
+		}
+
+		if rest[1] == "otp" {
+			res, code := otpCommand(ctx, opts, rest[2], func(ctx context.Context, q email.Query, after uint32) ([]email.OTP, uint32, error) {
+				srv, ctx, release, err := s.Lease(ctx, "", email.Shared)
+				if err != nil {
+					return nil, 0, err
+				}
+				defer release()
+				return srv.OTPs(ctx, q, after)
+			})
+			if opts.output == outputText {
+				res += "\n"
+			}
+			return res, code
+		}
+
+		if rest[1] == "undo" {
+			res, code := d.undo(ctx, s, opts, rest[2])
+			if opts.output == outputText {
+				res += "\n"
+			}
+			return res, code
+		}
+
+		srv, ctx, release, err := s.Lease(ctx, "", opts.access(rest[1]))
+		if err != nil {
+			return opts.fail(exitcode.Of(err), "failed to reserve a connection", err)
+		}
+		defer release()
+		res, code := runEmail(ctx, srv, opts, rest[1], rest[2])
+		// the client prints as is, in-process text output ends with Println
+		if opts.output == outputText {
+			res += "\n"
+		}
+		return res, code
+	case "slack":
+		return runSlack(ctx, args[1:])
+	case "shutdown":
+		log.Info("shutdown requested")
+		return "ok\n", int(exitcode.OK)
+	case "status":
+		format := outputFromArgs(args[1:])
+		if format == outputText {
+			format = outputTable
+		}
+		res, err := render(format, d.status().visibleTo(p))
+		if err != nil {
+			return renderError(format, err.Error(), int(exitcode.Error)), int(exitcode.Error)
+		}
+		return res, int(exitcode.OK)
+	default:
+		msg := fmt.Sprintf("unknown command %q", args[0])
+		return renderError(outputFromArgs(args[1:]), msg, int(exitcode.Usage)), int(exitcode.Usage)
+	}
+}
+
+// outputFromArgs returns the --output flag of forwarded arguments.
+func outputFromArgs(args []string) string {
+	format := outputText
+	flags := pflag.NewFlagSet("output", pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.StringVarP(&format, "output", "o", outputText, "")
+	flags.Parse(args)
+
+	if validOutput(format) != nil {
+		return outputText
+	}
+
+	return format
+}
+
+// timeoutFromArgs returns the --timeout flag of forwarded arguments.
+func timeoutFromArgs(args []string) time.Duration {
+	var timeout time.Duration
+	flags := pflag.NewFlagSet("timeout", pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.DurationVar(&timeout, "timeout", 0, "")
+	flags.Parse(args)
+
+	return timeout
+}
+
+// progressFromArgs returns the --progress flag of forwarded arguments.
+func progressFromArgs(args []string) bool {
+	var progress bool
+	flags := pflag.NewFlagSet("progress", pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.BoolVar(&progress, "progress", false, "")
+	flags.Parse(args)
+
+	return progress
+}
+
+func progressLine(op string, done, total int) string {
+	return fmt.Sprintf("%s: %d/%d", op, done, total)
+}
+
+func (d *daemon) session(name string) (*session, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.sessions.Get(name)
+}
+
+func (d *daemon) notifier(name string) (config.Notifier, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.conf.Notifier(name)
+}
+
+// apply moves the daemon from its current config to conf: sessions and
+// rules that did not change are kept, changed ones are restarted and
+// removed ones are closed.
+func (d *daemon) apply(ctx context.Context, conf *config.Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	want := make(map[string]email.Conf, len(conf.Emails))
+	for _, e := range conf.Emails {
+		e.Tokens = d.secrets
+		want[e.Name] = e
+	}
+
+	var remove []string
+	d.sessions.Each(func(name string, s *session) {
+		if e, ok := want[name]; !ok || !reflect.DeepEqual(e, s.conf) {
+			remove = append(remove, name)
+		}
+	})
+	restarted := make(map[string]bool, len(remove))
+	for _, name := range remove {
+		log.Info("closing session", "account", name)
+		restarted[name] = true
+		err := d.sessions.Remove(name)
+		if err != nil {
+			log.Error("failed to close session", "account", name, "error", err)
+		}
+	}
+
+	for _, e := range conf.Emails {
+		if _, ok := d.sessions.Get(e.Name); ok {
+			continue
+		}
+		log.Info("opening session", "account", e.Name)
+		pool, err := email.NewPool(want[e.Name])
+		if err != nil {
+			log.Error("failed to open session", "account", e.Name, "error", err)
+			continue
+		}
+		s := &session{Pool: pool, conf: want[e.Name], undo: &undoLog{}}
+		pool.OnMove(s.undo.record)
+		if e.Cache {
+			s.stopCache = d.startCache(ctx, s)
+		}
+		d.sessions.Add(e.Name, s)
+	}
+
+	rules := make(map[string]config.Rule, len(conf.Rules))
+	for _, r := range conf.Rules {
+		rules[r.Name] = r
+	}
+
+	for name, rr := range d.rules {
+		if r, ok := rules[name]; ok && reflect.DeepEqual(r, rr.rule) && !restarted[r.Account] {
+			continue
+		}
+		log.Info("stopping rule", "rule", name)
+		rr.cancel()
+		delete(d.rules, name)
+	}
+
+	for _, r := range conf.Rules {
+		if _, ok := d.rules[r.Name]; ok {
+			continue
+		}
+		log.Info("starting rule", "rule", r.Name)
+		d.rules[r.Name] = d.startRule(ctx, r)
+	}
+
+	d.conf = conf
+}
+
+// watch reloads the config on SIGHUP or when the config file changes. An
+// invalid config is logged and the daemon keeps running the previous one.
+func (d *daemon) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	var errs chan error
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error("failed to watch config, only SIGHUP will reload it", "error", err)
+	} else {
+		defer w.Close()
+		// watch the directory, editors often replace the file instead of
+		// writing to it
+		err = w.Add(filepath.Dir(d.path))
+		if err != nil {
+			log.Error("failed to watch config, only SIGHUP will reload it", "error", err)
+		}
+		events = w.Events
+		errs = w.Errors
+	}
+
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info("SIGHUP received")
+			d.reload(ctx)
+		case ev := <-events:
+			if filepath.Clean(ev.Name) != filepath.Clean(d.path) || ev.Has(fsnotify.Chmod) {
+				continue
+			}
+			// wait for the writes to settle before reading the file
+			delay = time.After(reloadDelay)
+		case err := <-errs:
+			log.Error("config watcher error", "error", err)
+		case <-delay:
+			delay = nil
+			log.Info("config file changed", "path", d.path)
+			d.reload(ctx)
+		}
+	}
+}
+
+func (d *daemon) reload(ctx context.Context) {
+	conf, err := config.Load(d.path)
+	if err != nil {
+		log.Error("rejecting invalid config, keeping the previous one", "path", d.path, "error", err)
+		return
+	}
+
+	d.mu.Lock()
+	prev := d.conf.Daemon
+	d.mu.Unlock()
+	if conf.Daemon.Socket != prev.Socket || (len(conf.Daemon.AllowGroups) > 0) != (len(prev.AllowGroups) > 0) ||
+		!reflect.DeepEqual(conf.Daemon.TLS, prev.TLS) {
+		log.Warn("socket changes take effect after a restart", "path", d.path)
+	}
+
+	d.apply(ctx, conf)
+	log.Info("config reloaded", "path", d.path)
+}
+
+func (d *daemon) shutdown() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name, rr := range d.rules {
+		rr.cancel()
+		delete(d.rules, name)
+	}
+
+	var names []string
+	d.sessions.Each(func(name string, _ *session) {
+		names = append(names, name)
+	})
+	for _, name := range names {
+		err := d.sessions.Remove(name)
+		if err != nil {
+			log.Error("failed to close session", "account", name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+)
+
+const (
+	startTimeout = 10 * time.Second
+	stopTimeout  = 15 * time.Second
+	pollDelay    = 100 * time.Millisecond
+)
+
+var errNotRunning = daemonError{err: errors.New("daemon is not running")}
+
+// daemonArgs returns the flags a daemon started by the CLI is run with.
+func daemonArgs() []string {
+	var args []string
+	if cfgFile != "" {
+		path, err := filepath.Abs(cfgFile)
+		if err != nil {
+			path = cfgFile
+		}
+		args = append(args, "--config", path)
+	}
+	if socketFile != "" {
+		args = append(args, "--socket", socketFile)
+	}
+	if httpAddr != "" {
+		args = append(args, "--http", httpAddr)
+	}
+
+	return args
+}
+
+// daemonStart runs the daemon in the foreground, or in the background when
+// detach is set and returns once it accepts connections.
+func daemonStart(ctx context.Context, detach bool) error {
+	if !detach {
+		return runDaemon(ctx)
+	}
+
+	pid, logPath, err := startDetached(startTimeout)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("daemon started (pid %d), logging to %s\n", pid, logPath)
+	return nil
+}
+
+// spawnDaemon is used by the client to start a missing daemon, it reports on
+// stderr so the output of the command stays untouched.
+func spawnDaemon() error {
+	pid, logPath, err := startDetached(spawnTimeout)
+	if err != nil && !errors.Is(err, errAlreadyRunning) {
+		return err
+	}
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "started the daemon (pid %d), logging to %s\n", pid, logPath)
+	}
+
+	return nil
+}
+
+// startDetached starts the daemon in the background and waits up to
+// timeout for its socket to accept connections.
+func startDetached(timeout time.Duration) (int, string, error) {
+	if pid := runningPID(); pid != 0 {
+		return 0, "", fmt.Errorf("%w (pid %d)", errAlreadyRunning, pid)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to find the wmb binary: %w", err)
+	}
+
+	err = os.MkdirAll(stateDir(), 0o700)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create state dir: %w", err)
+	}
+	logPath := filepath.Join(stateDir(), "daemon.log")
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open daemon log: %w", err)
+	}
+	defer logFile.Close()
+
+	c := exec.Command(exe, append([]string{"daemon", "start"}, daemonArgs()...)...)
+	c.Stdout = logFile
+	c.Stderr = logFile
+	c.SysProcAttr = detached()
+	err = c.Start()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to start daemon: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- c.Wait()
+	}()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case err := <-exited:
+			return 0, "", daemonError{err: fmt.Errorf("daemon exited (%v), see %s", err, logPath)}
+		case <-deadline:
+			return 0, "", daemonError{err: fmt.Errorf("daemon did not start in %s, see %s", timeout, logPath)}
+		case <-time.After(pollDelay):
+		}
+
+		if reachable() {
+			return c.Process.Pid, logPath, nil
+		}
+	}
+}
+
+// daemonStop asks the daemon to shut down, falling back to a signal when
+// the socket does not answer, and waits for it to exit.
+func daemonStop() error {
+	pid := runningPID()
+
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+
+	res, code, err := request(ctx, []string{"shutdown"})
+	if err == nil && code != int(exitcode.OK) {
+		return exitcode.WithCode(exitcode.Code(code), fmt.Errorf("daemon refused to stop: %s", strings.TrimSpace(res)))
+	}
+	if err != nil && remote() != "" {
+		return err
+	}
+	if err != nil {
+		if pid == 0 {
+			return errNotRunning
+		}
+		log.Warn("daemon did not answer, sending SIGTERM", "pid", pid, "error", err)
+		err = terminate(pid)
+		if err != nil {
+			return fmt.Errorf("failed to stop daemon: %w", err)
+		}
+	}
+
+	if remote() != "" {
+		fmt.Println("daemon is stopping")
+		return nil
+	}
+
+	deadline := time.Now().Add(stopTimeout)
+	for time.Now().Before(deadline) {
+		if runningPID() == 0 && !reachable() {
+			fmt.Println("daemon stopped")
+			return nil
+		}
+		time.Sleep(pollDelay)
+	}
+
+	return fmt.Errorf("daemon did not stop in %s", stopTimeout)
+}
+
+func daemonRestart(ctx context.Context) error {
+	// keep the config of the running daemon unless another one is given
+	if cfgFile == "" {
+		sctx, cancel := context.WithTimeout(ctx, startTimeout)
+		res, code, err := request(sctx, []string{"status", "-o", outputJSON})
+		cancel()
+		st := daemonStatus{}
+		if err == nil && code == int(exitcode.OK) && json.Unmarshal([]byte(res), &st) == nil {
+			cfgFile = st.Config
+		}
+	}
+
+	err := daemonStop()
+	if err != nil && !errors.Is(err, errNotRunning) {
+		return err
+	}
+
+	return daemonStart(ctx, true)
+}
+
+func reachable() bool {
+	conn, err := dial()
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
+
+type daemonProcess struct {
+	Running bool   `json:"running" yaml:"running"`
+	PID     int    `json:"pid,omitempty" yaml:"pid,omitempty"`
+	Address string `json:"address" yaml:"address"`
+	PIDFile string `json:"pid_file" yaml:"pid_file"`
+}
+
+func daemonState() error {
+	p := daemonProcess{PID: runningPID(), Address: getAddress(), PIDFile: pidPath()}
+	p.Running = reachable()
+
+	if output == outputText {
+		switch {
+		case p.Running && p.PID != 0:
+			fmt.Printf("daemon is running (pid %d) on %s\n", p.PID, p.Address)
+		case p.Running:
+			fmt.Printf("daemon is running on %s\n", p.Address)
+		case p.PID != 0:
+			fmt.Printf("daemon (pid %d) is not accepting connections on %s\n", p.PID, p.Address)
+		default:
+			fmt.Println("daemon is not running")
+		}
+	} else {
+		res, err := render(output, p)
+		if err != nil {
+			return err
+		}
+		fmt.Print(res)
+	}
+
+	if !p.Running {
+		os.Exit(int(exitcode.DaemonUnavailable))
+	}
+
+	return nil
+}
+
+// daemonSystemd prints the systemd user units, or writes them when install
+// is set.
+func daemonSystemd(socket, install bool) error {
+	units, err := systemdUnits(socket)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if !install {
+		for _, name := range names {
+			fmt.Printf("# %s\n%s\n", name, units[name])
+		}
+		return nil
+	}
+
+	dir, err := systemdUserDir()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		err = os.WriteFile(path, []byte(units[name]), 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to write unit: %w", err)
+		}
+		fmt.Println("wrote", path)
+	}
+
+	enable := "wmb.service"
+	if socket {
+		enable = "wmb.socket"
+	}
+	fmt.Printf("run `systemctl --user daemon-reload && systemctl --user enable --now %s`\n", enable)
+
+	return nil
+}
@@ -1,181 +1,669 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/emersion/go-imap/v2"
+	"github.com/spf13/pflag"
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+	"github.com/thesoulless/watchmyback/internal/secret"
 	"github.com/thesoulless/watchmyback/services/email"
+	"golang.org/x/term"
 )
 
-type EmailStatus int
-
-const (
-	Unknown EmailStatus = iota + 100
-	ClientError
-	SearchFound
-	SearchNotFound
-	OK
-	ReadOK
-	ArchiveOK
-	ArchiveError
-)
+type emailOptions struct {
+	from    string
+	status  bool
+	seqs    bool
+	archive bool
+	read    bool
+	output  string
+	limit   int
+	offset  int
+	uids    bool
 
-var (
-	ErrUnknown = errors.New("unknown error")
-	ErrClient  = errors.New("client error")
-	ErrSearch  = errors.New("search error")
-	ErrArchive = errors.New("archive error")
-)
+	seen       bool
+	unseen     bool
+	flagged    bool
+	unflagged  bool
+	keywords   []string
+	noKeywords []string
+	dryRun     bool
+	expunge    bool
+	yes        bool
+
+	gmail    bool
+	labels   []string
+	noLabels []string
+	local    bool
+
+	mailbox string
+	format  string
+	since   string
+	until   string
+
+	wait time.Duration
+	// clip is only set in the client, the daemon has no clipboard
+	clip bool
+
+	upcoming bool
+}
+
+// emailFlags defines the flags of emailCmd, the daemon parses the
+// arguments forwarded by the client with them too.
+func emailFlags(opts *emailOptions) *pflag.FlagSet {
+	flags := pflag.NewFlagSet("email", pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.BoolVarP(&opts.status, "status", "s", false, "just exit with status code")
+	flags.BoolVar(&opts.seqs, "seqs", false, "print sequence numbers")
+	flags.BoolVarP(&opts.archive, "archive", "a", false, "archive the affected email(s)")
+	flags.StringVarP(&opts.from, "from", "f", "", "from email address")
+	flags.BoolVarP(&opts.read, "read", "r", false, "run the command on every uid read from stdin, one per line or as the json of --output json")
+	flags.IntVar(&opts.limit, "limit", 0, "return at most this many matches, or threads, newest first")
+	flags.IntVar(&opts.offset, "offset", 0, "skip this many of the newest matches, or threads")
+	flags.BoolVar(&opts.uids, "uids", false, "search: print uids, other commands: the query is a uid instead of a sequence number")
+	flags.BoolVar(&opts.seen, "seen", false, "search: only read emails, mark: mark as read")
+	flags.BoolVar(&opts.unseen, "unseen", false, "search: only unread emails, mark: mark as unread")
+	flags.BoolVar(&opts.flagged, "flagged", false, "search: only flagged emails, mark: flag")
+	flags.BoolVar(&opts.unflagged, "unflagged", false, "search: only unflagged emails, mark: unflag")
+	flags.StringSliceVar(&opts.keywords, "keyword", nil, "search: only emails with the keyword, mark: add the keyword")
+	flags.StringSliceVar(&opts.noKeywords, "no-keyword", nil, "search: only emails without the keyword, mark: remove the keyword")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "print the emails archive, inbox, trash, delete, mark or undo would affect, or how unsubscribe would unsubscribe, and change nothing")
+	flags.BoolVar(&opts.expunge, "expunge", false, "delete: remove the email for good instead of flagging it \\Deleted")
+	flags.BoolVarP(&opts.yes, "yes", "y", false, "delete: expunge without asking for confirmation")
+	flags.BoolVar(&opts.gmail, "gmail", false, "use the Gmail extensions: search and threads take Gmail's search syntax, archive removes the \\Inbox label")
+	flags.StringSliceVar(&opts.labels, "label", nil, "label: add the Gmail label")
+	flags.StringSliceVar(&opts.noLabels, "no-label", nil, "label: remove the Gmail label")
+	flags.StringVar(&opts.mailbox, "mailbox", "INBOX", "export and import: the mailbox to export or to append to")
+	flags.StringVar(&opts.format, "format", "", "export and import: mbox, maildir or eml, export defaults to mbox and import tells it from the source")
+	flags.StringVar(&opts.since, "since", "", "export: only emails received on this day, YYYY-MM-DD, or after")
+	flags.StringVar(&opts.until, "until", "", "export: only emails received on this day, YYYY-MM-DD, or before")
+	flags.DurationVar(&opts.wait, "wait", 0, "otp: wait this long for an email with a code or link to arrive, 0 prints the newest one")
+	flags.BoolVar(&opts.upcoming, "upcoming", false, "invites: only the pending invitations that are still ahead, by start")
+	flags.BoolVar(&opts.local, "local", false, "search and read the local copy of the account kept by sync, without the server: the query matches words of the subject, senders and body, sequence numbers are the ones of the last sync")
+
+	return flags
+}
+
+// localOptions returns the options set by the flags of emailCmd.
+func localOptions() emailOptions {
+	opts := emailOpts
+	opts.output = output
 
-func emailCommand(args []string) (string, int) {
+	return opts
+}
+
+func emailCommand(ctx context.Context, args []string) (string, int) {
+	opts := localOptions()
+	args = defaultQuery(args)
+	if len(args) < 3 {
+		return opts.fail(exitcode.Usage, "usage: email <account> <command> <query>", nil)
+	}
 	service := args[0]
 	command := args[1]
 	query := args[2]
 
 	log.Debug("email command", "service", service, "command", command, "query", query)
 
+	srv, res, ex := openEmail(opts, service)
+	if srv == nil {
+		return res, ex
+	}
+	defer srv.Close()
+
+	if command == "sync" {
+		return opts.synced(query, func() (email.SyncStats, error) {
+			s, err := email.OpenStore(storePath(service), cacheMailbox)
+			if err != nil {
+				return email.SyncStats{}, err
+			}
+			return syncStore(ctx, srv, s)
+		})
+	}
+
+	return runEmail(ctx, srv, opts, command, query)
+}
+
+// defaultQuery fills in the query of the commands that have a default one.
+func defaultQuery(args []string) []string {
+	if len(args) != 2 {
+		return args
+	}
+
+	switch args[1] {
+	case "undo":
+		return append(args, "1")
+	case "labels":
+		return append(args, "*")
+	case "sync":
+		return append(args, cacheMailbox)
+	case "otp", "invites", "lists":
+		return append(args, "")
+	}
+
+	return args
+}
+
+// openEmail connects to the account service for --no-daemon, when it fails
+// it returns the output and exit code to report instead.
+func openEmail(opts emailOptions, service string) (*email.Core, string, int) {
 	conf, err := readConfig(cfgFile)
 	if err != nil {
-		return "", int(Unknown)
+		res, ex := opts.fail(exitcode.ConfigError, "failed to read config", err)
+		return nil, res, ex
+	}
+
+	e, ok := conf.Email(service)
+	if !ok {
+		res, ex := opts.fail(exitcode.ConfigError, fmt.Sprintf("%s %q", "unknown account", service), nil)
+		return nil, res, ex
+	}
+	if debug {
+		l := slog.LevelDebug
+		e.LogLevel = &l
+	}
+	e.Tokens = secret.New(secret.DefaultPath())
+	srv, err := email.New(e)
+	if err != nil {
+		res, ex := opts.fail(exitcode.Of(err), "failed to connect", err)
+		return nil, res, ex
 	}
 
-	var srv *email.Core
-	for _, e := range conf.Emails {
-		if e.Name != service {
-			continue
+	return srv, "", 0
+}
+
+// access returns how command uses the selected mailbox, the daemon leases
+// a connection accordingly.
+func (o emailOptions) access(command string) email.Access {
+	if o.dryRun {
+		return email.Shared
+	}
+
+	switch command {
+	case "search", "threads", "read", "mark":
+		if !o.archive {
+			return email.Shared
 		}
-		if debug {
-			l := slog.LevelDebug
-			e.LogLevel = &l
+	case "label":
+		// removing the label of the selected mailbox expunges the emails
+		// from it, like the archive of Gmail does with \Inbox
+		if len(o.noLabels) == 0 {
+			return email.Shared
 		}
-		srv, err = email.New(e)
+	case "labels", "otp", "invites", "lists", "unsubscribe":
+		return email.Shared
+	}
+
+	return email.Exclusive
+}
+
+// confirmExpunge asks before `delete --expunge` is sent, the daemon
+// refuses it without --yes. It exits unless the user agrees.
+func confirmExpunge(args []string) {
+	if len(args) < 2 || args[1] != "delete" || !emailOpts.expunge || emailOpts.yes || emailOpts.dryRun {
+		return
+	}
+
+	target := "the emails read from stdin"
+	if !emailOpts.read {
+		if len(args) < 3 {
+			return
+		}
+		target = args[2]
+	}
+
+	ok, err := confirm(fmt.Sprintf("permanently delete %s from %s?", target, args[0]))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(int(exitcode.Usage))
+	}
+	if !ok {
+		fmt.Fprintln(os.Stderr, "aborted")
+		os.Exit(int(exitcode.Error))
+	}
+	emailOpts.yes = true
+}
+
+// confirm asks question on the terminal, it fails when stdin is not one.
+func confirm(question string) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, errors.New("stdin is not a terminal, confirm with --yes")
+	}
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// seqnum parses query, a sequence number or with --uids a uid, which is
+// looked up in the selected mailbox.
+func (o emailOptions) seqnum(ctx context.Context, srv *email.Core, query string) (uint32, error) {
+	what := "sequence number"
+	if o.uids {
+		what = "uid"
+	}
+	n, err := strconv.ParseUint(query, 10, 32)
+	if err != nil || n == 0 {
+		return 0, exitcode.WithCode(exitcode.Usage, fmt.Errorf("invalid %s %q", what, query))
+	}
+	if !o.uids {
+		return uint32(n), nil
+	}
+
+	return srv.SeqNum(ctx, imap.UID(n))
+}
+
+// preview lists the emails a mutating command would affect, for --dry-run.
+func (o emailOptions) preview(action string, msgs []email.Message) (string, int) {
+	lines := []string{fmt.Sprintf("would %s %d email(s):", action, len(msgs))}
+	for _, m := range msgs {
+		lines = append(lines, m.Subject)
+	}
+
+	return o.done(exitcode.OK, dryRunResult{Action: action, Messages: msgs}, strings.Join(lines, "\n"))
+}
+
+// previewSet fetches set for preview.
+func (o emailOptions) previewSet(ctx context.Context, srv *email.Core, action string, set imap.NumSet) (string, int) {
+	msgs, err := srv.Headers(ctx, set)
+	if err != nil {
+		if errors.Is(err, email.ErrNotFound) {
+			return o.fail(exitcode.NotFound, "not found", err)
+		}
+
+		return o.fail(exitcode.Of(err), "failed to fetch", err)
+	}
+
+	return o.preview(action, msgs)
+}
+
+// flags returns the flags selected by --seen, --flagged and --keyword,
+// and the ones by --unseen, --unflagged and --no-keyword.
+func (o emailOptions) flags() (set, unset []string, err error) {
+	if (o.seen && o.unseen) || (o.flagged && o.unflagged) {
+		return nil, nil, errors.New("--seen and --unseen, or --flagged and --unflagged, exclude each other")
+	}
+
+	if o.seen {
+		set = append(set, string(imap.FlagSeen))
+	}
+	if o.flagged {
+		set = append(set, string(imap.FlagFlagged))
+	}
+	set = append(set, o.keywords...)
+	if o.unseen {
+		unset = append(unset, string(imap.FlagSeen))
+	}
+	if o.unflagged {
+		unset = append(unset, string(imap.FlagFlagged))
+	}
+	unset = append(unset, o.noKeywords...)
+
+	for _, f := range slices.Concat(set, unset) {
+		err = email.ValidFlag(f)
 		if err != nil {
-			return "", int(Unknown)
+			return nil, nil, err
+		}
+	}
+
+	return set, unset, nil
+}
+
+// messages prints the result of a search, by subject unless --seqs or
+// --uids is set.
+func (o emailOptions) messages(res []email.Message) (string, int) {
+	subjects := make([]string, len(res))
+	for i, m := range res {
+		subjects[i] = m.Subject
+	}
+
+	if o.status {
+		info := fmt.Sprintf("status%v\n", subjects)
+		return info, int(exitcode.OK)
+	}
+
+	if o.seqs {
+		lines := make([]string, len(res))
+		for i, m := range res {
+			lines[i] = strconv.FormatUint(uint64(m.Seq), 10)
 		}
-		break
+		return o.done(exitcode.OK, messageList(res), strings.Join(lines, "\n"))
 	}
 
+	if o.uids {
+		lines := make([]string, len(res))
+		for i, m := range res {
+			lines[i] = strconv.FormatUint(uint64(m.UID), 10)
+		}
+		return o.done(exitcode.OK, messageList(res), strings.Join(lines, "\n"))
+	}
+
+	return o.done(exitcode.OK, messageList(res), strings.Join(subjects, "\n"))
+}
+
+// fail returns the error in the requested output format
+func (o emailOptions) fail(code exitcode.Code, msg string, err error) (string, int) {
+	if err != nil {
+		msg = fmt.Sprintf("%s: %s", msg, err.Error())
+	}
+
+	return renderError(o.output, msg, int(code)), int(code)
+}
+
+// done returns v in the requested output format, or text for text output
+func (o emailOptions) done(code exitcode.Code, v any, text string) (string, int) {
+	if o.output == outputText {
+		return text, int(code)
+	}
+
+	res, err := render(o.output, v)
+	if err != nil {
+		return o.fail(exitcode.Error, "failed to render output", err)
+	}
+
+	return res, int(code)
+}
+
+func runEmail(ctx context.Context, srv *email.Core, opts emailOptions, command, query string) (string, int) {
 	switch command {
+	case "otp":
+		return otpCommand(ctx, opts, query, srv.OTPs)
+	case "invites":
+		return invitesCommand(ctx, srv, opts, query)
+	case "lists":
+		return listsCommand(ctx, srv, opts, query)
+	case "unsubscribe":
+		return unsubscribeCommand(ctx, srv, opts, query)
 	case "search":
-		res, seqnums, err := srv.Search(query, from)
+		if opts.limit < 0 || opts.offset < 0 {
+			return opts.fail(exitcode.Usage, "--limit and --offset must not be negative", nil)
+		}
+
+		set, unset, err := opts.flags()
+		if err != nil {
+			return opts.fail(exitcode.Usage, "invalid flags", err)
+		}
+
+		page := email.Page{Limit: opts.limit, Offset: opts.offset}
+		var res []email.Message
+		if opts.gmail {
+			if opts.from != "" || len(set)+len(unset) > 0 {
+				return opts.fail(exitcode.Usage, "--gmail takes Gmail's search syntax, use from:, is:unread or label: in the query", nil)
+			}
+			res, err = srv.GmailSearch(ctx, query, page)
+		} else {
+			q := email.Query{Subject: query, From: opts.from, Flags: set, NotFlags: unset}
+			res, err = srv.SearchMessages(ctx, q, page)
+		}
 		if err != nil {
 			if errors.Is(err, email.ErrNotFound) {
-				info := fmt.Sprintf("%s: %s\n", "not found", err.Error())
-				return info, int(SearchNotFound)
+				return opts.fail(exitcode.NotFound, "not found", err)
 			}
 
-			info := fmt.Sprintf("%s: %s\n", "failed to search", err.Error())
-			return info, int(ClientError)
+			return opts.fail(exitcode.Of(err), "failed to search", err)
 		}
 
-		if archive {
-			err = srv.Archive(seqnums)
-			if err != nil {
-				info := fmt.Sprintf("%s %v: %s\n", "failed to archive", seqnums, err.Error())
-				return info, int(ArchiveError)
-			}
+		seqnums := make([]uint32, len(res))
+		for i, m := range res {
+			seqnums[i] = m.Seq
 		}
 
-		if status {
-			info := fmt.Sprintf("status%v\n", res)
-			return info, int(SearchFound)
+		if opts.archive && opts.dryRun {
+			return opts.preview("archive", res)
 		}
 
-		if seqs {
-			info := fmt.Sprintf("%v", seqnums)
-			info = strings.Trim(info, "[]")
-			info = strings.ReplaceAll(info, " ", "\n")
-			return info, int(SearchFound)
+		if opts.archive {
+			if opts.gmail {
+				err = srv.GmailArchive(ctx, seqnums)
+			} else {
+				err = srv.Archive(ctx, seqnums)
+			}
+			if err != nil {
+				return opts.fail(exitcode.Of(err), fmt.Sprintf("%s %v", "failed to archive", seqnums), err)
+			}
 		}
 
-		info := strings.Join(res, "\n")
-		return info, int(SearchFound)
-	case "inbox":
-		seqnum, err := strconv.Atoi(query)
+		return opts.messages(res)
+	case "inbox", "archive", "trash", "delete":
+		seqnum, err := opts.seqnum(ctx, srv, query)
 		if err != nil {
-			info := fmt.Sprintf("%s: %s\n", "invalid sequence number", err.Error())
-			return info, int(ClientError)
+			return opts.fail(exitcode.Of(err), "failed to find the email", err)
 		}
+		seqs := []uint32{seqnum}
 
-		err = srv.Move([]uint32{uint32(seqnum)}, "INBOX")
+		action := command
+		switch {
+		case command == "inbox":
+			action = "move to INBOX"
+		case command == "delete" && opts.expunge:
+			action = "delete for good"
+		}
+		if opts.dryRun {
+			return opts.previewSet(ctx, srv, action, imap.SeqSetNum(seqs...))
+		}
+
+		switch command {
+		case "inbox":
+			err = srv.Move(ctx, seqs, "INBOX")
+		case "archive":
+			if opts.gmail {
+				err = srv.GmailArchive(ctx, seqs)
+			} else {
+				err = srv.Archive(ctx, seqs)
+			}
+		case "trash":
+			err = srv.Trash(ctx, seqs)
+		case "delete":
+			if opts.expunge && !opts.yes {
+				return opts.fail(exitcode.Usage, "expunging cannot be undone, confirm with --yes", nil)
+			}
+			err = srv.Delete(ctx, seqs, opts.expunge)
+		}
 		if err != nil {
 			if errors.Is(err, email.ErrNotFound) {
-				info := fmt.Sprintf("%s: %s\n", "not found", err.Error())
-				return info, int(SearchNotFound)
+				return opts.fail(exitcode.NotFound, "not found", err)
 			}
 
-			info := fmt.Sprintf("%s: %s\n", "failed to move", err.Error())
-			return info, int(ClientError)
+			return opts.fail(exitcode.Of(err), "failed to "+action, err)
 		}
 
-		if status {
+		if opts.status {
 			info := fmt.Sprintf("status%v\n", "OK")
-			return info, int(OK)
+			return info, int(exitcode.OK)
 		}
 
 		info := fmt.Sprintf("%v\n", "OK")
-		return info, int(OK)
-	case "archive":
-		seqnum, err := strconv.Atoi(query)
+		return opts.done(exitcode.OK, result{Status: "OK", Seqs: seqs}, info)
+	case "read":
+		seqnum, err := opts.seqnum(ctx, srv, query)
 		if err != nil {
-			info := fmt.Sprintf("%s: %s\n", "invalid sequence number", err.Error())
-			return info, int(ClientError)
+			return opts.fail(exitcode.Of(err), "failed to find the email", err)
+		}
+
+		if opts.archive && opts.dryRun {
+			return opts.previewSet(ctx, srv, "archive", imap.SeqSetNum(seqnum))
 		}
-		err = srv.Archive([]uint32{uint32(seqnum)})
+
+		res, err := srv.Read(ctx, seqnum)
 		if err != nil {
 			if errors.Is(err, email.ErrNotFound) {
-				info := fmt.Sprintf("%s: %s\n", "not found", err.Error())
-				return info, int(ArchiveError)
+				return opts.fail(exitcode.NotFound, "not found", err)
 			}
 
-			info := fmt.Sprintf("%s: %s\n", "failed to archive", err.Error())
-			return info, int(ClientError)
+			return opts.fail(exitcode.Of(err), "failed to read", err)
 		}
 
-		if status {
+		if opts.archive {
+			err = srv.Archive(ctx, []uint32{seqnum})
+			if err != nil {
+				return opts.fail(exitcode.Of(err), "failed to archive", err)
+			}
+		}
+
+		if opts.status {
+			info := fmt.Sprintf("status%v\n", res.Body)
+			return info, int(exitcode.OK)
+		}
+
+		return opts.done(exitcode.OK, message(*res), readText(*res))
+	case "mark":
+		uidSet, err := email.ParseUIDSet(query)
+		if err != nil {
+			return opts.fail(exitcode.Usage, "invalid uid set", err)
+		}
+
+		set, unset, err := opts.flags()
+		if err != nil {
+			return opts.fail(exitcode.Usage, "invalid flags", err)
+		}
+		if len(set)+len(unset) == 0 {
+			return opts.fail(exitcode.Usage, "nothing to mark, use --seen, --unseen, --flagged, --unflagged, --keyword or --no-keyword", nil)
+		}
+		if opts.dryRun {
+			return opts.previewSet(ctx, srv, "mark", uidSet)
+		}
+
+		if len(set) > 0 {
+			err = srv.AddFlags(ctx, uidSet, set...)
+		}
+		if err == nil && len(unset) > 0 {
+			err = srv.RemoveFlags(ctx, uidSet, unset...)
+		}
+		if err != nil {
+			return opts.fail(exitcode.Of(err), "failed to mark", err)
+		}
+
+		if opts.status {
 			info := fmt.Sprintf("status%v\n", "OK")
-			return info, int(OK)
+			return info, int(exitcode.OK)
 		}
 
-		info := fmt.Sprintf("%v\n", "OK")
-		return info, int(OK)
-	case "read":
-		seqnum, err := strconv.Atoi(query)
+		return opts.done(exitcode.OK, result{Status: "OK"}, "OK\n")
+	case "labels":
+		labels, err := srv.Labels(ctx, query)
 		if err != nil {
-			info := fmt.Sprintf("%s: %s\n", "invalid sequence number", err.Error())
-			return info, int(ClientError)
+			if errors.Is(err, email.ErrNotFound) {
+				return opts.fail(exitcode.NotFound, "not found", err)
+			}
+
+			return opts.fail(exitcode.Of(err), "failed to list labels", err)
 		}
 
-		res, err := srv.Body(uint32(seqnum))
+		return opts.done(exitcode.OK, labels, strings.Join(labels, "\n"))
+	case "label":
+		uidSet, err := email.ParseUIDSet(query)
+		if err != nil {
+			return opts.fail(exitcode.Usage, "invalid uid set", err)
+		}
+
+		if len(opts.labels)+len(opts.noLabels) == 0 {
+			return opts.fail(exitcode.Usage, "nothing to label, use --label or --no-label", nil)
+		}
+		for _, l := range slices.Concat(opts.labels, opts.noLabels) {
+			err = email.ValidLabel(l)
+			if err != nil {
+				return opts.fail(exitcode.Usage, "invalid labels", err)
+			}
+		}
+		if opts.dryRun {
+			return opts.previewSet(ctx, srv, "label", uidSet)
+		}
+
+		if len(opts.labels) > 0 {
+			err = srv.AddLabels(ctx, uidSet, opts.labels...)
+		}
+		if err == nil && len(opts.noLabels) > 0 {
+			err = srv.RemoveLabels(ctx, uidSet, opts.noLabels...)
+		}
+		if err != nil {
+			return opts.fail(exitcode.Of(err), "failed to label", err)
+		}
+
+		if opts.status {
+			info := fmt.Sprintf("status%v\n", "OK")
+			return info, int(exitcode.OK)
+		}
+
+		return opts.done(exitcode.OK, result{Status: "OK"}, "OK\n")
+	case "threads":
+		if opts.limit < 0 || opts.offset < 0 {
+			return opts.fail(exitcode.Usage, "--limit and --offset must not be negative", nil)
+		}
+
+		set, unset, err := opts.flags()
+		if err != nil {
+			return opts.fail(exitcode.Usage, "invalid flags", err)
+		}
+
+		page := email.Page{Limit: opts.limit, Offset: opts.offset}
+		var threads []email.Thread
+		if opts.gmail {
+			if opts.from != "" || len(set)+len(unset) > 0 {
+				return opts.fail(exitcode.Usage, "--gmail takes Gmail's search syntax, use from:, is:unread or label: in the query", nil)
+			}
+			threads, err = srv.GmailThreads(ctx, query, page)
+		} else {
+			q := email.Query{Subject: query, From: opts.from, Flags: set, NotFlags: unset}
+			threads, err = srv.Threads(ctx, q, page)
+		}
 		if err != nil {
 			if errors.Is(err, email.ErrNotFound) {
-				info := fmt.Sprintf("%s: %s\n", "not found", err.Error())
-				return info, int(SearchNotFound)
+				return opts.fail(exitcode.NotFound, "not found", err)
 			}
 
-			info := fmt.Sprintf("%s: %s\n", "failed to read", err.Error())
-			return info, int(ClientError)
+			return opts.fail(exitcode.Of(err), "failed to thread", err)
 		}
 
-		if archive {
-			err = srv.Archive([]uint32{uint32(seqnum)})
+		// archiving a thread archives every email of the conversation,
+		// not only the ones matching the query
+		var msgs []email.Message
+		var seqnums []uint32
+		for _, t := range threads {
+			for _, m := range t.Messages {
+				msgs = append(msgs, m)
+				seqnums = append(seqnums, m.Seq)
+			}
+		}
+		if opts.archive && opts.dryRun {
+			return opts.preview("archive", msgs)
+		}
+		if opts.archive {
+			if opts.gmail {
+				err = srv.GmailArchive(ctx, seqnums)
+			} else {
+				err = srv.Archive(ctx, seqnums)
+			}
 			if err != nil {
-				info := fmt.Sprintf("%s: %s\n", "failed to archive", err.Error())
-				return info, int(ArchiveError)
+				return opts.fail(exitcode.Of(err), fmt.Sprintf("%s %v", "failed to archive", seqnums), err)
 			}
 		}
 
-		if status {
-			info := fmt.Sprintf("status%v\n", res)
-			return info, int(SearchFound)
+		if opts.status {
+			return fmt.Sprintf("status%v\n", threadList(threads)), int(exitcode.OK)
 		}
 
-		info := fmt.Sprintf("%v\n", res)
-		return info, int(OK)
+		return opts.done(exitcode.OK, threadList(threads), threadList(threads).String())
+	case "export":
+		return exportCommand(ctx, srv, opts, query)
+	case "import":
+		return importCommand(ctx, srv, opts, query)
+	case "undo":
+		return opts.fail(exitcode.DaemonUnavailable, "undo needs the daemon, it keeps the log of recent moves", nil)
 	default:
-		return "Unknown command", int(Unknown)
+		return opts.fail(exitcode.Usage, "Unknown command", nil)
 	}
 }
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+	"github.com/thesoulless/watchmyback/services/email"
+)
+
+const (
+	formatMbox    = "mbox"
+	formatMaildir = "maildir"
+	formatEML     = "eml"
+)
+
+func validFormat(format string) error {
+	switch format {
+	case formatMbox, formatMaildir, formatEML:
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, use mbox, maildir or eml", format)
+	}
+}
+
+// checkpoint is how far the export to a destination went, exporting there
+// again goes on after it. It is kept once done, so a later export only adds
+// the new emails.
+type checkpoint struct {
+	Mailbox     string `json:"mailbox"`
+	Format      string `json:"format"`
+	UIDValidity uint32 `json:"uidvalidity"`
+	UID         uint32 `json:"uid"`
+	Count       int    `json:"count"`
+	// Size is the length of the mbox after the last email, one that was
+	// partly written is cut off when resuming
+	Size int64 `json:"size,omitempty"`
+
+	path string
+}
+
+func readCheckpoint(dest, format string) (*checkpoint, error) {
+	path := filepath.Join(dest, ".wmb-checkpoint")
+	if format == formatMbox {
+		path = dest + ".checkpoint"
+	}
+	c := &checkpoint{path: path}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+func (c *checkpoint) save() error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(c.path, b)
+}
+
+// writeFile replaces path with b at once, so an interrupted write leaves
+// the previous content.
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, b, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// exporter writes emails to a destination, write returns the size of an
+// mbox once the email is written.
+type exporter interface {
+	write(m email.RawMessage) (int64, error)
+	Close() error
+}
+
+func openExporter(format, dest string, c *checkpoint) (exporter, error) {
+	switch format {
+	case formatMbox:
+		f, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		err = resumeMbox(f, c)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &mboxExporter{f: f, w: bufio.NewWriter(f), size: c.Size}, nil
+	case formatMaildir:
+		for _, dir := range []string{"tmp", "new", "cur"} {
+			err := os.MkdirAll(filepath.Join(dest, dir), 0o700)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return maildirExporter(dest), nil
+	default:
+		err := os.MkdirAll(dest, 0o700)
+		if err != nil {
+			return nil, err
+		}
+		return emlExporter(dest), nil
+	}
+}
+
+// resumeMbox drops what an interrupted export wrote to f after the
+// checkpoint. Without one f has to be empty, it is not an export to go on
+// with.
+func resumeMbox(f *os.File, c *checkpoint) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c.Mailbox == "" && st.Size() > 0:
+		return exitcode.WithCode(exitcode.Usage, fmt.Errorf("%s exists without a checkpoint, export to another destination", f.Name()))
+	case st.Size() < c.Size:
+		return fmt.Errorf("%s is shorter than its checkpoint, it was changed since the export", f.Name())
+	}
+
+	err = f.Truncate(c.Size)
+	if err == nil {
+		_, err = f.Seek(c.Size, io.SeekStart)
+	}
+
+	return err
+}
+
+// mboxExporter writes mboxrd: lines starting with From, after any number of
+// >, get one more. The flags are kept in the Status, X-Status and X-Keywords
+// headers like mutt and Dovecot do.
+type mboxExporter struct {
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func (e *mboxExporter) write(m email.RawMessage) (int64, error) {
+	var status, xstatus string
+	var keywords []string
+	for _, f := range m.Flags {
+		switch strings.ToLower(f) {
+		case `\seen`:
+			status = "R"
+		case `\answered`:
+			xstatus += "A"
+		case `\flagged`:
+			xstatus += "F"
+		case `\draft`:
+			xstatus += "T"
+		case `\deleted`:
+			xstatus += "D"
+		default:
+			if !strings.HasPrefix(f, `\`) {
+				keywords = append(keywords, f)
+			}
+		}
+	}
+
+	n := 0
+	write := func(s string) {
+		k, _ := e.w.WriteString(s)
+		n += k
+	}
+	write(fmt.Sprintf("From MAILER-DAEMON %s\n", m.Date.UTC().Format(time.ANSIC)))
+	write("Status: " + status + "O\n")
+	if xstatus != "" {
+		write("X-Status: " + xstatus + "\n")
+	}
+	if len(keywords) > 0 {
+		write("X-Keywords: " + strings.Join(keywords, " ") + "\n")
+	}
+
+	r := bufio.NewReader(m.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				line = ">" + line
+			}
+			write(line + "\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	write("\n")
+
+	err := e.w.Flush()
+	if err != nil {
+		return 0, err
+	}
+	e.size += int64(n)
+
+	return e.size, nil
+}
+
+func (e *mboxExporter) Close() error {
+	return e.f.Close()
+}
+
+// maildirExporter names the emails after their internal date, UID and
+// UIDVALIDITY, so exporting one again replaces it.
+type maildirExporter string
+
+// maildirFlags are the letters of the info of Maildir file names, in the
+// order they have to be in.
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', `\Draft`},
+	{'F', `\Flagged`},
+	{'P', "$Forwarded"},
+	{'R', `\Answered`},
+	{'S', `\Seen`},
+	{'T', `\Deleted`},
+}
+
+func (dir maildirExporter) write(m email.RawMessage) (int64, error) {
+	info := ":2,"
+	for _, f := range maildirFlags {
+		if slices.ContainsFunc(m.Flags, func(flag string) bool { return strings.EqualFold(flag, f.flag) }) {
+			info += string(f.letter)
+		}
+	}
+	name := fmt.Sprintf("%d.U%dV%d.wmb", m.Date.Unix(), m.UID, m.UIDValidity)
+
+	tmp := filepath.Join(string(dir), "tmp", name)
+	err := writeMessage(tmp, m, true)
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, os.Rename(tmp, filepath.Join(string(dir), "cur", name+info))
+}
+
+func (dir maildirExporter) Close() error {
+	return nil
+}
+
+// emlExporter writes every email as it is to <uid>.eml, the flags are lost.
+type emlExporter string
+
+func (dir emlExporter) write(m email.RawMessage) (int64, error) {
+	path := filepath.Join(string(dir), fmt.Sprintf("%d.eml", m.UID))
+	err := writeMessage(path+".tmp", m, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, os.Rename(path+".tmp", path)
+}
+
+func (dir emlExporter) Close() error {
+	return nil
+}
+
+// writeMessage writes the body of m to path, with LF line endings for lf,
+// dated with its internal date.
+func writeMessage(path string, m email.RawMessage, lf bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if lf {
+		err = copyLF(f, m.Body)
+	} else {
+		_, err = io.Copy(f, m.Body)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, m.Date, m.Date)
+}
+
+// copyLF copies r to w with LF line endings.
+func copyLF(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadSlice('\n')
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			line = append(line[:len(line)-2], '\n')
+		}
+		_, werr := w.Write(line)
+		switch {
+		case werr != nil:
+			return werr
+		case err == io.EOF:
+			return nil
+		case err != nil && err != bufio.ErrBufferFull:
+			return err
+		}
+	}
+}
+
+// transferResult reports an export or an import.
+type transferResult struct {
+	Action  string `json:"action" yaml:"action"`
+	Mailbox string `json:"mailbox" yaml:"mailbox"`
+	Format  string `json:"format" yaml:"format"`
+	Path    string `json:"path" yaml:"path"`
+	Count   int    `json:"count" yaml:"count"`
+	// Total counts the emails of every export to Path
+	Total int `json:"total,omitempty" yaml:"total,omitempty"`
+}
+
+func (r transferResult) table(w io.Writer) {
+	fmt.Fprintln(w, "ACTION\tMAILBOX\tFORMAT\tPATH\tEMAILS\tTOTAL")
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", r.Action, r.Mailbox, r.Format, r.Path, r.Count, r.Total)
+}
+
+func (r transferResult) String() string {
+	if r.Action == "import" {
+		return fmt.Sprintf("imported %d email(s) from %s to %s", r.Count, r.Path, r.Mailbox)
+	}
+
+	return fmt.Sprintf("exported %d email(s) from %s to %s, %d in total", r.Count, r.Mailbox, r.Path, r.Total)
+}
+
+// parseDay parses a --since or --until date.
+func parseDay(flag, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --%s %q, use YYYY-MM-DD", flag, s)
+	}
+
+	return t, nil
+}
+
+// exportCommand exports the emails of --mailbox to dest, it goes on after
+// the checkpoint of a previous export there.
+func exportCommand(ctx context.Context, srv *email.Core, opts emailOptions, dest string) (string, int) {
+	format := opts.format
+	if format == "" {
+		format = formatMbox
+	}
+	err := validFormat(format)
+	if err != nil {
+		return opts.fail(exitcode.Usage, "invalid format", err)
+	}
+
+	since, err := parseDay("since", opts.since)
+	if err != nil {
+		return opts.fail(exitcode.Usage, "invalid dates", err)
+	}
+	until, err := parseDay("until", opts.until)
+	if err != nil {
+		return opts.fail(exitcode.Usage, "invalid dates", err)
+	}
+
+	c, err := readCheckpoint(dest, format)
+	if err != nil {
+		return opts.fail(exitcode.Error, "failed to resume", err)
+	}
+	if c.Mailbox != "" && (c.Mailbox != opts.mailbox || c.Format != format) {
+		msg := fmt.Sprintf("%s holds an export of %s as %s, export %s to another destination", dest, c.Mailbox, c.Format, opts.mailbox)
+		return opts.fail(exitcode.Usage, msg, nil)
+	}
+
+	exp, err := openExporter(format, dest, c)
+	if err != nil {
+		return opts.fail(exitcode.Of(err), "failed to open the destination", err)
+	}
+	defer exp.Close()
+
+	res := transferResult{Action: "export", Mailbox: opts.mailbox, Format: format, Path: dest}
+	err = srv.Export(ctx, email.ExportOptions{
+		Mailbox:     opts.mailbox,
+		Since:       since,
+		Until:       until,
+		After:       c.UID,
+		UIDValidity: c.UIDValidity,
+	}, func(m email.RawMessage) error {
+		size, err := exp.write(m)
+		if err != nil {
+			return fmt.Errorf("failed to write uid %d: %w", m.UID, err)
+		}
+		c.Mailbox, c.Format, c.UIDValidity, c.UID, c.Size = opts.mailbox, format, m.UIDValidity, m.UID, size
+		c.Count++
+		res.Count++
+		return c.save()
+	})
+	res.Total = c.Count
+	if err != nil {
+		msg := fmt.Sprintf("failed after exporting %d email(s), run it again to resume", res.Count)
+		return opts.fail(exitcode.Of(err), msg, err)
+	}
+
+	if opts.status {
+		return fmt.Sprintf("status%v\n", "OK"), int(exitcode.OK)
+	}
+
+	return opts.done(exitcode.OK, res, res.String())
+}
+
+// importCommand appends the emails of src to --mailbox, the format is told
+// by src unless --format is set: a directory with cur is a Maildir, other
+// directories and .eml files hold emails and other files are mboxes.
+func importCommand(ctx context.Context, srv *email.Core, opts emailOptions, src string) (string, int) {
+	format := opts.format
+	if format == "" {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return opts.fail(exitcode.Usage, "failed to read the source", err)
+		}
+		_, cerr := os.Stat(filepath.Join(src, "cur"))
+		switch {
+		case fi.IsDir() && cerr == nil:
+			format = formatMaildir
+		case fi.IsDir() || strings.HasSuffix(src, ".eml"):
+			format = formatEML
+		default:
+			format = formatMbox
+		}
+	}
+	err := validFormat(format)
+	if err != nil {
+		return opts.fail(exitcode.Usage, "invalid format", err)
+	}
+
+	read := readEML
+	switch format {
+	case formatMbox:
+		read = readMbox
+	case formatMaildir:
+		read = readMaildir
+	}
+
+	res := transferResult{Action: "import", Mailbox: opts.mailbox, Format: format, Path: src}
+	err = read(src, func(m email.RawMessage) error {
+		if !opts.dryRun {
+			err := srv.Append(ctx, opts.mailbox, m)
+			if err != nil {
+				return err
+			}
+		}
+		res.Count++
+		return nil
+	})
+	if err != nil {
+		return opts.fail(exitcode.Of(err), fmt.Sprintf("failed after importing %d email(s)", res.Count), err)
+	}
+
+	if opts.dryRun {
+		return opts.done(exitcode.OK, res, fmt.Sprintf("would append %d email(s) from %s to %s", res.Count, src, opts.mailbox))
+	}
+	if opts.status {
+		return fmt.Sprintf("status%v\n", "OK"), int(exitcode.OK)
+	}
+
+	return opts.done(exitcode.OK, res, res.String())
+}
+
+// rawMessage returns b, with CRLF line endings as APPEND needs them.
+func rawMessage(b []byte, flags []string, date time.Time) email.RawMessage {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	b = bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+
+	return email.RawMessage{Flags: flags, Date: date, Size: int64(len(b)), Body: bytes.NewReader(b)}
+}
+
+// readMbox reads the mboxrd written by export, the flags are taken from
+// the Status, X-Status and X-Keywords headers, which are dropped.
+func readMbox(path string, f func(email.RawMessage) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var msg bytes.Buffer
+	var flags []string
+	var date time.Time
+	started, header, skipping := false, false, false
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		// the empty line separating the emails is not part of them
+		b := bytes.TrimSuffix(msg.Bytes(), []byte("\n"))
+		err := f(rawMessage(b, flags, date))
+		msg.Reset()
+		flags, date = nil, time.Time{}
+		return err
+	}
+
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		switch {
+		case strings.HasPrefix(line, "From "):
+			ferr := flush()
+			if ferr != nil {
+				return ferr
+			}
+			started, header, skipping = true, true, false
+			// From sender Mon Jan  2 15:04:05 2006
+			if fields := strings.Fields(line); len(fields) >= 7 {
+				date, _ = time.Parse("Mon Jan 2 15:04:05 2006", strings.Join(fields[2:7], " "))
+			}
+		case !started:
+		case header && line == "":
+			header = false
+			msg.WriteString("\n")
+		case header && skipping && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")):
+		case header:
+			name, value, _ := strings.Cut(line, ":")
+			skipping = true
+			switch strings.ToLower(name) {
+			case "status":
+				if strings.Contains(value, "R") {
+					flags = append(flags, `\Seen`)
+				}
+			case "x-status":
+				for _, l := range []struct{ letter, flag string }{{"A", `\Answered`}, {"F", `\Flagged`}, {"T", `\Draft`}, {"D", `\Deleted`}} {
+					if strings.Contains(value, l.letter) {
+						flags = append(flags, l.flag)
+					}
+				}
+			case "x-keywords":
+				flags = append(flags, strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })...)
+			default:
+				skipping = false
+				msg.WriteString(line + "\n")
+			}
+		default:
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				line = line[1:]
+			}
+			msg.WriteString(line + "\n")
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return flush()
+}
+
+// readMaildir reads the emails of new and cur, with the flags of their
+// file names and their modification time as the internal date.
+func readMaildir(dir string, f func(email.RawMessage) error) error {
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			var flags []string
+			if _, info, ok := strings.Cut(entry.Name(), ":2,"); ok {
+				for _, mf := range maildirFlags {
+					if strings.IndexByte(info, mf.letter) >= 0 {
+						flags = append(flags, mf.flag)
+					}
+				}
+			}
+
+			err = readFile(filepath.Join(dir, sub, entry.Name()), flags, f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readEML reads an .eml file or the ones of a directory, in name order.
+func readEML(path string, f func(email.RawMessage) error) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return readFile(path, nil, f)
+	}
+
+	names, err := filepath.Glob(filepath.Join(path, "*.eml"))
+	if err != nil {
+		return err
+	}
+	// by length first, so 10.eml comes after 9.eml
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+	})
+	for _, name := range names {
+		err = readFile(name, nil, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readFile(path string, flags []string, f func(email.RawMessage) error) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	return f(rawMessage(b, flags, fi.ModTime()))
+}
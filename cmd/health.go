@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/metrics"
+	"github.com/thesoulless/watchmyback/services/email"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+// serveHTTP starts the health and metrics listener, it is stopped when ctx
+// is done.
+func (d *daemon) serveHTTP(ctx context.Context, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid --http address: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		log.Warn("health and metrics listener is not bound to localhost", "address", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", d.readyz)
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := srv.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("health and metrics listener failed", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+
+	log.Info("serving health and metrics", "address", l.Addr().String())
+	return nil
+}
+
+// readyz answers 200 once every service is connected, and 503 with the
+// services that are not otherwise.
+func (d *daemon) readyz(w http.ResponseWriter, r *http.Request) {
+	var failing []serviceStatus
+	for _, s := range d.status().Services {
+		if s.State != email.StateConnected {
+			failing = append(failing, s)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(failing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{"ready": false, "services": failing})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"ready": true})
+}
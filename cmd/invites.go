@@ -0,0 +1,148 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+	"github.com/thesoulless/watchmyback/services/email"
+)
+
+type inviteList []email.Invite
+
+func (l inviteList) table(w io.Writer) {
+	fmt.Fprintln(w, "UID\tMETHOD\tSTART\tSUMMARY\tORGANIZER\tLOCATION")
+	for _, i := range l {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", i.UID, i.Method, eventTime(i.Event), i.Summary, i.Organizer, i.Location)
+	}
+}
+
+// eventTime formats the start of ev in the local time zone.
+func eventTime(ev email.Event) string {
+	if ev.AllDay {
+		return ev.Start.Format("Mon 2006-01-02")
+	}
+
+	return ev.Start.Local().Format("Mon 2006-01-02 15:04 MST")
+}
+
+// eventText describes ev for the text output of read.
+func eventText(ev email.Event) string {
+	kind := "Event"
+	switch {
+	case ev.Canceled():
+		kind = "Canceled"
+	case ev.Method == email.MethodRequest:
+		kind = "Invitation"
+	}
+
+	lines := []string{fmt.Sprintf("%s: %s", kind, ev.Summary)}
+	when := eventTime(ev)
+	if !ev.End.Equal(ev.Start) && !ev.AllDay {
+		when += " to " + ev.End.Local().Format("Mon 2006-01-02 15:04 MST")
+	}
+	lines = append(lines, "When: "+when)
+	if ev.RRule != "" {
+		lines = append(lines, "Repeats: "+ev.RRule)
+	}
+	if ev.Location != "" {
+		lines = append(lines, "Where: "+ev.Location)
+	}
+	if ev.Organizer != "" {
+		lines = append(lines, "Organizer: "+ev.Organizer)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// readText is the text output of read, the body followed by the events of
+// the invitations.
+func readText(m email.Message) string {
+	text := fmt.Sprintf("%v\n", m.Body)
+	for _, ev := range m.Events {
+		text += "\n" + eventText(ev) + "\n"
+	}
+
+	return text
+}
+
+// pending returns the invitations of invites that are still ahead of now
+// and not called off, by start. Of the updates of an event only the last
+// one, by SEQUENCE and then by arrival, counts.
+func pending(invites []email.Invite, now time.Time) []email.Invite {
+	latest := map[string]email.Invite{}
+	for _, i := range invites {
+		prev, ok := latest[i.ID]
+		if !ok || i.Sequence > prev.Sequence || i.Sequence == prev.Sequence && i.UID > prev.UID {
+			latest[i.ID] = i
+		}
+	}
+
+	var res []email.Invite
+	for _, i := range latest {
+		if i.Method == email.MethodRequest && !i.Canceled() && i.Upcoming(now) {
+			res = append(res, i)
+		}
+	}
+	slices.SortFunc(res, func(a, b email.Invite) int {
+		return cmp.Or(a.Start.Compare(b.Start), cmp.Compare(a.ID, b.ID))
+	})
+
+	return res
+}
+
+// invitesCommand lists the events of the invitations matching query, with
+// --upcoming the pending ones by start, otherwise every event of the
+// newest emails.
+func invitesCommand(ctx context.Context, srv *email.Core, opts emailOptions, query string) (string, int) {
+	if opts.limit < 0 || opts.offset < 0 {
+		return opts.fail(exitcode.Usage, "--limit and --offset must not be negative", nil)
+	}
+
+	// --upcoming pages the events, which are only known once every email
+	// is read
+	page := email.Page{Limit: opts.limit, Offset: opts.offset}
+	if opts.upcoming {
+		page = email.Page{}
+	}
+
+	q := email.Query{Subject: query, From: opts.from}
+	res, err := srv.Invites(ctx, q, page)
+	if err != nil && !errors.Is(err, email.ErrNotFound) {
+		return opts.fail(exitcode.Of(err), "failed to look for invitations", err)
+	}
+
+	if opts.upcoming {
+		res = pending(res, time.Now())
+		res = res[min(opts.offset, len(res)):]
+		if opts.limit > 0 && opts.limit < len(res) {
+			res = res[:opts.limit]
+		}
+	}
+	if len(res) == 0 {
+		return opts.fail(exitcode.NotFound, "no invitations found", nil)
+	}
+
+	lines := make([]string, len(res))
+	for i, inv := range res {
+		lines[i] = fmt.Sprintf("%s  %s", eventTime(inv.Event), inv.Summary)
+		if inv.Location != "" {
+			lines[i] += " @ " + inv.Location
+		}
+		if inv.Canceled() {
+			lines[i] += " (canceled)"
+		}
+	}
+
+	if opts.status {
+		return fmt.Sprintf("status%v\n", lines), int(exitcode.OK)
+	}
+
+	return opts.done(exitcode.OK, inviteList(res), strings.Join(lines, "\n"))
+}
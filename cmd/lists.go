@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+	"github.com/thesoulless/watchmyback/services/email"
+)
+
+type listList []email.List
+
+func (l listList) table(w io.Writer) {
+	fmt.Fprintln(w, "ID\tNAME\tCOUNT\tLAST SEEN\tUNSUBSCRIBE")
+	for _, list := range l {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", list.ID, list.Name, list.Count, list.LastSeen.Format(time.DateOnly), unsubscribeKind(list))
+	}
+}
+
+// unsubscribeKind tells how list can be unsubscribed from: one-click,
+// mailto, link when it only has a page to open, or none.
+func unsubscribeKind(list email.List) string {
+	u, err := list.Unsubscription()
+	switch {
+	case err == nil && u.Method == email.UnsubscribePost:
+		return "one-click"
+	case err == nil:
+		return u.Method
+	case len(list.Unsubscribe) > 0:
+		return "link"
+	default:
+		return "none"
+	}
+}
+
+type unsubscribeResult struct {
+	email.Unsubscription `yaml:",inline"`
+	DryRun               bool `json:"dry_run,omitempty" yaml:"dry_run,omitempty"`
+}
+
+func (r unsubscribeResult) table(w io.Writer) {
+	fmt.Fprintln(w, "LIST\tMETHOD\tTARGET\tDRY RUN")
+	fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", r.List, r.Method, r.Target, r.DryRun)
+}
+
+func (r unsubscribeResult) String() string {
+	action := "unsubscribed from"
+	if r.DryRun {
+		action = "would unsubscribe from"
+	}
+	if r.Method == email.UnsubscribePost {
+		return fmt.Sprintf("%s %s with a POST to %s", action, r.List, r.Target)
+	}
+
+	to, _, _ := strings.Cut(r.Target[len("mailto:"):], "?")
+	return fmt.Sprintf("%s %s with an email to %s", action, r.List, to)
+}
+
+// listsCommand prints the lists and newsletters of the emails matching
+// query, the ones with the most emails first.
+func listsCommand(ctx context.Context, srv *email.Core, opts emailOptions, query string) (string, int) {
+	if opts.limit < 0 || opts.offset < 0 {
+		return opts.fail(exitcode.Usage, "--limit and --offset must not be negative", nil)
+	}
+
+	res, err := srv.Lists(ctx, email.Query{Subject: query, From: opts.from})
+	if err != nil {
+		if errors.Is(err, email.ErrNotFound) {
+			return opts.fail(exitcode.NotFound, "no lists found", err)
+		}
+
+		return opts.fail(exitcode.Of(err), "failed to list", err)
+	}
+
+	res = res[min(opts.offset, len(res)):]
+	if opts.limit > 0 && opts.limit < len(res) {
+		res = res[:opts.limit]
+	}
+
+	lines := make([]string, len(res))
+	for i, l := range res {
+		lines[i] = fmt.Sprintf("%4d  %s  %s", l.Count, l.LastSeen.Format(time.DateOnly), l.ID)
+		if l.Name != "" {
+			lines[i] += " (" + l.Name + ")"
+		}
+		lines[i] += "  " + unsubscribeKind(l)
+	}
+
+	if opts.status {
+		return fmt.Sprintf("status%v\n", lines), int(exitcode.OK)
+	}
+
+	return opts.done(exitcode.OK, listList(res), strings.Join(lines, "\n"))
+}
+
+// unsubscribeCommand unsubscribes from the list id, a List-Id or a sender
+// as printed by lists, with the List-Unsubscribe of its newest email.
+func unsubscribeCommand(ctx context.Context, srv *email.Core, opts emailOptions, id string) (string, int) {
+	list, err := findList(ctx, srv, id)
+	if err != nil {
+		if errors.Is(err, email.ErrNotFound) {
+			return opts.fail(exitcode.NotFound, fmt.Sprintf("no list %q", id), err)
+		}
+
+		return opts.fail(exitcode.Of(err), "failed to find the list", err)
+	}
+
+	var u email.Unsubscription
+	if opts.dryRun {
+		u, err = list.Unsubscription()
+	} else {
+		u, err = srv.Unsubscribe(ctx, list)
+	}
+	if err != nil {
+		return opts.fail(exitcode.Of(err), "failed to unsubscribe", err)
+	}
+
+	res := unsubscribeResult{Unsubscription: u, DryRun: opts.dryRun}
+	if opts.status {
+		return fmt.Sprintf("status%v\n", "OK"), int(exitcode.OK)
+	}
+
+	return opts.done(exitcode.OK, res, res.String())
+}
+
+// findList looks id up as a List-Id, and then as the sender of a list
+// without one.
+func findList(ctx context.Context, srv *email.Core, id string) (email.List, error) {
+	id = strings.ToLower(id)
+	for _, q := range []email.Query{{ListID: id}, {From: id}} {
+		lists, err := srv.Lists(ctx, q)
+		if err != nil && !errors.Is(err, email.ErrNotFound) {
+			return email.List{}, err
+		}
+		for _, l := range lists {
+			if l.ID == id {
+				return l, nil
+			}
+		}
+	}
+
+	return email.List{}, email.ErrNotFound
+}
@@ -3,19 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
 
-	"github.com/thesoulless/watchmyback/services/email"
-
-	"gopkg.in/yaml.v3"
+	"github.com/thesoulless/watchmyback/internal/config"
+	"github.com/thesoulless/watchmyback/internal/exitcode"
 )
 
 var (
 	log = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	// version is set at build time with -ldflags "-X main.version=..."
+	version = "dev"
 )
 
 // Execute executes the root command.
@@ -29,12 +31,18 @@ func main() {
 	ctx := context.Background()
 	err := run(ctx)
 	if err != nil {
-		log.Error("faild to run", "error", err)
+		code := exitcode.Of(err)
+		if output != outputText {
+			fmt.Print(renderError(output, err.Error(), int(code)))
+		} else {
+			log.Error("faild to run", "error", err)
+		}
+		os.Exit(int(code))
 	}
 }
 
 const (
-	unixSocket = "/tmp/app.sock"
+	socketName = "wmb.sock"
 	tcpPort    = "127.0.0.1:8080"
 )
 
@@ -42,22 +50,92 @@ func getAddress() string {
 	if runtime.GOOS == "windows" {
 		return tcpPort
 	}
-	return unixSocket
+	return socketPath()
+}
+
+func defaultSocketPath() string {
+	return filepath.Join(runtimeDir(), socketName)
+}
+
+// socketPath returns the daemon socket from --socket, $WMB_SOCKET, the
+// daemon section of the config file or $XDG_RUNTIME_DIR/wmb/wmb.sock, in
+// that order.
+func socketPath() string {
+	if socketFile != "" {
+		return socketFile
+	}
+	if p := os.Getenv("WMB_SOCKET"); p != "" {
+		return p
+	}
+
+	// the client has no use for an invalid config, the daemon refuses it
+	// anyway
+	if conf, err := readConfig(cfgFile); err == nil && conf.Daemon.Socket != "" {
+		return conf.Daemon.Socket
+	}
+
+	return defaultSocketPath()
 }
 
-func listen() (net.Listener, error) {
+// listen creates the daemon socket. Its directory is only accessible by
+// the owner, unless shared is set because groups are allowed to connect,
+// in which case the peer credentials are the only check.
+func listen(shared bool) (net.Listener, error) {
+	l, ok, err := activationListener()
+	if ok {
+		return l, err
+	}
+
 	if runtime.GOOS == "windows" {
 		return net.Listen("tcp", tcpPort)
 	}
-	os.Remove(unixSocket)
-	return net.Listen("unix", unixSocket)
+
+	path := socketPath()
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket dir: %w", err)
+	}
+
+	// never change the mode of a directory we do not own, like /tmp
+	if dir == runtimeDir() {
+		mode := os.FileMode(0o700)
+		if shared {
+			mode = 0o711
+		}
+		err = os.Chmod(dir, mode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to secure socket dir: %w", err)
+		}
+	}
+
+	os.Remove(path)
+	l, err = net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := os.FileMode(0o600)
+	if shared {
+		mode = 0o666
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set socket mode: %w", err)
+	}
+
+	return l, nil
 }
 
 func dial() (net.Conn, error) {
+	if addr := remote(); addr != "" {
+		return dialRemote(addr)
+	}
 	if runtime.GOOS == "windows" {
 		return net.Dial("tcp", tcpPort)
 	}
-	return net.Dial("unix", unixSocket)
+	return net.Dial("unix", socketPath())
 }
 
 var (
@@ -65,27 +143,13 @@ var (
 	Version = []byte("1.0")
 )
 
-type T struct {
-	Emails []email.Conf `yaml:"email"`
-}
-
-func readConfig(conf string) (T, error) {
-	t := T{}
-
-	f, err := os.Open(conf)
-	if err != nil {
-		return t, fmt.Errorf("failed to readConfig os.Open: %w", err)
-	}
-	defer f.Close()
-
-	data, err := io.ReadAll(f)
-	if err != nil {
-		return t, fmt.Errorf("failed to readConfig io.ReadAll: %w", err)
-	}
-	err = yaml.Unmarshal([]byte(data), &t)
+// readConfig loads and validates the config file, discovering it when conf
+// is empty.
+func readConfig(conf string) (*config.Config, error) {
+	path, err := config.Find(conf)
 	if err != nil {
-		return t, fmt.Errorf("failed to readConfig yaml.Unmarshal: %w", err)
+		return nil, err
 	}
 
-	return t, nil
+	return config.Load(path)
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+	"github.com/thesoulless/watchmyback/services/email"
+)
+
+// otp --wait first looks for new emails after otpPollInterval, the
+// interval doubles while no code arrives, up to otpPollMax.
+const (
+	otpPollInterval = 2 * time.Second
+	otpPollMax      = 16 * time.Second
+)
+
+// otpPoll is OTPs of the account, the daemon leases a connection for
+// every call so waiting does not hold one.
+type otpPoll func(ctx context.Context, query email.Query, after uint32) ([]email.OTP, uint32, error)
+
+type otpResult email.OTP
+
+func (r otpResult) table(w io.Writer) {
+	fmt.Fprintln(w, "UID\tFROM\tSUBJECT\tCODE\tLINK")
+	fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", r.UID, strings.Join(r.From, ", "), r.Subject, r.Code, r.Link)
+}
+
+// otpCommand prints the code or link of the newest email matching query
+// and --from, with --wait of the first one to arrive within that time.
+func otpCommand(ctx context.Context, opts emailOptions, query string, poll otpPoll) (string, int) {
+	if opts.wait < 0 {
+		return opts.fail(exitcode.Usage, "--wait must not be negative", nil)
+	}
+
+	q := email.Query{Subject: query, From: opts.from}
+	otps, last, err := poll(ctx, q, 0)
+	if err != nil {
+		return opts.fail(exitcode.Of(err), "failed to look for codes", err)
+	}
+
+	if opts.wait == 0 {
+		if len(otps) == 0 {
+			return opts.fail(exitcode.NotFound, "no code or link found", nil)
+		}
+		return opts.otp(otps[0])
+	}
+
+	wait, cancel := context.WithTimeout(ctx, opts.wait)
+	defer cancel()
+	interval := otpPollInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-wait.Done():
+			if ctx.Err() != nil {
+				return opts.fail(exitcode.Of(ctx.Err()), "stopped waiting for a code", ctx.Err())
+			}
+			msg := fmt.Sprintf("no code or link arrived within %s", opts.wait)
+			return opts.fail(exitcode.Timeout, msg, nil)
+		case <-timer.C:
+		}
+		interval = min(2*interval, otpPollMax)
+		timer.Reset(interval)
+
+		otps, last, err = poll(wait, q, last)
+		if err != nil {
+			if wait.Err() != nil {
+				continue
+			}
+			return opts.fail(exitcode.Of(err), "failed to look for codes", err)
+		}
+		if len(otps) > 0 {
+			return opts.otp(otps[0])
+		}
+	}
+}
+
+// otp prints the code, or the link, of res and copies it for --clip.
+func (o emailOptions) otp(res email.OTP) (string, int) {
+	if o.clip {
+		err := copyToClipboard(res.Value())
+		if err != nil {
+			return o.fail(exitcode.Error, "failed to copy to the clipboard", err)
+		}
+	}
+
+	if o.status {
+		return fmt.Sprintf("status%v\n", res.Value()), int(exitcode.OK)
+	}
+
+	return o.done(exitcode.OK, otpResult(res), res.Value())
+}
+
+// clipOTP copies the result of otp --clip forwarded to the daemon with
+// --output json, the clipboard is the one of this machine, and renders it
+// in the requested format.
+func clipOTP(res string, ex int) (string, int) {
+	opts := localOptions()
+	if ex != int(exitcode.OK) {
+		var e errorResult
+		if json.Unmarshal([]byte(res), &e) != nil {
+			return res, ex
+		}
+		return renderError(opts.output, e.Error, ex), ex
+	}
+
+	var o email.OTP
+	err := json.Unmarshal([]byte(res), &o)
+	if err != nil {
+		return opts.fail(exitcode.ProtocolMismatch, "malformed response", err)
+	}
+
+	res, ex = opts.otp(o)
+	if opts.output == outputText {
+		res += "\n"
+	}
+
+	return res, ex
+}
+
+// copyToClipboard writes s to the clipboard with the tool of the platform.
+func copyToClipboard(s string) error {
+	var tools [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		tools = [][]string{{"pbcopy"}}
+	case "windows":
+		tools = [][]string{{"clip.exe"}}
+	default:
+		tools = [][]string{{"wl-copy"}, {"xclip", "-selection", "clipboard"}, {"xsel", "--clipboard", "--input"}}
+	}
+
+	for _, tool := range tools {
+		path, err := exec.LookPath(tool[0])
+		if err != nil {
+			continue
+		}
+		cmd := exec.Command(path, tool[1:]...)
+		cmd.Stdin = strings.NewReader(s)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s failed: %w: %s", tool[0], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	names := make([]string, len(tools))
+	for i, tool := range tools {
+		names[i] = tool[0]
+	}
+	return fmt.Errorf("no clipboard tool found, install %s", strings.Join(names, ", "))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thesoulless/watchmyback/services/email"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	outputText  = "text"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputTable = "table"
+)
+
+func validOutput(format string) error {
+	switch format {
+	case outputText, outputJSON, outputYAML, outputTable:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q, use text, json, yaml or table", format)
+	}
+}
+
+// tabler is implemented by results that have a table rendering, other
+// values fall back to yaml.
+type tabler interface {
+	table(w io.Writer)
+}
+
+type errorResult struct {
+	Error string `json:"error" yaml:"error"`
+	Code  int    `json:"code" yaml:"code"`
+}
+
+// result is returned by commands that only report success.
+type result struct {
+	Status string   `json:"status" yaml:"status"`
+	Seqs   []uint32 `json:"seqs,omitempty" yaml:"seqs,omitempty"`
+}
+
+func render(format string, v any) (string, error) {
+	switch format {
+	case outputJSON:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(v)
+		if err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	case outputTable:
+		if t, ok := v.(tabler); ok {
+			var buf bytes.Buffer
+			w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+			t.table(w)
+			w.Flush()
+			return buf.String(), nil
+		}
+		fallthrough
+	case outputYAML:
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	case outputText:
+		return fmt.Sprintf("%v\n", v), nil
+	default:
+		return "", validOutput(format)
+	}
+}
+
+// renderError formats an error, text output keeps the plain message.
+func renderError(format, msg string, code int) string {
+	if format == outputText || format == "" {
+		return msg + "\n"
+	}
+
+	res, err := render(format, errorResult{Error: msg, Code: code})
+	if err != nil {
+		return msg + "\n"
+	}
+
+	return res
+}
+
+// dryRunResult lists the emails a mutating command would affect.
+type dryRunResult struct {
+	Action   string      `json:"would" yaml:"would"`
+	Messages messageList `json:"messages" yaml:"messages"`
+}
+
+func (d dryRunResult) table(w io.Writer) {
+	fmt.Fprintf(w, "would %s:\n", d.Action)
+	d.Messages.table(w)
+}
+
+type messageList []email.Message
+
+func (l messageList) table(w io.Writer) {
+	fmt.Fprintln(w, "SEQ\tUID\tDATE\tFROM\tSUBJECT\tFLAGS\tSIZE")
+	for _, m := range l {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%d\n",
+			m.Seq, m.UID, m.Date.Format(time.DateTime), strings.Join(m.From, ", "), m.Subject, strings.Join(m.Flags, " "), m.Size)
+	}
+}
+
+type threadList []email.Thread
+
+func (l threadList) table(w io.Writer) {
+	fmt.Fprintln(w, "THREAD\tEMAILS\tUIDS\tSUBJECT")
+	for _, t := range l {
+		uids := make([]string, len(t.Messages))
+		for i, m := range t.Messages {
+			uids[i] = strconv.FormatUint(uint64(m.UID), 10)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", t.ID, len(t.Messages), strings.Join(uids, ","), t.Subject)
+	}
+}
+
+func (l threadList) String() string {
+	lines := make([]string, len(l))
+	for i, t := range l {
+		lines[i] = fmt.Sprintf("%s (%d)", t.Subject, len(t.Messages))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+type message email.Message
+
+func (m message) table(w io.Writer) {
+	fmt.Fprintf(w, "SEQ\t%d\n", m.Seq)
+	fmt.Fprintf(w, "UID\t%d\n", m.UID)
+	fmt.Fprintf(w, "DATE\t%s\n", m.Date.Format(time.DateTime))
+	fmt.Fprintf(w, "FROM\t%s\n", strings.Join(m.From, ", "))
+	fmt.Fprintf(w, "TO\t%s\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(w, "SUBJECT\t%s\n", m.Subject)
+	fmt.Fprintf(w, "FLAGS\t%s\n", strings.Join(m.Flags, " "))
+	fmt.Fprintf(w, "SIZE\t%d\n", m.Size)
+	for _, ev := range m.Events {
+		fmt.Fprintf(w, "EVENT\t%s %s: %s\n", eventTime(ev), ev.Method, ev.Summary)
+	}
+	// the body is printed after the table so tabwriter does not align it
+	fmt.Fprintf(w, "\n%s\n", m.Body)
+}
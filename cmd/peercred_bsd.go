@@ -0,0 +1,40 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCred returns the uid and effective gid of the process on the other
+// end of a unix socket.
+func peerCred(c net.Conn) (uint32, uint32, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return 0, 0, errNoPeerCred
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var cred *unix.Xucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+	if cred.Ngroups < 1 {
+		return 0, 0, errNoPeerCred
+	}
+
+	return cred.Uid, cred.Groups[0], nil
+}
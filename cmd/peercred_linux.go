@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred returns the uid and gid of the process on the other end of a
+// unix socket.
+func peerCred(c net.Conn) (uint32, uint32, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return 0, 0, errNoPeerCred
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+
+	return cred.Uid, cred.Gid, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errAlreadyRunning = errors.New("daemon is already running")
+
+// runtimeDir returns $XDG_RUNTIME_DIR/wmb, falling back to a per user
+// directory in the temp dir.
+func runtimeDir() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("wmb-%d", os.Getuid()))
+	}
+
+	return filepath.Join(dir, "wmb")
+}
+
+func pidPath() string {
+	return filepath.Join(runtimeDir(), "wmb.pid")
+}
+
+// stateDir returns $XDG_STATE_HOME/wmb, it holds the log of a detached
+// daemon.
+func stateDir() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = os.TempDir()
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(dir, "wmb")
+}
+
+// pidFile is held by the running daemon, its lock makes sure only one
+// daemon owns the socket.
+type pidFile struct {
+	f    *os.File
+	path string
+}
+
+func acquirePIDFile(path string) (*pidFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create runtime dir: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pid file: %w", err)
+	}
+
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		if pid, perr := readPID(path); perr == nil {
+			return nil, fmt.Errorf("%w (pid %d)", errAlreadyRunning, pid)
+		}
+		return nil, fmt.Errorf("%w: %w", errAlreadyRunning, err)
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write pid file: %w", err)
+	}
+
+	return &pidFile{f: f, path: path}, nil
+}
+
+// Release removes the pid file before dropping the lock.
+func (p *pidFile) Release() error {
+	os.Remove(p.path)
+	return p.f.Close()
+}
+
+func readPID(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// runningPID returns the pid of the running daemon, or 0 when there is none.
+// A pid file left behind by a killed daemon is not locked anymore.
+func runningPID() int {
+	f, err := os.Open(pidPath())
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	pid, err := readPID(pidPath())
+	if err != nil || !lockHeld(f, pid) {
+		return 0
+	}
+
+	return pid
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// lockHeld reports whether another process holds the lock of f.
+func lockHeld(f *os.File, pid int) bool {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err != nil {
+		return errors.Is(err, syscall.EWOULDBLOCK)
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	return false
+}
+
+func terminate(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// detached starts the daemon in its own session, so it survives the
+// terminal it was started from.
+func detached() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,38 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile is a no-op, the daemon listens on TCP there and a second daemon
+// fails to bind instead of replacing the socket.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// lockHeld reports whether the process that wrote the pid file is alive.
+func lockHeld(f *os.File, pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+
+	return true
+}
+
+func terminate(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return p.Kill()
+}
+
+func detached() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/thesoulless/watchmyback/internal/config"
+	"github.com/thesoulless/watchmyback/internal/pki"
+)
+
+// listenTLS opens the TCP listener for remote clients.
+func listenTLS(t *config.TLS) (net.Listener, error) {
+	dir := pki.DefaultDir()
+	cfg, err := pki.ServerConfig(
+		orDefault(t.Cert, filepath.Join(dir, pki.ServerFile)),
+		orDefault(t.Key, filepath.Join(dir, pki.ServerKeyFile)),
+		orDefault(t.CA, filepath.Join(dir, pki.CAFile)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.Listen("tcp", t.Listen, cfg)
+}
+
+// remote returns the address of a remote daemon from --remote or
+// $WMB_REMOTE, it is empty for the local daemon.
+func remote() string {
+	if remoteAddr != "" {
+		return remoteAddr
+	}
+
+	return os.Getenv("WMB_REMOTE")
+}
+
+func dialRemote(addr string) (net.Conn, error) {
+	dir := pki.DefaultDir()
+	cfg, err := pki.ClientConfig(
+		orDefault(tlsCert, filepath.Join(dir, pki.ClientFile)),
+		orDefault(tlsKey, filepath.Join(dir, pki.ClientKeyFile)),
+		orDefault(tlsCA, filepath.Join(dir, pki.CAFile)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote address: %w", err)
+	}
+	cfg.ServerName = host
+
+	return tls.DialWithDialer(&net.Dialer{Timeout: startTimeout}, "tcp", addr, cfg)
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+
+	return s
+}
+
+func certsInit(hosts []string) error {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if h, err := os.Hostname(); err == nil {
+			hosts = append(hosts, h)
+		}
+	}
+
+	dir := pki.DefaultDir()
+	err := pki.Init(dir, hosts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created the CA and the server certificate for %v in %s\n", hosts, dir)
+	return nil
+}
+
+func certsIssue(name, out string) error {
+	if out == "" {
+		out = name
+	}
+
+	err := pki.Issue(pki.DefaultDir(), name, out)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("issued a client certificate for %q in %s, copy its files to %s on the client\n", name, out, pki.DefaultDir())
+	fmt.Printf("and allow it in the daemon section of the config:\n  clients:\n    - name: %s\n", name)
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/config"
+	"github.com/thesoulless/watchmyback/internal/metrics"
+	"github.com/thesoulless/watchmyback/services/email"
+	"github.com/thesoulless/watchmyback/services/slack"
+)
+
+const (
+	defaultRuleInterval   = time.Minute
+	notificationQueueSize = 100
+)
+
+type ruleRunner struct {
+	rule   config.Rule
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	lastRun   time.Time
+	lastFire  time.Time
+	lastError string
+	matches   int
+}
+
+type ruleStatus struct {
+	Name      string     `json:"name" yaml:"name"`
+	Account   string     `json:"account" yaml:"account"`
+	Interval  string     `json:"interval" yaml:"interval"`
+	LastRun   *time.Time `json:"last_run,omitempty" yaml:"last_run,omitempty"`
+	LastFire  *time.Time `json:"last_fire,omitempty" yaml:"last_fire,omitempty"`
+	LastError string     `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	Matches   int        `json:"matches" yaml:"matches"`
+}
+
+func (rr *ruleRunner) status() ruleStatus {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	return ruleStatus{
+		Name:      rr.rule.Name,
+		Account:   rr.rule.Account,
+		Interval:  ruleInterval(rr.rule).String(),
+		LastRun:   timeOrNil(rr.lastRun),
+		LastFire:  timeOrNil(rr.lastFire),
+		LastError: rr.lastError,
+		Matches:   rr.matches,
+	}
+}
+
+func ruleInterval(r config.Rule) time.Duration {
+	if r.Interval == 0 {
+		return defaultRuleInterval
+	}
+
+	return r.Interval
+}
+
+type notification struct {
+	rule     string
+	notifier config.Notifier
+	msg      string
+}
+
+func (d *daemon) startRule(ctx context.Context, r config.Rule) *ruleRunner {
+	ctx, cancel := context.WithCancel(ctx)
+	rr := &ruleRunner{rule: r, cancel: cancel}
+	go d.runRule(ctx, rr)
+
+	return rr
+}
+
+func (d *daemon) runRule(ctx context.Context, rr *ruleRunner) {
+	ticker := time.NewTicker(ruleInterval(rr.rule))
+	defer ticker.Stop()
+
+	var seen ruleSeen
+	for {
+		seen = d.evalRule(ctx, rr, seen)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ruleSeen holds the UIDs a rule matched in its previous evaluation, they
+// only compare within the UIDVALIDITY of the mailbox.
+type ruleSeen struct {
+	validity uint32
+	uids     map[uint32]bool
+	// last is the highest UID of the mailbox, invite rules only look at
+	// the emails above it
+	last uint32
+}
+
+// ruleMatches is what an evaluation of a rule found, the subjects and UIDs
+// of the matches and the UIDVALIDITY they are of.
+type ruleMatches struct {
+	subjects []string
+	uids     []uint32
+	validity uint32
+	last     uint32
+}
+
+// searchRule runs the query of r, and archives the matches, over a
+// connection leased from s. Invite rules only look at the emails that
+// came in since seen.
+func searchRule(ctx context.Context, s *session, r config.Rule, seen ruleSeen) (ruleMatches, error) {
+	access := email.Shared
+	if r.Archive {
+		access = email.Exclusive
+	}
+	srv, ctx, release, err := s.Lease(ctx, "", access)
+	if err != nil {
+		return ruleMatches{}, err
+	}
+	defer release()
+
+	var m ruleMatches
+	var seqnums []uint32
+	if r.Invite != "" {
+		var after uint32
+		if srv.UIDValidity() == seen.validity {
+			after = seen.last
+		}
+		m.subjects, m.uids, seqnums, m.last, err = searchInvites(ctx, srv, r, after)
+	} else {
+		var msgs []email.Message
+		msgs, err = srv.SearchMessages(ctx, email.Query{Subject: r.Query, From: r.From}, email.Page{})
+		for _, msg := range msgs {
+			m.subjects = append(m.subjects, msg.Subject)
+			m.uids = append(m.uids, msg.UID)
+			seqnums = append(seqnums, msg.Seq)
+		}
+	}
+	m.validity = srv.UIDValidity()
+	if err == nil && r.Archive && len(seqnums) > 0 {
+		err = srv.Archive(ctx, seqnums)
+	}
+
+	return m, err
+}
+
+// searchInvites returns the emails above after matching r that have an
+// invitation of its method, described by their events rather than their
+// subjects, with their UIDs and sequence numbers and the highest UID of
+// the mailbox.
+func searchInvites(ctx context.Context, srv *email.Core, r config.Rule, after uint32) ([]string, []uint32, []uint32, uint32, error) {
+	invites, last, err := srv.InvitesAfter(ctx, email.Query{Subject: r.Query, From: r.From}, after)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	var subjects []string
+	var uids, seqnums []uint32
+	for _, i := range invites {
+		if r.Invite != "any" && !strings.EqualFold(i.Method, r.Invite) {
+			continue
+		}
+		subjects = append(subjects, fmt.Sprintf("%s: %s, %s", i.Method, i.Summary, eventTime(i.Event)))
+		if !slices.Contains(uids, i.UID) {
+			uids = append(uids, i.UID)
+			seqnums = append(seqnums, i.Seq)
+		}
+	}
+
+	return subjects, uids, seqnums, last, nil
+}
+
+// evalRule searches the rule's account and notifies about matches that
+// were not part of the previous evaluation, it returns the current matches.
+// Every match is new once the UIDVALIDITY changed. Invite rules only search
+// above the last UID they looked at, so their matches are the new ones.
+func (d *daemon) evalRule(ctx context.Context, rr *ruleRunner, seen ruleSeen) ruleSeen {
+	r := rr.rule
+	s, ok := d.session(r.Account)
+	if !ok {
+		log.Warn("rule account has no session", "rule", r.Name, "account", r.Account)
+		return seen
+	}
+
+	start := time.Now()
+	m, err := searchRule(ctx, s, r, seen)
+	metrics.PollDuration.WithLabelValues(r.Account).Observe(time.Since(start).Seconds())
+
+	// rr.mu is released before notify, which takes d.mu, the lock status
+	// holds while it lists the rules
+	rr.mu.Lock()
+	rr.lastRun = time.Now()
+
+	if errors.Is(err, email.ErrNotFound) {
+		metrics.RuleEvaluations.WithLabelValues(r.Name, "ok").Inc()
+		s.polled()
+		rr.lastError = ""
+		rr.matches = 0
+		rr.mu.Unlock()
+		return ruleSeen{validity: m.validity, last: m.last}
+	}
+	if err != nil {
+		log.Error("failed to evaluate rule", "rule", r.Name, "error", err)
+		rr.lastError = err.Error()
+		metrics.RuleEvaluations.WithLabelValues(r.Name, metrics.Result(err)).Inc()
+		rr.mu.Unlock()
+		return seen
+	}
+	metrics.RuleEvaluations.WithLabelValues(r.Name, "ok").Inc()
+	s.polled()
+	rr.lastError = ""
+	rr.matches = len(m.uids)
+
+	if m.validity != seen.validity {
+		seen.uids = nil
+	}
+	matched := ruleSeen{validity: m.validity, uids: make(map[uint32]bool, len(m.uids)), last: m.last}
+	fresh := 0
+	for _, uid := range m.uids {
+		matched.uids[uid] = true
+		if !seen.uids[uid] {
+			fresh++
+		}
+	}
+
+	if fresh == 0 {
+		rr.mu.Unlock()
+		return matched
+	}
+	rr.lastFire = time.Now()
+	rr.mu.Unlock()
+
+	metrics.RuleFires.WithLabelValues(r.Name).Inc()
+	msg := fmt.Sprintf("%s: %d new matching email(s) on %s\n%s", r.Name, fresh, r.Account, strings.Join(m.subjects, "\n"))
+	d.notify(r, msg)
+
+	return matched
+}
+
+// notify queues msg for every notifier of the rule, the queue is drained
+// by sendNotifications.
+func (d *daemon) notify(r config.Rule, msg string) {
+	for _, name := range r.Notify {
+		n, ok := d.notifier(name)
+		if !ok {
+			log.Warn("rule notifier not found", "rule", r.Name, "notifier", name)
+			continue
+		}
+
+		select {
+		case d.notifications <- notification{rule: r.Name, notifier: n, msg: msg}:
+		default:
+			log.Error("notification queue is full, dropping notification", "rule", r.Name, "notifier", name)
+		}
+	}
+}
+
+func (d *daemon) sendNotifications(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-d.notifications:
+			err := sendNotification(ctx, n.notifier, n.msg)
+			metrics.Notifications.WithLabelValues(n.notifier.Name, metrics.Result(err)).Inc()
+			if err != nil {
+				log.Error("failed to send notification", "rule", n.rule, "notifier", n.notifier.Name, "error", err)
+			}
+		}
+	}
+}
+
+func sendNotification(ctx context.Context, n config.Notifier, msg string) error {
+	switch n.Type {
+	case "slack":
+		body, err := json.Marshal(map[string]string{"text": msg})
+		if err != nil {
+			return err
+		}
+		return slack.SendToChanel(ctx, n.URL, string(body))
+	default:
+		return fmt.Errorf("unknown notifier type %q", n.Type)
+	}
+}
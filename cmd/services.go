@@ -64,3 +64,33 @@ func (l *List[T]) Get(name string) (T, bool) {
 
 	return node.val, true
 }
+
+// Remove unlinks the named service and closes it.
+func (l *List[T]) Remove(name string) error {
+	node, ok := l.c[name]
+	if !ok {
+		return nil
+	}
+
+	if l.head == node {
+		l.head = node.next
+	} else {
+		for n := l.head; n != nil; n = n.next {
+			if n.next == node {
+				n.next = node.next
+				break
+			}
+		}
+	}
+	delete(l.c, name)
+	l.l--
+
+	return node.val.Close()
+}
+
+// Each calls fn for every service in insertion order.
+func (l *List[T]) Each(fn func(name string, val T)) {
+	for n := l.head; n != nil; n = n.next {
+		fn(n.Name, n.val)
+	}
+}
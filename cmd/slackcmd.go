@@ -4,16 +4,26 @@ import (
 	"context"
 
 	"github.com/spf13/pflag"
+	"github.com/thesoulless/watchmyback/internal/exitcode"
 	"github.com/thesoulless/watchmyback/services/slack"
 )
 
-func runSlack(args []string) string {
+func runSlack(ctx context.Context, args []string) (string, int) {
 	log.Debug("slack command (runSlack)", "args", args)
-	flags := pflag.NewFlagSet("slack", pflag.ExitOnError)
-	flags.Parse(args)
+	format := outputText
+	flags := pflag.NewFlagSet("slack", pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.StringVarP(&format, "output", "o", outputText, "output format")
+	err := flags.Parse(args)
+	if err != nil {
+		return renderError(format, err.Error(), int(exitcode.Usage)), int(exitcode.Usage)
+	}
 
 	args = flags.Args()
 	log.Debug("args", "args", args)
+	if len(args) < 3 {
+		return renderError(format, "usage: slack webhook <uri> <msg>", int(exitcode.Usage)), int(exitcode.Usage)
+	}
 
 	command := args[0]
 	uri := args[1]
@@ -22,14 +32,22 @@ func runSlack(args []string) string {
 	switch command {
 	case "webhook":
 		log.Debug("sending message to slack", "uri", uri, "msg", msg)
-		err := slack.SendToChanel(context.Background(), uri, msg)
+		err := slack.SendToChanel(ctx, uri, msg)
 		if err != nil {
-			return err.Error()
+			code := exitcode.Of(err)
+			return renderError(format, err.Error(), int(code)), int(code)
 		}
 	default:
 		log.Error("unknown command", "command", command)
-		return "unknown command"
+		return renderError(format, "unknown command", int(exitcode.Usage)), int(exitcode.Usage)
+	}
+
+	if format != outputText {
+		res, err := render(format, result{Status: "ok"})
+		if err == nil {
+			return res, int(exitcode.OK)
+		}
 	}
 
-	return "ok"
+	return "ok", int(exitcode.OK)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thesoulless/watchmyback/services/email"
+)
+
+type serviceStatus struct {
+	Name         string     `json:"name" yaml:"name"`
+	LastPoll     *time.Time `json:"last_poll,omitempty" yaml:"last_poll,omitempty"`
+	email.Status `yaml:",inline"`
+}
+
+type daemonStatus struct {
+	Version       string          `json:"version" yaml:"version"`
+	Protocol      string          `json:"protocol" yaml:"protocol"`
+	Started       time.Time       `json:"started" yaml:"started"`
+	Uptime        string          `json:"uptime" yaml:"uptime"`
+	Config        string          `json:"config" yaml:"config"`
+	Services      []serviceStatus `json:"services" yaml:"services"`
+	Rules         []ruleStatus    `json:"rules" yaml:"rules"`
+	Notifications int             `json:"queued_notifications" yaml:"queued_notifications"`
+	// the Lua runtime in internal/lua is disabled, so no plugin is ever
+	// loaded yet
+	Plugins []string `json:"plugins" yaml:"plugins"`
+}
+
+func (d *daemon) status() daemonStatus {
+	d.mu.Lock()
+	st := daemonStatus{
+		Version:       version,
+		Protocol:      string(Version),
+		Started:       d.started,
+		Uptime:        time.Since(d.started).Round(time.Second).String(),
+		Config:        d.path,
+		Services:      []serviceStatus{},
+		Rules:         []ruleStatus{},
+		Notifications: len(d.notifications),
+		Plugins:       []string{},
+	}
+
+	d.sessions.Each(func(name string, s *session) {
+		st.Services = append(st.Services, serviceStatus{Name: name, LastPoll: timeOrNil(s.lastPoll()), Status: s.Status()})
+	})
+
+	// the runners are asked after d.mu is released, evalRule notifies,
+	// which takes d.mu, while holding rr.mu
+	runners := make([]*ruleRunner, 0, len(d.rules))
+	for _, rr := range d.rules {
+		runners = append(runners, rr)
+	}
+	d.mu.Unlock()
+
+	for _, rr := range runners {
+		st.Rules = append(st.Rules, rr.status())
+	}
+	sort.Slice(st.Rules, func(i, j int) bool {
+		return st.Rules[i].Name < st.Rules[j].Name
+	})
+
+	return st
+}
+
+// visibleTo drops the services and rules of accounts p may not use.
+func (s daemonStatus) visibleTo(p peer) daemonStatus {
+	services := []serviceStatus{}
+	for _, srv := range s.Services {
+		if p.allowsAccount(srv.Name) {
+			services = append(services, srv)
+		}
+	}
+	rules := []ruleStatus{}
+	for _, r := range s.Rules {
+		if p.allowsAccount(r.Account) {
+			rules = append(rules, r)
+		}
+	}
+	s.Services = services
+	s.Rules = rules
+
+	return s
+}
+
+func (s daemonStatus) table(w io.Writer) {
+	fmt.Fprintf(w, "VERSION\t%s (protocol %s)\n", s.Version, s.Protocol)
+	fmt.Fprintf(w, "UPTIME\t%s\n", s.Uptime)
+	fmt.Fprintf(w, "CONFIG\t%s\n", s.Config)
+	fmt.Fprintf(w, "QUEUED NOTIFICATIONS\t%d\n", s.Notifications)
+	fmt.Fprintf(w, "PLUGINS\t%s\n", orNone(strings.Join(s.Plugins, ", ")))
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "SERVICE\tSTATE\tSINCE\tMAILBOX\tLAST POLL\tRECONNECTS\tLAST ERROR")
+	for _, srv := range s.Services {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			srv.Name, srv.State, ago(&srv.Since), srv.Mailbox, ago(srv.LastPoll), srv.Reconnects, srv.LastError)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "RULE\tACCOUNT\tINTERVAL\tLAST RUN\tLAST FIRE\tMATCHES\tLAST ERROR")
+	for _, r := range s.Rules {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			r.Name, r.Account, r.Interval, ago(r.LastRun), ago(r.LastFire), r.Matches, r.LastError)
+	}
+}
+
+func ago(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+
+	return time.Since(*t).Round(time.Second).String() + " ago"
+}
+
+// timeOrNil leaves a zero t out of the status.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+
+	return s
+}
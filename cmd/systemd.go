@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// activationListener returns the socket passed by systemd socket
+// activation, ok is false when the daemon was not socket activated.
+func activationListener() (l net.Listener, ok bool, err error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, false, nil
+	}
+	if n > 1 {
+		log.Warn("only the first socket passed by systemd is used", "fds", n)
+	}
+
+	// do not pass the sockets to children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFDsStart), "systemd")
+	defer f.Close()
+
+	l, err = net.FileListener(f)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to use the systemd socket: %w", err)
+	}
+
+	return l, true, nil
+}
+
+const serviceUnit = `[Unit]
+Description=Watch My Back daemon
+Documentation=https://github.com/thesoulless/watchmyback
+After=network-online.target
+Wants=network-online.target
+%s
+[Service]
+Type=simple
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+%s`
+
+const socketUnit = `[Unit]
+Description=Watch My Back daemon socket
+
+[Socket]
+ListenStream=%s
+SocketMode=0600
+DirectoryMode=0700
+
+[Install]
+WantedBy=sockets.target
+`
+
+// systemdUnits returns the user units of the daemon by file name.
+func systemdUnits(socket bool) (map[string]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the wmb binary: %w", err)
+	}
+
+	start := []string{exe, "daemon", "start"}
+	for _, a := range daemonArgs() {
+		start = append(start, strconv.Quote(a))
+	}
+
+	units := map[string]string{}
+	if socket {
+		units["wmb.service"] = fmt.Sprintf(serviceUnit, "Requires=wmb.socket\n", strings.Join(start, " "), "Also=wmb.socket\n")
+		path := socketPath()
+		if path == defaultSocketPath() {
+			// %t is the runtime dir of the user manager
+			path = "%t/wmb/" + socketName
+		}
+		units["wmb.socket"] = fmt.Sprintf(socketUnit, path)
+	} else {
+		units["wmb.service"] = fmt.Sprintf(serviceUnit, "", strings.Join(start, " "), "")
+	}
+
+	return units, nil
+}
+
+// systemdUserDir returns $XDG_CONFIG_HOME/systemd/user.
+func systemdUserDir() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+
+	return filepath.Join(dir, "systemd", "user"), nil
+}
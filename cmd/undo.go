@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thesoulless/watchmyback/internal/exitcode"
+	"github.com/thesoulless/watchmyback/services/email"
+)
+
+// undoSize is how many moves of each account the daemon remembers.
+const undoSize = 50
+
+// undoLog remembers the recent moves of an account, newest last, so they
+// can be moved back with `wmb email <account> undo`.
+type undoLog struct {
+	mu    sync.Mutex
+	next  int
+	moves []undoEntry
+}
+
+type undoEntry struct {
+	ID          int `json:"id" yaml:"id"`
+	email.Moved `yaml:",inline"`
+}
+
+func (l *undoLog) record(m email.Moved) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.next++
+	l.moves = append(l.moves, undoEntry{ID: l.next, Moved: m})
+	if len(l.moves) > undoSize {
+		l.moves = l.moves[len(l.moves)-undoSize:]
+	}
+}
+
+// recent returns the n most recent moves, newest first.
+func (l *undoLog) recent(n int) []undoEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n = min(n, len(l.moves))
+	res := make([]undoEntry, 0, n)
+	for i := len(l.moves) - 1; i >= len(l.moves)-n; i-- {
+		res = append(res, l.moves[i])
+	}
+
+	return res
+}
+
+func (l *undoLog) remove(id int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, m := range l.moves {
+		if m.ID == id {
+			l.moves = append(l.moves[:i], l.moves[i+1:]...)
+			return
+		}
+	}
+}
+
+type undoList []undoEntry
+
+func (l undoList) table(w io.Writer) {
+	fmt.Fprintln(w, "ID\tAT\tFROM\tTO\tEMAILS\tUNTRACKED\tUIDS")
+	for _, m := range l {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", m.ID, m.At.Format(time.DateTime), m.From, m.To, m.Count, m.Untracked, m.UIDs)
+	}
+}
+
+func (l undoList) String() string {
+	lines := make([]string, len(l))
+	for i, m := range l {
+		lines[i] = fmt.Sprintf("%d: %d email(s) from %s to %s at %s", m.ID, m.Count, m.From, m.To, m.At.Format(time.DateTime))
+		if m.Untracked > 0 {
+			lines[i] += fmt.Sprintf(", %d cannot be moved back", m.Untracked)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// undo moves back the n most recent moves of s, or lists them for "list"
+// and --dry-run. A failed move is kept in the log, older ones are not tried.
+// A move the server sent no UIDs for fails too but is dropped from the log,
+// it can never be undone.
+func (d *daemon) undo(ctx context.Context, s *session, opts emailOptions, query string) (string, int) {
+	if query == "list" {
+		l := undoList(s.undo.recent(undoSize))
+		return opts.done(exitcode.OK, l, l.String())
+	}
+
+	n, err := strconv.Atoi(query)
+	if err != nil || n < 1 {
+		return opts.fail(exitcode.Usage, "usage: email <account> undo [<count>|list]", err)
+	}
+
+	moves := undoList(s.undo.recent(n))
+	if len(moves) == 0 {
+		return opts.fail(exitcode.NotFound, "nothing to undo", nil)
+	}
+	if opts.dryRun {
+		return opts.done(exitcode.OK, moves, "would move back:\n"+moves.String())
+	}
+
+	var done undoList
+	for _, m := range moves {
+		if !m.Undoable() {
+			s.undo.remove(m.ID)
+			msg := fmt.Sprintf("%d cannot be undone, the server sent no UIDs for the moved emails, %d of %d moves were undone", m.ID, len(done), len(moves))
+			return opts.fail(exitcode.Error, msg, nil)
+		}
+		err = d.undoMove(ctx, s, m.Moved)
+		if err != nil {
+			msg := fmt.Sprintf("failed to undo %d, %d of %d moves were undone", m.ID, len(done), len(moves))
+			return opts.fail(exitcode.Of(err), msg, err)
+		}
+		s.undo.remove(m.ID)
+		done = append(done, m)
+	}
+
+	return opts.done(exitcode.OK, done, "moved back:\n"+done.String())
+}
+
+func (d *daemon) undoMove(ctx context.Context, s *session, m email.Moved) error {
+	srv, ctx, release, err := s.Lease(ctx, m.To, email.Exclusive)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return srv.Undo(ctx, m)
+}
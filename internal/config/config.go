@@ -0,0 +1,260 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/thesoulless/watchmyback/services/email"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+var (
+	ErrNotFound = errors.New("no config file found")
+)
+
+type Config struct {
+	Emails    []email.Conf `json:"email" yaml:"email"`
+	Notifiers []Notifier   `json:"notifiers,omitempty" yaml:"notifiers,omitempty"`
+	Rules     []Rule       `json:"rules,omitempty" yaml:"rules,omitempty"`
+	Daemon    Daemon       `json:"daemon" yaml:"daemon,omitempty"`
+}
+
+// Daemon configures the socket the daemon listens on and who may use it,
+// the owner of the daemon is always allowed.
+type Daemon struct {
+	Socket      string   `json:"socket,omitempty" yaml:"socket,omitempty"`
+	AllowGroups []string `json:"allow_groups,omitempty" yaml:"allow_groups,omitempty"`
+	TLS         *TLS     `json:"tls,omitempty" yaml:"tls,omitempty"`
+	Clients     []Client `json:"clients,omitempty" yaml:"clients,omitempty"`
+}
+
+// TLS enables the TCP listener, clients must present a certificate signed
+// by CA. The files default to the ones written by `wmb certs init`.
+type TLS struct {
+	Listen string `json:"listen" yaml:"listen"`
+	Cert   string `json:"cert,omitempty" yaml:"cert,omitempty"`
+	Key    string `json:"key,omitempty" yaml:"key,omitempty"`
+	CA     string `json:"ca,omitempty" yaml:"ca,omitempty"`
+}
+
+// Client restricts what the holder of a client certificate may do, Name is
+// the common name of the certificate. Empty lists allow every account and
+// every command but shutdown.
+type Client struct {
+	Name     string   `json:"name" yaml:"name"`
+	Commands []string `json:"commands,omitempty" yaml:"commands,omitempty"`
+	Accounts []string `json:"accounts,omitempty" yaml:"accounts,omitempty"`
+}
+
+func (d *Daemon) Client(name string) (Client, bool) {
+	for _, c := range d.Clients {
+		if c.Name == name {
+			return c, true
+		}
+	}
+
+	return Client{}, false
+}
+
+// Notifier is a named destination for rule notifications.
+type Notifier struct {
+	Name string `json:"name" yaml:"name"`
+	Type string `json:"type" yaml:"type"`
+	URL  string `json:"url" yaml:"url"`
+}
+
+// Rule periodically searches an account and notifies when it matches.
+type Rule struct {
+	Name     string        `json:"name" yaml:"name"`
+	Account  string        `json:"account" yaml:"account"`
+	Query    string        `json:"query" yaml:"query"`
+	From     string        `json:"from,omitempty" yaml:"from,omitempty"`
+	Interval time.Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Notify   []string      `json:"notify,omitempty" yaml:"notify,omitempty"`
+	Archive  bool          `json:"archive,omitempty" yaml:"archive,omitempty"`
+	// Invite only matches the emails with an invitation of this method,
+	// request or cancel, or any for every email with an iCalendar part
+	Invite string `json:"invite,omitempty" yaml:"invite,omitempty"`
+}
+
+func (c *Config) Email(name string) (email.Conf, bool) {
+	for _, e := range c.Emails {
+		if e.Name == name {
+			return e, true
+		}
+	}
+
+	return email.Conf{}, false
+}
+
+func (c *Config) Notifier(name string) (Notifier, bool) {
+	for _, n := range c.Notifiers {
+		if n.Name == name {
+			return n, true
+		}
+	}
+
+	return Notifier{}, false
+}
+
+// Redacted returns a copy of the config with passwords, client secrets and
+// webhook urls replaced.
+func (c *Config) Redacted() *Config {
+	r := &Config{
+		Emails:    make([]email.Conf, len(c.Emails)),
+		Notifiers: make([]Notifier, len(c.Notifiers)),
+		Rules:     c.Rules,
+		Daemon:    c.Daemon,
+	}
+
+	for i, e := range c.Emails {
+		if e.Password != "" {
+			e.Password = redacted
+		}
+		if e.OAuth != nil && e.OAuth.ClientSecret != "" {
+			o := *e.OAuth
+			o.ClientSecret = redacted
+			e.OAuth = &o
+		}
+		if e.SMTP != nil && e.SMTP.Password != "" {
+			s := *e.SMTP
+			s.Password = redacted
+			e.SMTP = &s
+		}
+		r.Emails[i] = e
+	}
+
+	for i, n := range c.Notifiers {
+		if n.URL != "" {
+			n.URL = redacted
+		}
+		r.Notifiers[i] = n
+	}
+
+	return r
+}
+
+// Paths returns the candidate config files in lookup order:
+// $WMB_CONFIG, $XDG_CONFIG_HOME/wmb and then every $XDG_CONFIG_DIRS entry.
+func Paths() []string {
+	var paths []string
+	if p := os.Getenv("WMB_CONFIG"); p != "" {
+		paths = append(paths, p)
+	}
+
+	home := os.Getenv("XDG_CONFIG_HOME")
+	if home == "" {
+		if h, err := os.UserHomeDir(); err == nil {
+			home = filepath.Join(h, ".config")
+		}
+	}
+
+	dirs := []string{}
+	if home != "" {
+		dirs = append(dirs, home)
+	}
+
+	sys := os.Getenv("XDG_CONFIG_DIRS")
+	if sys == "" {
+		sys = "/etc/xdg"
+	}
+	dirs = append(dirs, filepath.SplitList(sys)...)
+
+	for _, d := range dirs {
+		paths = append(paths,
+			filepath.Join(d, "wmb", "config.yaml"),
+			filepath.Join(d, "wmb", "config.yml"),
+		)
+	}
+
+	return paths
+}
+
+// Find returns explicit if set, otherwise the first existing file of Paths.
+func Find(explicit string) (string, error) {
+	if explicit != "" {
+		return explicit, nil
+	}
+
+	paths := Paths()
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w, looked in: %s", ErrNotFound, strings.Join(paths, ", "))
+}
+
+// Load reads, strictly decodes and validates the config file. Decoding and
+// validation problems are returned as Problems.
+func Load(path string) (*Config, error) {
+	c, problems, err := Check(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return c, nil
+}
+
+// Check is like Load but returns every problem found, together with the
+// config when it could be decoded at all.
+func Check(path string) (*Config, Problems, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to readConfig os.Open: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to readConfig io.ReadAll: %w", err)
+	}
+
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Config, Problems, error) {
+	c := &Config{}
+	var problems Problems
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(c)
+
+	var typeErr *yaml.TypeError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+	case errors.As(err, &typeErr):
+		// the decoder keeps going after type errors, so the config is
+		// still worth validating
+		for _, msg := range typeErr.Errors {
+			problems = append(problems, parseYAMLError(msg))
+		}
+	default:
+		problems = append(problems, parseYAMLError(strings.TrimPrefix(err.Error(), "yaml: ")))
+		return nil, problems, nil
+	}
+
+	root := &yaml.Node{}
+	err = yaml.Unmarshal(data, root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to readConfig yaml.Unmarshal: %w", err)
+	}
+
+	problems = append(problems, c.validate(root)...)
+	problems.sort()
+
+	return c, problems, nil
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+const account = `email:
+  - name: work
+    host: imap.example.com
+    port: "993"
+    username: me@example.com
+    password: secret
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		problems Problems
+	}{
+		{
+			name: "valid",
+			yaml: account + `notifiers:
+  - name: team
+    type: slack
+    url: https://hooks.example.com/x
+rules:
+  - name: alerts
+    account: work
+    query: alert
+    notify: [team]
+`,
+		},
+		{
+			name: "unknown key",
+			yaml: account + `    folder: INBOX
+`,
+			problems: Problems{
+				{Line: 7, Msg: "field folder not found in type email.Conf"},
+			},
+		},
+		{
+			name: "unknown key and invalid port",
+			yaml: `email:
+  - name: work
+    host: imap.example.com
+    port: "99999"
+    username: me@example.com
+    password: secret
+rules:
+  - name: alerts
+    account: work
+    query: alert
+    every: 1m
+`,
+			problems: Problems{
+				{Line: 4, Path: "email[0].port", Msg: `invalid port "99999"`},
+				{Line: 11, Msg: "field every not found in type config.Rule"},
+			},
+		},
+		{
+			name: "duplicate account name",
+			yaml: account + `  - name: work
+    host: imap.example.org
+    port: "993"
+    username: me@example.org
+    password: secret
+`,
+			problems: Problems{
+				{Line: 7, Path: "email[1].name", Msg: `duplicate account name "work"`},
+			},
+		},
+		{
+			name: "duplicate rule name",
+			yaml: account + `rules:
+  - name: alerts
+    account: work
+    query: alert
+  - name: alerts
+    account: work
+    from: boss@example.com
+`,
+			problems: Problems{
+				{Line: 11, Path: "rules[1].name", Msg: `duplicate rule name "alerts"`},
+			},
+		},
+		{
+			name: "unknown notifier",
+			yaml: account + `notifiers:
+  - name: team
+    type: slack
+    url: https://hooks.example.com/x
+rules:
+  - name: alerts
+    account: work
+    query: alert
+    notify:
+      - team
+      - ops
+`,
+			problems: Problems{
+				{Line: 17, Path: "rules[0].notify[1]", Msg: `unknown notifier "ops"`},
+			},
+		},
+		{
+			name: "unknown account",
+			yaml: account + `rules:
+  - name: alerts
+    account: home
+    query: alert
+`,
+			problems: Problems{
+				{Line: 9, Path: "rules[0].account", Msg: `unknown account "home"`},
+			},
+		},
+		{
+			name: "missing fields",
+			yaml: `email:
+  - name: work
+    host: imap.example.com
+`,
+			problems: Problems{
+				{Line: 2, Path: "email[0]", Msg: "port is required"},
+				{Line: 2, Path: "email[0]", Msg: "username is required"},
+				{Line: 2, Path: "email[0]", Msg: "password is required for login auth"},
+			},
+		},
+		{
+			name: "too many connections",
+			yaml: account + `    connections: 100
+`,
+			problems: Problems{
+				{Line: 7, Path: "email[0].connections", Msg: "connections must be at most 5, 0 for the default"},
+			},
+		},
+		{
+			name: "syntax error",
+			yaml: `email:
+  - name: work
+    host: imap.example.com: 993
+`,
+			problems: Problems{
+				{Line: 3, Msg: "mapping values are not allowed in this context"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, problems, err := Parse([]byte(tt.yaml))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(problems, tt.problems) {
+				t.Errorf("expected %v, got %v", tt.problems, problems)
+			}
+		})
+	}
+}
+
+func TestProblemsError(t *testing.T) {
+	_, problems, err := Parse([]byte(account + `rules:
+  - name: alerts
+    account: work
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "invalid config:\n  line 8: rules[0]: query or from is required"
+	if problems.Error() != want {
+		t.Errorf("expected %q, got %q", want, problems.Error())
+	}
+}
@@ -0,0 +1,322 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thesoulless/watchmyback/services/email"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a single decoding or validation error, Line is 0 when the
+// position is unknown.
+type Problem struct {
+	Line int
+	Path string
+	Msg  string
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", p.Line)
+	}
+	if p.Path != "" {
+		fmt.Fprintf(&b, "%s: ", p.Path)
+	}
+	b.WriteString(p.Msg)
+
+	return b.String()
+}
+
+type Problems []Problem
+
+func (p Problems) Error() string {
+	s := make([]string, len(p))
+	for i, pr := range p {
+		s[i] = pr.String()
+	}
+
+	return "invalid config:\n  " + strings.Join(s, "\n  ")
+}
+
+func (p Problems) sort() {
+	sort.SliceStable(p, func(i, j int) bool {
+		return p[i].Line < p[j].Line
+	})
+}
+
+var yamlLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+func parseYAMLError(msg string) Problem {
+	m := yamlLine.FindStringSubmatch(msg)
+	if m == nil {
+		return Problem{Msg: msg}
+	}
+	line, _ := strconv.Atoi(m[1])
+
+	return Problem{Line: line, Msg: m[2]}
+}
+
+var notifierTypes = map[string]bool{
+	"slack": true,
+}
+
+// Commands are the commands a remote client can be allowed to send.
+var Commands = map[string]bool{
+	"email":    true,
+	"slack":    true,
+	"status":   true,
+	"shutdown": true,
+}
+
+var hostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+type validator struct {
+	root     *yaml.Node
+	problems Problems
+}
+
+func (v *validator) add(msg string, path ...any) {
+	v.problems = append(v.problems, Problem{
+		Line: lineOf(v.root, path...),
+		Path: pathString(path),
+		Msg:  msg,
+	})
+}
+
+func (c *Config) validate(root *yaml.Node) Problems {
+	v := &validator{root: root}
+
+	accounts := map[string]bool{}
+	for i, e := range c.Emails {
+		switch {
+		case e.Name == "":
+			v.add("name is required", "email", i)
+		case accounts[e.Name]:
+			v.add(fmt.Sprintf("duplicate account name %q", e.Name), "email", i, "name")
+		}
+		accounts[e.Name] = true
+
+		if e.Host == "" {
+			v.add("host is required", "email", i)
+		} else if net.ParseIP(e.Host) == nil && !hostname.MatchString(e.Host) {
+			v.add(fmt.Sprintf("invalid host %q", e.Host), "email", i, "host")
+		}
+
+		if e.Port == "" {
+			v.add("port is required", "email", i)
+		} else if p, err := strconv.Atoi(e.Port); err != nil || p < 1 || p > 65535 {
+			v.add(fmt.Sprintf("invalid port %q", e.Port), "email", i, "port")
+		}
+
+		if e.Username == "" {
+			v.add("username is required", "email", i)
+		}
+
+		if e.Connections < 0 || e.Connections > email.MaxConnections {
+			v.add(fmt.Sprintf("connections must be at most %d, 0 for the default", email.MaxConnections), "email", i, "connections")
+		}
+
+		if e.CacheInterval < 0 {
+			v.add("cache_interval must not be negative", "email", i, "cache_interval")
+		}
+
+		if e.SMTP != nil && (e.SMTP.Host == "" || e.SMTP.Port == "") {
+			v.add("smtp host and port are required", "email", i, "smtp")
+		}
+
+		if _, err := email.NewExtractor(e.OTP); err != nil {
+			v.add(err.Error(), "email", i, "otp")
+		}
+
+		switch e.Auth {
+		case "", email.AuthLogin:
+			if e.Password == "" {
+				v.add("password is required for login auth", "email", i)
+			}
+		case email.AuthXOAuth2, email.AuthOAuthBearer:
+			if e.OAuth == nil {
+				v.add(fmt.Sprintf("oauth section is required for %s auth", e.Auth), "email", i, "auth")
+			} else if _, err := e.OAuth.Config(""); err != nil {
+				v.add(err.Error(), "email", i, "oauth")
+			}
+		default:
+			v.add(fmt.Sprintf("unknown auth mechanism %q", e.Auth), "email", i, "auth")
+		}
+	}
+
+	notifiers := map[string]bool{}
+	for i, n := range c.Notifiers {
+		switch {
+		case n.Name == "":
+			v.add("name is required", "notifiers", i)
+		case notifiers[n.Name]:
+			v.add(fmt.Sprintf("duplicate notifier name %q", n.Name), "notifiers", i, "name")
+		}
+		notifiers[n.Name] = true
+
+		if !notifierTypes[n.Type] {
+			v.add(fmt.Sprintf("unknown notifier type %q", n.Type), "notifiers", i, "type")
+		}
+		if n.URL == "" {
+			v.add("url is required", "notifiers", i)
+		}
+	}
+
+	rules := map[string]bool{}
+	for i, r := range c.Rules {
+		switch {
+		case r.Name == "":
+			v.add("name is required", "rules", i)
+		case rules[r.Name]:
+			v.add(fmt.Sprintf("duplicate rule name %q", r.Name), "rules", i, "name")
+		}
+		rules[r.Name] = true
+
+		if r.Account == "" {
+			v.add("account is required", "rules", i)
+		} else if !accounts[r.Account] {
+			v.add(fmt.Sprintf("unknown account %q", r.Account), "rules", i, "account")
+		}
+
+		if r.Query == "" && r.From == "" {
+			v.add("query or from is required", "rules", i)
+		}
+
+		if r.Interval < 0 {
+			v.add("interval must not be negative", "rules", i, "interval")
+		}
+
+		switch r.Invite {
+		case "", "request", "cancel", "any":
+		default:
+			v.add(fmt.Sprintf("unknown invite method %q, use request, cancel or any", r.Invite), "rules", i, "invite")
+		}
+
+		for j, n := range r.Notify {
+			if !notifiers[n] {
+				v.add(fmt.Sprintf("unknown notifier %q", n), "rules", i, "notify", j)
+			}
+		}
+	}
+
+	if c.Daemon.Socket != "" && !filepath.IsAbs(c.Daemon.Socket) {
+		v.add("socket must be an absolute path", "daemon", "socket")
+	}
+	for i, g := range c.Daemon.AllowGroups {
+		if _, err := LookupGroup(g); err != nil {
+			v.add(err.Error(), "daemon", "allow_groups", i)
+		}
+	}
+
+	if t := c.Daemon.TLS; t != nil {
+		if _, _, err := net.SplitHostPort(t.Listen); err != nil {
+			v.add(fmt.Sprintf("invalid listen address %q", t.Listen), "daemon", "tls", "listen")
+		}
+	} else if len(c.Daemon.Clients) > 0 {
+		v.add("clients require the tls listener", "daemon", "clients")
+	}
+
+	clients := map[string]bool{}
+	for i, cl := range c.Daemon.Clients {
+		switch {
+		case cl.Name == "":
+			v.add("name is required", "daemon", "clients", i)
+		case clients[cl.Name]:
+			v.add(fmt.Sprintf("duplicate client name %q", cl.Name), "daemon", "clients", i, "name")
+		}
+		clients[cl.Name] = true
+
+		for j, cmd := range cl.Commands {
+			if !Commands[cmd] {
+				v.add(fmt.Sprintf("unknown command %q", cmd), "daemon", "clients", i, "commands", j)
+			}
+		}
+		for j, a := range cl.Accounts {
+			if !accounts[a] {
+				v.add(fmt.Sprintf("unknown account %q", a), "daemon", "clients", i, "accounts", j)
+			}
+		}
+	}
+
+	return v.problems
+}
+
+// LookupGroup returns the id of a group given by name or id.
+func LookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err == nil {
+		return g.Gid, nil
+	}
+
+	g, err = user.LookupGroupId(name)
+	if err == nil {
+		return g.Gid, nil
+	}
+
+	return "", fmt.Errorf("unknown group %q", name)
+}
+
+// lineOf walks the document along path (mapping keys and sequence indexes)
+// and returns the line of the deepest node found.
+func lineOf(root *yaml.Node, path ...any) int {
+	n := root
+	if n == nil {
+		return 0
+	}
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+
+	line := n.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case string:
+			if n.Kind != yaml.MappingNode {
+				return line
+			}
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == p {
+					next = n.Content[i+1]
+					break
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && p < len(n.Content) {
+				next = n.Content[p]
+			}
+		}
+		if next == nil {
+			return line
+		}
+		n = next
+		line = n.Line
+	}
+
+	return line
+}
+
+func pathString(path []any) string {
+	var b strings.Builder
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(p)
+		case int:
+			fmt.Fprintf(&b, "[%d]", p)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package exitcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/thesoulless/watchmyback/internal/config"
+	"github.com/thesoulless/watchmyback/services/email"
+	"golang.org/x/oauth2"
+)
+
+// Code is the exit status of wmb, it is shared by the CLI, the client and
+// the daemon responses.
+type Code int
+
+const (
+	OK Code = iota
+	Error
+	Usage
+	NotFound
+	AuthFailure
+	NetworkFailure
+	ConfigError
+	ProtocolMismatch
+	DaemonUnavailable
+	Timeout
+
+	// Canceled follows the shell convention for commands ended by SIGINT.
+	Canceled Code = 130
+)
+
+var descriptions = []struct {
+	code Code
+	name string
+	desc string
+}{
+	{OK, "ok", "the command succeeded, searches found at least one email"},
+	{Error, "error", "unclassified failure"},
+	{Usage, "usage", "invalid arguments, flags or sequence numbers"},
+	{NotFound, "not-found", "the search or message lookup matched nothing"},
+	{AuthFailure, "auth-failure", "the server rejected the credentials or the OAuth2 token"},
+	{NetworkFailure, "network-failure", "the server could not be reached or the connection dropped"},
+	{ConfigError, "config-error", "the config file is missing or invalid, or names an unknown account"},
+	{ProtocolMismatch, "protocol-mismatch", "the client and the daemon speak different protocol versions"},
+	{DaemonUnavailable, "daemon-unavailable", "the daemon is not running or refused the connection"},
+	{Timeout, "timeout", "the command did not finish within --timeout"},
+	{Canceled, "canceled", "the command was interrupted with Ctrl-C"},
+}
+
+func (c Code) String() string {
+	for _, d := range descriptions {
+		if d.code == c {
+			return d.name
+		}
+	}
+
+	return fmt.Sprintf("code-%d", int(c))
+}
+
+// Help returns the table printed by `wmb help exit-codes`.
+func Help() string {
+	var b strings.Builder
+	for _, d := range descriptions {
+		fmt.Fprintf(&b, "  %d  %-19s %s\n", d.code, d.name, d.desc)
+	}
+
+	return b.String()
+}
+
+// Coder is implemented by errors that carry their own exit code.
+type Coder interface {
+	ExitCode() Code
+}
+
+type codedError struct {
+	code Code
+	err  error
+}
+
+func (e codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e codedError) Unwrap() error {
+	return e.err
+}
+
+func (e codedError) ExitCode() Code {
+	return e.code
+}
+
+// WithCode attaches code to err, it is returned by Of.
+func WithCode(code Code, err error) error {
+	return codedError{code: code, err: err}
+}
+
+// Of maps an error to its exit code, nil is OK.
+func Of(err error) Code {
+	if err == nil {
+		return OK
+	}
+
+	var coder Coder
+	if errors.As(err, &coder) {
+		return coder.ExitCode()
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return Timeout
+	case errors.Is(err, context.Canceled):
+		return Canceled
+	}
+
+	var problems config.Problems
+	var imapErr *imap.Error
+	var retrieveErr *oauth2.RetrieveError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, email.ErrNotFound):
+		return NotFound
+	case errors.Is(err, email.ErrAuth):
+		return AuthFailure
+	case errors.Is(err, email.ErrNetwork):
+		return NetworkFailure
+	case errors.Is(err, config.ErrNotFound), errors.As(err, &problems):
+		return ConfigError
+	case errors.Is(err, email.ErrNoToken), errors.As(err, &retrieveErr):
+		return AuthFailure
+	case errors.As(err, &imapErr):
+		switch imapErr.Code {
+		case imap.ResponseCodeAuthenticationFailed, imap.ResponseCodeAuthorizationFailed, imap.ResponseCodeExpired:
+			return AuthFailure
+		}
+		return Error
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return NetworkFailure
+	default:
+		return Error
+	}
+}
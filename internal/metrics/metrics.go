@@ -0,0 +1,108 @@
+// Package metrics holds the Prometheus metrics exported by the daemon.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "wmb"
+
+var (
+	registry = prometheus.NewRegistry()
+
+	IMAPCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "imap_commands_total",
+		Help:      "IMAP commands sent, by command and result.",
+	}, []string{"account", "command", "result"})
+
+	Reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "imap_reconnects_total",
+		Help:      "Reconnections to the IMAP server.",
+	}, []string{"account"})
+
+	PollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "poll_duration_seconds",
+		Help:      "Time taken to poll an account for a rule.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"account"})
+
+	RuleEvaluations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rule_evaluations_total",
+		Help:      "Rule evaluations, by rule and result.",
+	}, []string{"rule", "result"})
+
+	RuleFires = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rule_fires_total",
+		Help:      "Rule evaluations that found new matching emails.",
+	}, []string{"rule"})
+
+	Notifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_total",
+		Help:      "Notifications sent, by notifier and result.",
+	}, []string{"notifier", "result"})
+
+	SocketRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "socket_requests_total",
+		Help:      "Requests served over the daemon socket, by command and exit code.",
+	}, []string{"command", "code"})
+
+	// LuaErrors stays at 0 while the Lua runtime in internal/lua is
+	// disabled, it is registered so dashboards can rely on it.
+	LuaErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lua_errors_total",
+		Help:      "Errors raised by Lua scripts.",
+	}, []string{"script"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		IMAPCommands,
+		Reconnects,
+		PollDuration,
+		RuleEvaluations,
+		RuleFires,
+		Notifications,
+		SocketRequests,
+		LuaErrors,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Result is the result label of err, "timeout" and "error" are told apart
+// so slow servers can be alerted on separately.
+func Result(err error) string {
+	var timeout interface{ Timeout() bool }
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &timeout) && timeout.Timeout():
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// Request counts a socket request.
+func Request(command string, code int) {
+	SocketRequests.WithLabelValues(command, strconv.Itoa(code)).Inc()
+}
@@ -0,0 +1,239 @@
+// Package pki issues the certificates used by the TCP listener of the
+// daemon, a private CA signs one server certificate and a certificate per
+// client.
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	CAFile        = "ca.pem"
+	CAKeyFile     = "ca-key.pem"
+	ServerFile    = "server.pem"
+	ServerKeyFile = "server-key.pem"
+	ClientFile    = "client.pem"
+	ClientKeyFile = "client-key.pem"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 2 * 365 * 24 * time.Hour
+)
+
+var (
+	ErrExists = errors.New("the CA already exists")
+	ErrNoCA   = errors.New("no CA found, run `wmb certs init`")
+)
+
+// DefaultDir returns $XDG_DATA_HOME/wmb/pki, falling back to
+// ~/.local/share when XDG_DATA_HOME is not set.
+func DefaultDir() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = os.TempDir()
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+
+	return filepath.Join(dir, "wmb", "pki")
+}
+
+// Init creates the CA and the server certificate for hosts in dir.
+func Init(dir string, hosts []string) error {
+	if _, err := os.Stat(filepath.Join(dir, CAFile)); err == nil {
+		return fmt.Errorf("%w in %s", ErrExists, dir)
+	}
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template("wmb CA", caValidity)
+	if err != nil {
+		return err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create the CA: %w", err)
+	}
+
+	err = write(dir, CAFile, CAKeyFile, der, key)
+	if err != nil {
+		return err
+	}
+
+	return issue(dir, dir, "wmb server", ServerFile, ServerKeyFile, func(t *x509.Certificate) {
+		t.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				t.IPAddresses = append(t.IPAddresses, ip)
+			} else {
+				t.DNSNames = append(t.DNSNames, h)
+			}
+		}
+	})
+}
+
+// Issue signs a client certificate for name and writes it to out together
+// with the CA certificate, the directory can be copied as is to the pki
+// directory of the client.
+func Issue(dir, name, out string) error {
+	err := os.MkdirAll(out, 0o700)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", out, err)
+	}
+
+	ca, err := os.ReadFile(filepath.Join(dir, CAFile))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNoCA, err)
+	}
+	err = os.WriteFile(filepath.Join(out, CAFile), ca, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return issue(dir, out, name, ClientFile, ClientKeyFile, func(t *x509.Certificate) {
+		t.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	})
+}
+
+func issue(dir, out, cn, certFile, keyFile string, set func(*x509.Certificate)) error {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, CAFile), filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNoCA, err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template(cn, certValidity)
+	if err != nil {
+		return err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	set(tmpl)
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, pair.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to sign the certificate: %w", err)
+	}
+
+	return write(out, certFile, keyFile, der, key)
+}
+
+func template(cn string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+func write(dir, certFile, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	k, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(dir, keyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k}), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", keyFile, err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, certFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", certFile, err)
+	}
+
+	return nil
+}
+
+func pool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	p := x509.NewCertPool()
+	if !p.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+
+	return p, nil
+}
+
+// ServerConfig requires clients to present a certificate signed by the CA.
+func ServerConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the server certificate: %w", err)
+	}
+
+	cas, err := pool(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the CA: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    cas,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// ClientConfig trusts only the CA of the daemon.
+func ClientConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+	}
+
+	cas, err := pool(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the CA: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      cas,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
@@ -0,0 +1,140 @@
+package secret
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrNotFound = errors.New("secret not found")
+)
+
+// Store is a small file backed key/value store for credentials such as
+// OAuth2 tokens. The file is only readable by the owning user.
+type Store struct {
+	path string
+	mu   sync.Mutex
+}
+
+func New(path string) *Store {
+	return &Store{path: path}
+}
+
+// DefaultPath returns $XDG_DATA_HOME/wmb/secrets.json, falling back to
+// ~/.local/share when XDG_DATA_HOME is not set.
+func DefaultPath() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = os.TempDir()
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+
+	return filepath.Join(dir, "wmb", "secrets.json")
+}
+
+func (s *Store) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	val, ok := m[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	return val, nil
+}
+
+func (s *Store) Set(key string, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.load()
+	if err != nil {
+		return err
+	}
+	m[key] = val
+
+	return s.save(m)
+}
+
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.load()
+	if err != nil {
+		return err
+	}
+	delete(m, key)
+
+	return s.save(m)
+}
+
+func (s *Store) load() (map[string][]byte, error) {
+	m := map[string][]byte{}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secrets os.ReadFile: %w", err)
+	}
+
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secrets json.Unmarshal: %w", err)
+	}
+
+	return m, nil
+}
+
+func (s *Store) save(m map[string][]byte) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to save secrets json.Marshal: %w", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("failed to save secrets os.MkdirAll: %w", err)
+	}
+
+	// write to a temporary file first so a crash never leaves a truncated store
+	f, err := os.CreateTemp(dir, ".secrets-*")
+	if err != nil {
+		return fmt.Errorf("failed to save secrets os.CreateTemp: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	err = f.Chmod(0o600)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save secrets: %w", err)
+	}
+
+	err = os.Rename(f.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("failed to save secrets os.Rename: %w", err)
+	}
+
+	return nil
+}
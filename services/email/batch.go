@@ -0,0 +1,314 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// ChunkSize is the number of messages fetched or moved by one command, so
+// large results are neither held in a single response nor run into server
+// timeouts.
+const ChunkSize = 250
+
+// Page selects Limit matches of a search, newest first, after skipping the
+// Offset newest ones. The zero Page selects every match in sequence order.
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+func (p Page) paged() bool {
+	return p.Limit > 0 || p.Offset > 0
+}
+
+// apply returns the page of seqnums, which are in ascending order.
+func (p Page) apply(seqnums []uint32) []uint32 {
+	if !p.paged() {
+		return seqnums
+	}
+
+	res := slices.Clone(seqnums)
+	slices.Reverse(res)
+	if p.Offset >= len(res) {
+		return nil
+	}
+	res = res[p.Offset:]
+	if p.Limit > 0 && p.Limit < len(res) {
+		res = res[:p.Limit]
+	}
+
+	return res
+}
+
+// Progress is told after each chunk of a long operation how many of total
+// messages it has handled.
+type Progress func(op string, done, total int)
+
+type progressKey struct{}
+
+// WithProgress returns a context reporting the progress of the commands run
+// with it to p.
+func WithProgress(ctx context.Context, p Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// progress returns the Progress of ctx, it is only called for operations
+// spanning more than one chunk.
+func progress(ctx context.Context, total int) Progress {
+	p, ok := ctx.Value(progressKey{}).(Progress)
+	if !ok || total <= ChunkSize {
+		return func(string, int, int) {}
+	}
+
+	return p
+}
+
+func chunks[T any](s []T) [][]T {
+	var res [][]T
+	for len(s) > ChunkSize {
+		res = append(res, s[:ChunkSize:ChunkSize])
+		s = s[ChunkSize:]
+	}
+	if len(s) > 0 {
+		res = append(res, s)
+	}
+
+	return res
+}
+
+// uidsAfter returns the UIDs of the emails matching criteria above after,
+// in ascending order. The n:* range searched for always matches the last
+// email, even when it is older than n, so it is left out.
+func (e *Core) uidsAfter(client *imapclient.Client, criteria *imap.SearchCriteria, after uint32) ([]imap.UID, error) {
+	if after > 0 {
+		criteria.UID = append(criteria.UID, imap.UIDSet{{Start: imap.UID(after + 1), Stop: 0}})
+	}
+	res, err := client.UIDSearch(criteria, nil).Wait()
+	e.observe("SEARCH", err)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+	uids := slices.DeleteFunc(res.AllUIDs(), func(uid imap.UID) bool { return uint32(uid) <= after })
+	slices.Sort(uids)
+
+	return uids, nil
+}
+
+// fetchHeaders fetches the envelope and header section of set.
+func (e *Core) fetchHeaders(client *imapclient.Client, set imap.NumSet) (_ []Message, err error) {
+	c := client.Fetch(set, &imap.FetchOptions{
+		Envelope:   true,
+		UID:        true,
+		Flags:      true,
+		RFC822Size: true,
+		BodySection: []*imap.FetchItemBodySection{
+			{Peek: true, Specifier: imap.PartSpecifierHeader},
+		},
+	})
+	defer func() {
+		cerr := c.Close()
+		e.observe("FETCH", cerr)
+		if err == nil && cerr != nil {
+			err = fmt.Errorf("%w: %w", ErrClientError, cerr)
+		}
+	}()
+
+	var res []Message
+	for {
+		msg := c.Next()
+		if msg == nil {
+			break
+		}
+
+		data, err := msg.Collect()
+		if err != nil {
+			e.log.Error("failed to collect msg", "error", err)
+			return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+		}
+
+		res = append(res, newMessage(data))
+	}
+
+	return res, nil
+}
+
+// uids resolves seqnums, moving messages by sequence number in several
+// commands would move the wrong ones once the first are expunged.
+func (e *Core) uids(client *imapclient.Client, seqnums []uint32) ([]imap.UID, error) {
+	var uids []imap.UID
+	for _, chunk := range chunks(seqnums) {
+		msgs, err := client.Fetch(imap.SeqSetNum(chunk...), &imap.FetchOptions{UID: true}).Collect()
+		e.observe("FETCH", err)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			uids = append(uids, m.UID)
+		}
+	}
+	if len(uids) < len(seqnums) {
+		return nil, fmt.Errorf("%w: %d of %d messages", ErrNotFound, len(seqnums)-len(uids), len(seqnums))
+	}
+
+	return uids, nil
+}
+
+// SeqNum returns the sequence number of uid in the selected mailbox, it
+// only stays valid while the caller holds a lease.
+func (e *Core) SeqNum(ctx context.Context, uid imap.UID) (_ uint32, err error) {
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	msgs, err := client.Fetch(imap.UIDSetNum(uid), &imap.FetchOptions{UID: true}).Collect()
+	e.observe("FETCH", err)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+	if len(msgs) == 0 {
+		return 0, fmt.Errorf("%w: uid %d", ErrNotFound, uid)
+	}
+
+	return msgs[0].SeqNum, nil
+}
+
+// move moves seqs to mailbox, over client which the caller holds an
+// exclusive lease of.
+func (e *Core) move(ctx context.Context, client *imapclient.Client, seqs []uint32, mailbox string) error {
+	e.log.Debug("moving", "count", len(seqs), "mailbox", mailbox)
+	moved := Moved{At: time.Now(), From: e.sched.current(), To: mailbox}
+	defer func() {
+		if moved.Untracked > 0 {
+			e.log.Warn("the server sent no UIDs for the moved emails, they cannot be moved back", "count", moved.Untracked, "mailbox", mailbox)
+		}
+		if moved.Count > 0 {
+			e.moved(moved)
+		}
+	}()
+
+	if len(seqs) <= ChunkSize && client.Caps().Has(imap.CapMove) {
+		data, err := client.Move(imap.SeqSetNum(seqs...), mailbox).Wait()
+		e.observe("MOVE", err)
+		if err != nil {
+			return err
+		}
+		moved.add(data.UIDValidity, data.DestUIDs, len(seqs))
+		return nil
+	}
+
+	uids, err := e.uids(client, seqs)
+	if err != nil {
+		return err
+	}
+
+	report := progress(ctx, len(seqs))
+	done := 0
+	for _, chunk := range chunks(uids) {
+		validity, dest, err := e.moveUIDs(client, imap.UIDSetNum(chunk...), mailbox)
+		if err != nil {
+			return fmt.Errorf("failed after moving %d of %d messages: %w", done, len(seqs), err)
+		}
+		moved.add(validity, dest, len(chunk))
+		done += len(chunk)
+		report("move", done, len(seqs))
+	}
+
+	return nil
+}
+
+// moveUIDs moves uids to mailbox and returns their UIDs there when the
+// server tells them. Servers without MOVE get COPY, STORE +FLAGS.SILENT
+// \Deleted and UID EXPUNGE.
+func (e *Core) moveUIDs(client *imapclient.Client, uids imap.UIDSet, mailbox string) (uint32, imap.NumSet, error) {
+	if client.Caps().Has(imap.CapMove) {
+		data, err := client.Move(uids, mailbox).Wait()
+		e.observe("MOVE", err)
+		if err != nil {
+			return 0, nil, err
+		}
+		return data.UIDValidity, data.DestUIDs, nil
+	}
+
+	data, err := client.Copy(uids, mailbox).Wait()
+	e.observe("COPY", err)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = e.storeDeleted(client, uids)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = e.expunge(client, uids)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return data.UIDValidity, data.DestUIDs, nil
+}
+
+func (e *Core) storeDeleted(client *imapclient.Client, uids imap.UIDSet) error {
+	err := client.Store(uids, &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Silent: true,
+		Flags:  []imap.Flag{imap.FlagDeleted},
+	}, nil).Close()
+	e.observe("STORE", err)
+
+	return err
+}
+
+// expunge removes uids with UID EXPUNGE, or with a plain EXPUNGE without
+// UIDPLUS, which also removes messages flagged \Deleted by someone else.
+func (e *Core) expunge(client *imapclient.Client, uids imap.UIDSet) error {
+	var err error
+	if client.Caps().Has(imap.CapUIDPlus) {
+		err = client.UIDExpunge(uids).Close()
+	} else {
+		e.log.Warn("server does not support UIDPLUS, expunging every deleted message", "account", e.conf.Name)
+		err = client.Expunge().Close()
+	}
+	e.observe("EXPUNGE", err)
+
+	return err
+}
+
+// Headers fetches the envelopes of set, which holds sequence numbers or
+// UIDs.
+func (e *Core) Headers(ctx context.Context, set imap.NumSet) (_ []Message, err error) {
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	msgs, err := e.fetchHeaders(client, set)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return msgs, nil
+}
@@ -1,39 +1,121 @@
 package email
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"mime"
+	"net/http"
 	"os"
+	"slices"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
-	"github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"github.com/thesoulless/watchmyback/internal/metrics"
+	"golang.org/x/oauth2"
 	"jaytaylor.com/html2text"
 )
 
 type Conf struct {
-	Name     string `yaml:"name"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
-	Host     string `yaml:"host"`
-	Port     string `yaml:"port"`
-	LogLevel *slog.Level
+	Name     string      `json:"name" yaml:"name"`
+	Username string      `json:"username" yaml:"username"`
+	Password string      `json:"password" yaml:"password"`
+	Host     string      `json:"host" yaml:"host"`
+	Port     string      `json:"port" yaml:"port"`
+	Auth     string      `json:"auth,omitempty" yaml:"auth,omitempty"`
+	OAuth    *OAuthConf  `json:"oauth,omitempty" yaml:"oauth,omitempty"`
+	LogLevel *slog.Level `json:"loglevel,omitempty" yaml:"loglevel,omitempty"`
+	// Trash defaults to the mailbox with the \Trash special use, or Trash
+	Trash string `json:"trash,omitempty" yaml:"trash,omitempty"`
+	// Connections is the size of the daemon's pool for this account
+	Connections int `json:"connections,omitempty" yaml:"connections,omitempty"`
+	// Cache keeps a local copy of INBOX for `search --local`, the daemon
+	// syncs it every CacheInterval
+	Cache         bool          `json:"cache,omitempty" yaml:"cache,omitempty"`
+	CacheInterval time.Duration `json:"cache_interval,omitempty" yaml:"cache_interval,omitempty"`
+	// SMTP sends the emails of the lists unsubscribed from by mailto
+	SMTP *SMTPConf `json:"smtp,omitempty" yaml:"smtp,omitempty"`
+	// OTP are the patterns of `otp`, tried before the default ones
+	OTP    []OTPPattern `json:"otp,omitempty" yaml:"otp,omitempty"`
+	Tokens TokenStore   `json:"-" yaml:"-"`
 }
 
 type Core struct {
 	conf   Conf
 	log    *slog.Logger
-	client *imapclient.Client
+	tokens oauth2.TokenSource
 	done   chan struct{}
-	ticker *time.Ticker
+	once   sync.Once
+
+	// sched orders the commands sent over client, the supervisor only
+	// pings an idle connection.
+	sched scheduler
+
+	// connMu guards client, commands use the client returned by ready so
+	// a reconnect does not change it under them.
+	connMu sync.Mutex
+	client *imapclient.Client
+	// selection is the answer to the last SELECT
+	selection *imap.SelectData
+	trash     string
+
+	// onMove is told about every move, see OnMove
+	onMove func(Moved)
+
+	// gmailConn sends the X-GM-* commands, see gmail
+	gmailMu   sync.Mutex
+	gmailConn *gmailConn
+	// budget counts gmailConn against the connections of the pool
+	budget *connBudget
+
+	otp *Extractor
+
+	// httpClient sends the one-click unsubscribe POSTs
+	httpClient *http.Client
+
+	statusMu sync.Mutex
+	status   Status
+	// mailbox is the default of commands run without a lease
+	mailbox string
 }
 
+// New connects to the server, login and mailbox selection happen on the
+// first command.
 func New(conf Conf) (*Core, error) {
+	e, err := newCore(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// NewSupervised returns a client whose connection is kept alive in the
+// background: dead sessions are detected with NOOP and reconnected with
+// exponential backoff. It only fails on configuration errors.
+func NewSupervised(conf Conf) (*Core, error) {
+	e, err := newCore(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	go e.supervise()
+
+	return e, nil
+}
+
+func newCore(conf Conf) (*Core, error) {
 	l := slog.LevelInfo
 	if conf.LogLevel != nil {
 		l = *conf.LogLevel
@@ -42,33 +124,71 @@ func New(conf Conf) (*Core, error) {
 		Level: l,
 	}))
 
-	options := &imapclient.Options{
-		WordDecoder: &mime.WordDecoder{CharsetReader: charset.Reader},
+	var tokens oauth2.TokenSource
+	switch conf.Auth {
+	case "", AuthLogin:
+	case AuthXOAuth2, AuthOAuthBearer:
+		var err error
+		tokens, err = newTokenSource(conf)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth mechanism %q", conf.Auth)
 	}
 
-	target := fmt.Sprintf("%s:%s", conf.Host, conf.Port)
-	log.Debug("new email client", "target", target)
-
-	client, err := imapclient.DialTLS(target, options)
+	otp, err := NewExtractor(conf.OTP)
 	if err != nil {
 		return nil, err
 	}
 
-	ticker := time.NewTicker(1 * time.Minute)
-
 	return &Core{
-		client: client,
-		log:    log,
-		conf:   conf,
-		done:   make(chan struct{}, 1),
-		ticker: ticker,
+		otp:        otp,
+		httpClient: cleanhttp.DefaultClient(),
+		tokens:     tokens,
+		log:        log,
+		conf:       conf,
+		sched:      scheduler{mailbox: "INBOX"},
+		mailbox:    "INBOX",
+		done:       make(chan struct{}),
+		status:     Status{State: StateDisconnected, Since: time.Now()},
 	}, nil
 }
 
+// home returns the mailbox of commands run without a lease.
+func (e *Core) home() string {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+
+	return e.mailbox
+}
+
 func (e *Core) Login(username, password string) error {
+	release, err := e.sched.acquire(context.Background(), e.home(), Exclusive)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	if e.client == nil {
+		err := e.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.login(username, password)
+}
+
+func (e *Core) login(username, password string) error {
 	e.log.Debug("logging in", "username", username)
 	c := e.client.Login(username, password)
-	if err := c.Wait(); err != nil {
+	err := c.Wait()
+	e.observe("LOGIN", err)
+	if err != nil {
 		e.log.Error("error logging in", "error", err)
 		return err
 	}
@@ -76,13 +196,53 @@ func (e *Core) Login(username, password string) error {
 	return nil
 }
 
+// authenticate logs in with the configured mechanism, OAuth2 tokens are
+// refreshed as needed.
+func (e *Core) authenticate() error {
+	switch e.conf.Auth {
+	case AuthXOAuth2, AuthOAuthBearer:
+	default:
+		return e.login(e.conf.Username, e.conf.Password)
+	}
+
+	e.log.Debug("authenticating", "username", e.conf.Username, "mechanism", e.conf.Auth)
+	saslClient, err := e.SASL()
+	if err != nil {
+		return err
+	}
+
+	err = e.client.Authenticate(saslClient)
+	e.observe("AUTHENTICATE", err)
+	if err != nil {
+		e.log.Error("error authenticating", "error", err)
+		return err
+	}
+
+	return nil
+}
+
 func (e *Core) Logout() error {
+	release, err := e.sched.acquire(context.Background(), e.home(), Exclusive)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	if e.client == nil {
+		return nil
+	}
+
 	c := e.client.Logout()
-	if err := c.Wait(); err != nil {
+	err = c.Wait()
+	e.observe("LOGOUT", err)
+	if err != nil {
 		return err
 	}
 
-	err := e.client.Close()
+	err = e.client.Close()
 	if err != nil {
 		return err
 	}
@@ -90,65 +250,196 @@ func (e *Core) Logout() error {
 	return nil
 }
 
+// SelectMailbox makes mailbox the default of commands run without a lease
+// and selects it.
 func (e *Core) SelectMailbox(mailbox string) error {
+	e.statusMu.Lock()
+	e.mailbox = mailbox
+	e.statusMu.Unlock()
+
+	release, err := e.sched.acquire(context.Background(), mailbox, Exclusive)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	return e.healthCheck()
+}
+
+func (e *Core) selectMailbox(mailbox string) error {
 	c := e.client.Select(mailbox, nil)
-	if _, err := c.Wait(); err != nil {
+	data, err := c.Wait()
+	e.observe("SELECT", err)
+	if err != nil {
 		return err
 	}
+	e.selection = data
 
 	return nil
 }
 
+// UIDValidity returns the UIDVALIDITY of the selected mailbox, UIDs of one
+// value are not those of another. It is 0 before the first SELECT.
+func (e *Core) UIDValidity() uint32 {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	if e.selection == nil {
+		return 0
+	}
+
+	return e.selection.UIDValidity
+}
+
+// ready returns early for a done ctx, and otherwise makes sure the session
+// is connected and selected. The returned client is the one to send the
+// command over.
+func (e *Core) ready(ctx context.Context) (*imapclient.Client, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	err = e.healthCheck()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+
+	return e.client, nil
+}
+
+// interrupt closes the connection when ctx is done before the returned
+// func is called, which is the only way to abort a pending IMAP command.
+// The error is then replaced by the one of ctx, and healthCheck reconnects
+// on the next use. Commands pipelined next to others are left to finish,
+// closing the connection would abort them all.
+func (e *Core) interrupt(ctx context.Context, c *imapclient.Client, errp *error) func() {
+	stop := context.AfterFunc(ctx, func() {
+		if !e.sched.isolate() {
+			e.log.Debug("waiting for the command to finish", "reason", ctx.Err())
+			return
+		}
+		e.log.Debug("interrupting command", "reason", ctx.Err())
+		c.Close()
+	})
+
+	return func() {
+		if stop() {
+			return
+		}
+		// whatever the closed connection reported is noise
+		*errp = ctx.Err()
+	}
+}
+
+// observe counts an IMAP command in the daemon metrics.
+func (e *Core) observe(command string, err error) {
+	metrics.IMAPCommands.WithLabelValues(e.conf.Name, command, metrics.Result(err)).Inc()
+}
+
 var (
 	ErrClientError = errors.New("client error")
 	ErrNotFound    = errors.New("not found")
+	ErrAuth        = errors.New("authentication failed")
+	ErrNetwork     = errors.New("network failure")
 )
 
 // Body reads an email by sequence number and returns the email body
-func (e *Core) Body(seqnum uint32) (string, error) {
+func (e *Core) Body(ctx context.Context, seqnum uint32) (string, error) {
+	msg, err := e.Read(ctx, seqnum)
+	if err != nil {
+		return "", err
+	}
+
+	return msg.Body, nil
+}
+
+// Read fetches an email by sequence number together with its body
+func (e *Core) Read(ctx context.Context, seqnum uint32) (_ *Message, err error) {
 	e.log.Debug("reading", "seqnum", seqnum)
 
-	err := e.healthCheck()
+	release, err := e.acquire(ctx, "", Shared)
 	if err != nil {
-		return "", fmt.Errorf("%w: %v", ErrClientError, err)
+		return nil, err
 	}
+	defer release()
 
-	c := e.client.Fetch(imap.SeqSetNum(seqnum), &imap.FetchOptions{
+	client, err := e.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	c := client.Fetch(imap.SeqSetNum(seqnum), &imap.FetchOptions{
+		Envelope:   true,
+		UID:        true,
+		Flags:      true,
+		RFC822Size: true,
 		BodySection: []*imap.FetchItemBodySection{
 			{Peek: true},
 		},
 	})
-	defer c.Close()
+	defer func() {
+		e.observe("FETCH", c.Close())
+	}()
 
 	msg := c.Next()
 	if msg == nil {
 		e.log.Error("FETCH command returned no message")
-		return "", ErrNotFound
+		return nil, ErrNotFound
 	}
 
-	var body string
-	var bodySection imapclient.FetchItemDataBodySection
+	res := &Message{Seq: msg.SeqNum}
 	ok := false
 	for {
 		item := msg.Next()
 		if item == nil {
 			break
 		}
-		bodySection, ok = item.(imapclient.FetchItemDataBodySection)
-		if ok {
-			break
+
+		switch item := item.(type) {
+		case imapclient.FetchItemDataEnvelope:
+			res.setEnvelope(item.Envelope)
+		case imapclient.FetchItemDataUID:
+			res.UID = uint32(item.UID)
+		case imapclient.FetchItemDataFlags:
+			res.setFlags(item.Flags)
+		case imapclient.FetchItemDataRFC822Size:
+			res.Size = item.Size
+		case imapclient.FetchItemDataBodySection:
+			// the literal has to be consumed before moving to the next item
+			res.Body, res.Events, err = e.parseBody(item.Literal)
+			if err != nil {
+				return nil, err
+			}
+			ok = true
 		}
 	}
 	if !ok {
 		e.log.Debug("FETCH command did not return body section")
-		return "", fmt.Errorf("%w: %v", ErrClientError, "FETCH command did not return body section")
+		return nil, fmt.Errorf("%w: %v", ErrClientError, "FETCH command did not return body section")
 	}
 
+	return res, nil
+}
+
+// parseBody returns the text of the email read from r and the events of
+// its iCalendar parts, inline or attached.
+func (e *Core) parseBody(r io.Reader) (string, []Event, error) {
+	var body string
+	var events []Event
+
 	// read the message via the go-message library
-	mr, err := mail.CreateReader(bodySection.Literal)
+	mr, err := mail.CreateReader(r)
 	if err != nil {
 		e.log.Error("failed to create mail reader", "error", err)
-		return "", fmt.Errorf("%w: %v", ErrClientError, err)
+		return "", nil, fmt.Errorf("%w: %w", ErrClientError, err)
 	}
 
 	// process the message's parts
@@ -158,14 +449,24 @@ func (e *Core) Body(seqnum uint32) (string, error) {
 			break
 		} else if err != nil {
 			e.log.Error("failed to read message part", "error", err)
-			return "", fmt.Errorf("%w: %v", ErrClientError, err)
+			return "", nil, fmt.Errorf("%w: %w", ErrClientError, err)
 		}
 
-		switch p.Header.(type) {
+		switch h := p.Header.(type) {
 		case *mail.InlineHeader:
+			mediaType, params, _ := h.ContentType()
+			if isCalendar(mediaType, "") {
+				events = append(events, e.parseCalendar(p.Body, params["method"])...)
+				continue
+			}
 			b, _ := io.ReadAll(p.Body)
 			body = string(b)
-			// case *mail.AttachmentHeader:
+		case *mail.AttachmentHeader:
+			filename, _ := h.Filename()
+			mediaType, params, _ := h.ContentType()
+			if isCalendar(mediaType, filename) {
+				events = append(events, e.parseCalendar(p.Body, params["method"])...)
+			}
 		}
 	}
 
@@ -173,100 +474,99 @@ func (e *Core) Body(seqnum uint32) (string, error) {
 	body, err = html2text.FromString(body)
 	if err != nil {
 		e.log.Error("failed to convert html to text", "error", err)
-		return "", fmt.Errorf("%w: %v", ErrClientError, err)
+		return "", nil, fmt.Errorf("%w: %w", ErrClientError, err)
 	}
 
-	return body, nil
+	return body, events, nil
 }
 
-func (e *Core) Search(query string, from string) ([]string, []uint32, error) {
-	e.log.Debug("searching", "query", query)
+// parseCalendar returns the events of an iCalendar part, a malformed one
+// is logged rather than failing the whole email.
+func (e *Core) parseCalendar(r io.Reader, method string) []Event {
+	events, err := ParseCalendar(r, method)
+	if err != nil {
+		e.log.Warn("failed to parse calendar", "error", err)
+	}
+
+	return events
+}
 
-	err := e.healthCheck()
+func (e *Core) Search(ctx context.Context, query string, from string) ([]string, []uint32, error) {
+	msgs, err := e.SearchMessages(ctx, Query{Subject: query, From: from}, Page{})
 	if err != nil {
-		return nil, nil, fmt.Errorf("%w: %v", ErrClientError, err)
+		return nil, nil, err
+	}
+
+	result := make([]string, len(msgs))
+	seqnums := make([]uint32, len(msgs))
+	for i, m := range msgs {
+		result[i] = m.Subject
+		seqnums[i] = m.Seq
+	}
+
+	return result, seqnums, nil
+}
+
+// SearchMessages returns the page of emails matching query, the headers are
+// fetched in chunks of ChunkSize.
+func (e *Core) SearchMessages(ctx context.Context, query Query, page Page) (_ []Message, err error) {
+	e.log.Debug("searching", "query", query)
+
+	for _, f := range slices.Concat(query.Flags, query.NotFlags) {
+		err = ValidFlag(f)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+		}
 	}
 
-	header := []imap.SearchCriteriaHeaderField{
-		{Key: "Subject", Value: query},
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
-	if from != "" {
-		header = append(header, imap.SearchCriteriaHeaderField{Key: "From", Value: from})
+	client, err := e.ready(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer e.interrupt(ctx, client, &err)()
 
-	c := e.client.Search(&imap.SearchCriteria{
-		Header:  header,
-		NotFlag: []imap.Flag{}}, &imap.SearchOptions{})
+	c := client.Search(query.criteria(), &imap.SearchOptions{})
 	res, err := c.Wait()
+	e.observe("SEARCH", err)
 	if err != nil {
-		return nil, nil, fmt.Errorf("%w: %v", ErrClientError, err)
+		return nil, fmt.Errorf("%w: %w", ErrClientError, err)
 	}
 
 	seqnums := res.AllSeqNums()
+	slices.Sort(seqnums)
 
 	e.log.Debug("email count", "count", len(seqnums))
 
-	numSet := imap.SeqSetNum(seqnums...)
-
+	seqnums = page.apply(seqnums)
 	if len(seqnums) == 0 {
-		return nil, nil, ErrNotFound
+		return nil, ErrNotFound
 	}
 
-	fetchCmd := e.client.Fetch(numSet, &imap.FetchOptions{
-		Envelope: true,
-		UID:      true,
-		BodySection: []*imap.FetchItemBodySection{
-			{Peek: true, Specifier: imap.PartSpecifierHeader},
-		},
-	})
-	defer fetchCmd.Close()
-
-	var result []string
-	for {
-		msg := fetchCmd.Next()
-		if msg == nil {
-			break
-		}
-
-		data, err := msg.Collect()
+	report := progress(ctx, len(seqnums))
+	result := make([]Message, 0, len(seqnums))
+	for _, chunk := range chunks(seqnums) {
+		msgs, err := e.fetchHeaders(client, imap.SeqSetNum(chunk...))
 		if err != nil {
-			e.log.Error("failed to collect msg", "error", err)
-			return nil, seqnums, fmt.Errorf("%w: %v", ErrClientError, err)
+			return nil, err
 		}
-
-		result = append(result, data.Envelope.Subject)
+		result = append(result, msgs...)
+		report("fetch", len(result), len(seqnums))
 	}
 
-	return result, seqnums, nil
-}
-
-func (e *Core) healthCheck() error {
-	e.log.Debug("health check")
-
-	state := e.client.State()
-	switch state {
-
-	case imap.ConnStateNone, imap.ConnStateNotAuthenticated, imap.ConnStateLogout:
-		options := &imapclient.Options{
-			WordDecoder: &mime.WordDecoder{CharsetReader: charset.Reader},
-		}
-
-		target := fmt.Sprintf("%s:%s", e.conf.Host, e.conf.Port)
-
-		var err error
-		e.client, err = imapclient.DialTLS(target, options)
-		if err != nil {
-			e.log.Error("error reconnecting to the imap server", "error", err)
-			return errors.New("error reconnecting to the imap server")
+	sort.Slice(result, func(i, j int) bool {
+		if page.paged() {
+			return result[i].Seq > result[j].Seq
 		}
+		return result[i].Seq < result[j].Seq
+	})
 
-		e.client.Login(e.conf.Username, e.conf.Password)
-		e.SelectMailbox("INBOX")
-		return nil
-	default:
-		return nil
-	}
+	return result, nil
 }
 
 type customOutput struct{}
@@ -276,34 +576,114 @@ func (c customOutput) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func (e *Core) Move(seqs []uint32, mailbox string) error {
-	seqSet := imap.SeqSetNum(seqs...)
+// Move moves seqs to mailbox in chunks of ChunkSize, by UID unless a single
+// MOVE does.
+func (e *Core) Move(ctx context.Context, seqs []uint32, mailbox string) (err error) {
+	release, err := e.acquire(ctx, "", Exclusive)
+	if err != nil {
+		return err
+	}
+	defer release()
 
-	e.log.Debug("moving", "seqSet", seqSet, "mailbox", mailbox)
-	c := e.client.Move(seqSet, mailbox)
-	if _, err := c.Wait(); err != nil {
+	client, err := e.ready(ctx)
+	if err != nil {
 		return err
 	}
+	defer e.interrupt(ctx, client, &err)()
 
-	return nil
+	return e.move(ctx, client, seqs, mailbox)
+}
+
+func (e *Core) Archive(ctx context.Context, seqs []uint32) error {
+	e.log.Debug("archiving", "count", len(seqs))
+
+	return e.Move(ctx, seqs, "Archive")
+}
+
+// Trash moves seqs to the Trash mailbox of the account.
+func (e *Core) Trash(ctx context.Context, seqs []uint32) (err error) {
+	release, err := e.acquire(ctx, "", Exclusive)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	trash, err := e.trashMailbox(client)
+	if err != nil {
+		return err
+	}
+
+	return e.move(ctx, client, seqs, trash)
 }
 
-func (e *Core) Archive(seqs []uint32) error {
-	seqSet := imap.SeqSetNum(seqs...)
+// Delete flags seqs \Deleted, with expunge they are removed for good right
+// away.
+func (e *Core) Delete(ctx context.Context, seqs []uint32, expunge bool) (err error) {
+	release, err := e.acquire(ctx, "", Exclusive)
+	if err != nil {
+		return err
+	}
+	defer release()
 
-	e.log.Debug("archiving", "seqSet", seqSet)
-	c := e.client.Move(seqSet, "Archive")
-	if _, err := c.Wait(); err != nil {
+	client, err := e.ready(ctx)
+	if err != nil {
+		return err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	e.log.Debug("deleting", "count", len(seqs), "expunge", expunge)
+	uids, err := e.uids(client, seqs)
+	if err != nil {
 		return err
 	}
 
+	report := progress(ctx, len(seqs))
+	done := 0
+	for _, chunk := range chunks(uids) {
+		set := imap.UIDSetNum(chunk...)
+		err = e.storeDeleted(client, set)
+		if err == nil && expunge {
+			err = e.expunge(client, set)
+		}
+		if err != nil {
+			return fmt.Errorf("failed after deleting %d of %d messages: %w", done, len(seqs), err)
+		}
+		done += len(chunk)
+		report("delete", done, len(seqs))
+	}
+
 	return nil
 }
 
 func (e *Core) Close() error {
 	e.log.Debug("closing email client")
-	e.ticker.Stop()
-	<-e.done
+	e.once.Do(func() {
+		close(e.done)
+	})
+
+	// let the running commands finish
+	release, err := e.sched.acquire(context.Background(), e.home(), Exclusive)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	e.setState(StateClosed, nil)
+	e.gmailMu.Lock()
+	e.closeGmail()
+	e.gmailMu.Unlock()
+	if e.client == nil {
+		return nil
+	}
 
 	return e.client.Close()
 }
@@ -0,0 +1,214 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// RawMessage is an email as stored by the server. Export hands out Body
+// while the email is being received, it has to be read before the next one.
+type RawMessage struct {
+	UID         uint32
+	UIDValidity uint32
+	Flags       []string
+	// Date is the internal date, when the server received the email
+	Date time.Time
+	Size int64
+	Body io.Reader
+}
+
+// ExportOptions selects the emails of Export.
+type ExportOptions struct {
+	Mailbox string
+	// Since and Until are the first and last day of the internal dates,
+	// the zero time leaves them open
+	Since time.Time
+	Until time.Time
+	// After resumes an export, the emails up to this UID are skipped and
+	// UIDValidity has to be the one they were exported with
+	After       uint32
+	UIDValidity uint32
+}
+
+// Export calls f with every email of opts.Mailbox selected by opts, in UID
+// order. Bodies are streamed, only their flags and dates are fetched ahead
+// in chunks of ChunkSize.
+func (e *Core) Export(ctx context.Context, opts ExportOptions, f func(RawMessage) error) (err error) {
+	e.log.Debug("exporting", "mailbox", opts.Mailbox, "since", opts.Since, "until", opts.Until, "after", opts.After)
+
+	release, err := e.acquire(ctx, opts.Mailbox, Shared)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	validity := e.UIDValidity()
+	if opts.After > 0 && validity != opts.UIDValidity {
+		return fmt.Errorf("%w: %s was recreated since, UIDVALIDITY is %d instead of %d", ErrClientError, opts.Mailbox, validity, opts.UIDValidity)
+	}
+
+	criteria := &imap.SearchCriteria{Since: opts.Since}
+	if !opts.Until.IsZero() {
+		criteria.Before = opts.Until.AddDate(0, 0, 1)
+	}
+	uids, err := e.uidsAfter(client, criteria, opts.After)
+	if err != nil {
+		return err
+	}
+
+	e.log.Debug("email count", "count", len(uids))
+
+	report := progress(ctx, len(uids))
+	done := 0
+	for _, chunk := range chunks(uids) {
+		err = e.exportChunk(client, imap.UIDSetNum(chunk...), validity, f)
+		if err != nil {
+			return fmt.Errorf("failed after exporting %d of %d messages: %w", done, len(uids), err)
+		}
+		done += len(chunk)
+		report("export", done, len(uids))
+	}
+
+	return nil
+}
+
+func (e *Core) exportChunk(client *imapclient.Client, set imap.UIDSet, validity uint32, f func(RawMessage) error) (err error) {
+	meta, err := client.Fetch(set, &imap.FetchOptions{UID: true, Flags: true, InternalDate: true, RFC822Size: true}).Collect()
+	e.observe("FETCH", err)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+	byUID := make(map[imap.UID]*imapclient.FetchMessageBuffer, len(meta))
+	for _, buf := range meta {
+		byUID[buf.UID] = buf
+	}
+
+	c := client.Fetch(set, &imap.FetchOptions{
+		UID:         true,
+		BodySection: []*imap.FetchItemBodySection{{Peek: true}},
+	})
+	defer func() {
+		cerr := c.Close()
+		e.observe("FETCH", cerr)
+		if err == nil && cerr != nil {
+			err = fmt.Errorf("%w: %w", ErrClientError, cerr)
+		}
+	}()
+
+	for {
+		msg := c.Next()
+		if msg == nil {
+			return nil
+		}
+
+		var uid imap.UID
+		var body io.Reader
+		for item := msg.Next(); item != nil; item = msg.Next() {
+			switch item := item.(type) {
+			case imapclient.FetchItemDataUID:
+				uid = item.UID
+			case imapclient.FetchItemDataBodySection:
+				if uid != 0 {
+					err = e.exportMessage(byUID[uid], validity, item.Literal, f)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				// the literal has to be consumed before the next item, the
+				// UID needed to export it comes later
+				b, err := io.ReadAll(item.Literal)
+				if err != nil {
+					return fmt.Errorf("%w: %w", ErrNetwork, err)
+				}
+				body = bytes.NewReader(b)
+			}
+		}
+		if body != nil {
+			err = e.exportMessage(byUID[uid], validity, body, f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exportMessage calls f with the email of buf and its body, and consumes
+// what f left of it.
+func (e *Core) exportMessage(buf *imapclient.FetchMessageBuffer, validity uint32, body io.Reader, f func(RawMessage) error) error {
+	if buf == nil {
+		return fmt.Errorf("%w: FETCH returned a body without its flags", ErrClientError)
+	}
+
+	m := RawMessage{UID: uint32(buf.UID), UIDValidity: validity, Date: buf.InternalDate, Size: buf.RFC822Size, Body: body}
+	m.Flags = make([]string, len(buf.Flags))
+	for i, f := range buf.Flags {
+		m.Flags[i] = string(f)
+	}
+	err := f(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.Discard, body)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+
+	return nil
+}
+
+// Append adds msg to mailbox with its flags and internal date, Body has to
+// be Size bytes long.
+func (e *Core) Append(ctx context.Context, mailbox string, msg RawMessage) (err error) {
+	release, err := e.acquire(ctx, "", Independent)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	var flags []imap.Flag
+	for _, f := range msg.Flags {
+		// \Recent is only ever set by the server
+		if !strings.EqualFold(f, `\Recent`) {
+			flags = append(flags, imap.Flag(f))
+		}
+	}
+
+	c := client.Append(mailbox, msg.Size, &imap.AppendOptions{Flags: flags, Time: msg.Date})
+	_, err = io.Copy(c, msg.Body)
+	cerr := c.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		e.observe("APPEND", err)
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	_, err = c.Wait()
+	e.observe("APPEND", err)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// Query selects the messages of a search, empty fields match everything.
+type Query struct {
+	Subject string
+	From    string
+	// ListID matches the List-Id header, it is not searched locally
+	ListID string
+	// Flags must all be set and NotFlags all unset, they are system flags
+	// such as \Seen or keywords such as wmb-processed
+	Flags    []string
+	NotFlags []string
+}
+
+func (q Query) criteria() *imap.SearchCriteria {
+	c := &imap.SearchCriteria{}
+	if q.Subject != "" {
+		c.Header = append(c.Header, imap.SearchCriteriaHeaderField{Key: "Subject", Value: q.Subject})
+	}
+	if q.From != "" {
+		c.Header = append(c.Header, imap.SearchCriteriaHeaderField{Key: "From", Value: q.From})
+	}
+	if q.ListID != "" {
+		c.Header = append(c.Header, imap.SearchCriteriaHeaderField{Key: "List-Id", Value: q.ListID})
+	}
+	for _, f := range q.Flags {
+		c.Flag = append(c.Flag, imap.Flag(f))
+	}
+	for _, f := range q.NotFlags {
+		c.NotFlag = append(c.NotFlag, imap.Flag(f))
+	}
+
+	return c
+}
+
+// ValidFlag checks that flag is a system flag, such as \Seen, or a keyword,
+// which is an IMAP atom without a leading backslash.
+func ValidFlag(flag string) error {
+	name, system := strings.CutPrefix(flag, `\`)
+	if name == "" {
+		return fmt.Errorf("invalid flag %q", flag)
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return fmt.Errorf("invalid flag %q: %q is not allowed", flag, r)
+		}
+	}
+	if system {
+		switch imap.Flag(flag) {
+		case imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged, imap.FlagDeleted, imap.FlagDraft:
+		default:
+			return fmt.Errorf("unknown system flag %q", flag)
+		}
+	}
+
+	return nil
+}
+
+// ParseUIDSet parses a set of UIDs such as 4,7:9 or 10:*.
+func ParseUIDSet(s string) (imap.UIDSet, error) {
+	var set imap.UIDSet
+	for _, part := range strings.Split(s, ",") {
+		start, stop, isRange := strings.Cut(part, ":")
+		a, err := parseUID(start)
+		if err != nil {
+			return nil, err
+		}
+		b := a
+		if isRange {
+			b, err = parseUID(stop)
+			if err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, imap.UIDRange{Start: a, Stop: b})
+	}
+
+	return set, nil
+}
+
+// parseUID returns 0 for *, the largest UID in use.
+func parseUID(s string) (imap.UID, error) {
+	if s == "*" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid uid %q", s)
+	}
+
+	return imap.UID(n), nil
+}
+
+// SetFlags replaces the flags of the messages in uids.
+func (e *Core) SetFlags(ctx context.Context, uids imap.UIDSet, flags ...string) error {
+	return e.store(ctx, uids, imap.StoreFlagsSet, flags)
+}
+
+// AddFlags sets flags on the messages in uids, keeping their other flags.
+func (e *Core) AddFlags(ctx context.Context, uids imap.UIDSet, flags ...string) error {
+	return e.store(ctx, uids, imap.StoreFlagsAdd, flags)
+}
+
+// RemoveFlags unsets flags on the messages in uids.
+func (e *Core) RemoveFlags(ctx context.Context, uids imap.UIDSet, flags ...string) error {
+	return e.store(ctx, uids, imap.StoreFlagsDel, flags)
+}
+
+func (e *Core) store(ctx context.Context, uids imap.UIDSet, op imap.StoreFlagsOp, flags []string) (err error) {
+	for _, f := range flags {
+		err = ValidFlag(f)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrClientError, err)
+		}
+	}
+
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	e.log.Debug("storing flags", "uids", uids, "op", op, "flags", flags)
+	store := &imap.StoreFlags{Op: op, Silent: true}
+	for _, f := range flags {
+		store.Flags = append(store.Flags, imap.Flag(f))
+	}
+	// with .SILENT the server only answers for messages changed by others,
+	// so the response stays small without chunking
+	err = client.Store(uids, store, nil).Close()
+	e.observe("STORE", err)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+
+	return nil
+}
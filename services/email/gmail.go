@@ -0,0 +1,483 @@
+package email
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// CapGmail is advertised by Gmail, whose labels, search syntax and
+// conversations are then available through the X-GM-* extensions.
+const CapGmail imap.Cap = "X-GM-EXT-1"
+
+// LabelInbox is the system label of the emails in the inbox, archiving
+// an email in Gmail removes it.
+const LabelInbox = `\Inbox`
+
+// ValidLabel checks that label can be set with X-GM-LABELS: a system
+// label such as \Inbox or \Starred, or any user label without line breaks.
+func ValidLabel(label string) error {
+	name, system := strings.CutPrefix(label, `\`)
+	if name == "" {
+		return fmt.Errorf("invalid label %q", label)
+	}
+	if strings.ContainsAny(label, "\r\n") {
+		return fmt.Errorf("invalid label %q: line breaks are not allowed", label)
+	}
+	if system {
+		for _, r := range name {
+			if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+				return fmt.Errorf("invalid system label %q", label)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removesFrom tells whether removing label from emails takes them out of
+// mailbox, which expunges them from it while it is selected. The mailboxes
+// of the system labels are localized, so any of them is taken to match.
+func removesFrom(label, mailbox string) bool {
+	if strings.EqualFold(mailbox, "INBOX") {
+		return strings.EqualFold(label, LabelInbox)
+	}
+	if strings.HasPrefix(label, `\`) {
+		return strings.HasPrefix(mailbox, "[")
+	}
+
+	return label == mailbox
+}
+
+// gmail runs f with the connection of the X-GM-* commands, dialed on first
+// use and selecting the mailbox of the lease, and client for the others.
+// It fails when the server does not advertise CapGmail.
+func (e *Core) gmail(ctx context.Context, access Access, f func(client *imapclient.Client, g *gmailConn) error) (err error) {
+	release, err := e.acquire(ctx, "", access)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	if !client.Caps().Has(CapGmail) {
+		return fmt.Errorf("%w: the server does not advertise %s", ErrClientError, CapGmail)
+	}
+
+	e.gmailMu.Lock()
+	defer e.gmailMu.Unlock()
+
+	if e.gmailConn == nil {
+		e.gmailConn, err = e.dialGmail(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = e.gmailConn.selectMailbox(ctx, e.sched.current())
+	if err == nil {
+		err = f(client, e.gmailConn)
+	}
+
+	// a broken connection is dialed again on the next use
+	var serr statusError
+	switch {
+	case err == nil, errors.Is(err, ErrClientError), errors.Is(err, ErrNotFound):
+	case errors.As(err, &serr):
+		err = fmt.Errorf("%w: %w", ErrClientError, err)
+	case ctx.Err() != nil:
+		e.closeGmail()
+	default:
+		e.closeGmail()
+		err = fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+
+	return err
+}
+
+// closeGmail drops the Gmail connection, the caller holds gmailMu.
+func (e *Core) closeGmail() {
+	if e.gmailConn != nil {
+		e.gmailConn.Close()
+		e.gmailConn = nil
+		e.budget.put()
+	}
+}
+
+// Labels returns the Gmail labels matching pattern, such as * or Work/*.
+// They are the mailboxes of the account, without the ones that cannot be
+// selected such as [Gmail].
+func (e *Core) Labels(ctx context.Context, pattern string) (_ []string, err error) {
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	if !client.Caps().Has(CapGmail) {
+		return nil, fmt.Errorf("%w: the server does not advertise %s", ErrClientError, CapGmail)
+	}
+
+	mailboxes, err := client.List("", pattern, nil).Collect()
+	e.observe("LIST", err)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+
+	var labels []string
+	for _, mb := range mailboxes {
+		if !slices.Contains(mb.Attrs, imap.MailboxAttrNoSelect) {
+			labels = append(labels, mb.Mailbox)
+		}
+	}
+	if len(labels) == 0 {
+		return nil, ErrNotFound
+	}
+	sort.Strings(labels)
+
+	return labels, nil
+}
+
+// AddLabels adds the Gmail labels to the messages in uids.
+func (e *Core) AddLabels(ctx context.Context, uids imap.UIDSet, labels ...string) error {
+	return e.storeLabels(ctx, uids, "+X-GM-LABELS", labels)
+}
+
+// RemoveLabels removes the Gmail labels from the messages in uids.
+func (e *Core) RemoveLabels(ctx context.Context, uids imap.UIDSet, labels ...string) error {
+	return e.storeLabels(ctx, uids, "-X-GM-LABELS", labels)
+}
+
+func (e *Core) storeLabels(ctx context.Context, uids imap.UIDSet, op string, labels []string) error {
+	for _, l := range labels {
+		err := ValidLabel(l)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrClientError, err)
+		}
+	}
+
+	// the emails leaving the selected mailbox change its sequence numbers
+	access := Shared
+	mailbox := e.mailboxOf(ctx)
+	for _, l := range labels {
+		if op == "-X-GM-LABELS" && removesFrom(l, mailbox) {
+			access = Exclusive
+		}
+	}
+
+	return e.gmail(ctx, access, func(_ *imapclient.Client, g *gmailConn) error {
+		return e.storeGmail(ctx, g, uids, op, labels)
+	})
+}
+
+func (e *Core) storeGmail(ctx context.Context, g *gmailConn, uids imap.UIDSet, op string, labels []string) error {
+	e.log.Debug("storing labels", "uids", uids, "op", op, "labels", labels)
+	list := make([]any, len(labels))
+	for i, l := range labels {
+		list[i] = labelArg(l)
+	}
+	// the FETCH responses telling the new labels are not needed
+	_, err := g.command(ctx, atom("UID STORE"), atom(uids.String()), atom(op), list)
+	e.observe("STORE", err)
+
+	return err
+}
+
+// labelArg sends system labels as atoms, Gmail would take a quoted \Inbox
+// for a user label.
+func labelArg(label string) any {
+	if strings.HasPrefix(label, `\`) {
+		return atom(label)
+	}
+
+	return utf7Encode(label)
+}
+
+// GmailArchive archives seqs the Gmail way, by removing their \Inbox label
+// rather than moving them to an Archive label. Like a MOVE it expunges them
+// from the inbox.
+func (e *Core) GmailArchive(ctx context.Context, seqs []uint32) error {
+	return e.gmail(ctx, Exclusive, func(client *imapclient.Client, g *gmailConn) error {
+		uids, err := e.uids(client, seqs)
+		if err != nil {
+			return err
+		}
+
+		report := progress(ctx, len(uids))
+		done := 0
+		for _, chunk := range chunks(uids) {
+			err = e.storeGmail(ctx, g, imap.UIDSetNum(chunk...), "-X-GM-LABELS", []string{LabelInbox})
+			if err != nil {
+				return fmt.Errorf("failed after archiving %d of %d messages: %w", done, len(uids), err)
+			}
+			done += len(chunk)
+			report("archive", done, len(uids))
+		}
+
+		return nil
+	})
+}
+
+// GmailSearch returns the page of emails matching raw, a query in the
+// search syntax of Gmail such as "from:jira newer_than:2d", with their
+// labels and thread ids.
+func (e *Core) GmailSearch(ctx context.Context, raw string, page Page) (res []Message, err error) {
+	e.log.Debug("searching gmail", "query", raw)
+
+	err = e.gmail(ctx, Shared, func(client *imapclient.Client, g *gmailConn) error {
+		uids, err := e.gmailSearch(ctx, g, rawCriteria(raw)...)
+		if err != nil {
+			return err
+		}
+
+		// uids grow with the sequence numbers, so the page is the same
+		uids = page.apply(uids)
+		if len(uids) == 0 {
+			return ErrNotFound
+		}
+
+		res, err = e.gmailMessages(ctx, client, g, uids)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if page.paged() {
+			return res[i].Seq > res[j].Seq
+		}
+		return res[i].Seq < res[j].Seq
+	})
+
+	return res, nil
+}
+
+func rawCriteria(raw string) []any {
+	if !quotable(raw) {
+		return []any{atom("CHARSET UTF-8 X-GM-RAW"), raw}
+	}
+
+	return []any{atom("X-GM-RAW"), raw}
+}
+
+// gmailSearch runs UID SEARCH with criteria and returns the UIDs in
+// ascending order.
+func (e *Core) gmailSearch(ctx context.Context, g *gmailConn, criteria ...any) ([]uint32, error) {
+	lines, err := g.command(ctx, append([]any{atom("UID SEARCH")}, criteria...)...)
+	e.observe("SEARCH", err)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for _, fields := range lines {
+		if name, _ := field(fields, 0); name != "SEARCH" {
+			continue
+		}
+		for i := 1; i < len(fields); i++ {
+			s, _ := field(fields, i)
+			uid, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid uid %q in search response", s)
+			}
+			uids = append(uids, uint32(uid))
+		}
+	}
+	slices.Sort(uids)
+
+	e.log.Debug("email count", "count", len(uids))
+
+	return uids, nil
+}
+
+// gmailMessages fetches the headers, labels and thread ids of uids in
+// chunks of ChunkSize.
+func (e *Core) gmailMessages(ctx context.Context, client *imapclient.Client, g *gmailConn, uids []uint32) ([]Message, error) {
+	report := progress(ctx, len(uids))
+	res := make([]Message, 0, len(uids))
+	for _, chunk := range chunks(uids) {
+		set := uidSet(chunk)
+		msgs, err := e.fetchHeaders(client, set)
+		if err != nil {
+			return nil, err
+		}
+		err = e.fetchGmail(ctx, g, set, msgs)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, msgs...)
+		report("fetch", len(res), len(uids))
+	}
+
+	return res, nil
+}
+
+func uidSet(uids []uint32) imap.UIDSet {
+	set := imap.UIDSet{}
+	for _, uid := range uids {
+		set.AddNum(imap.UID(uid))
+	}
+
+	return set
+}
+
+// fetchGmail sets the labels and thread ids of msgs, the messages of set.
+func (e *Core) fetchGmail(ctx context.Context, g *gmailConn, set imap.UIDSet, msgs []Message) error {
+	lines, err := g.command(ctx, atom("UID FETCH"), atom(set.String()), []any{atom("UID X-GM-THRID X-GM-LABELS")})
+	e.observe("FETCH", err)
+	if err != nil {
+		return err
+	}
+
+	byUID := make(map[uint32]*Message, len(msgs))
+	for i := range msgs {
+		byUID[msgs[i].UID] = &msgs[i]
+	}
+	for _, fields := range lines {
+		if name, _ := field(fields, 1); name != "FETCH" || len(fields) < 3 {
+			continue
+		}
+		items, ok := fields[2].([]any)
+		if !ok {
+			continue
+		}
+
+		var m *Message
+		var thread string
+		var labels []string
+		for i := 0; i+1 < len(items); i += 2 {
+			name, _ := field(items, i)
+			switch strings.ToUpper(name) {
+			case "UID":
+				s, _ := field(items, i+1)
+				uid, _ := strconv.ParseUint(s, 10, 32)
+				m = byUID[uint32(uid)]
+			case "X-GM-THRID":
+				thread, _ = field(items, i+1)
+			case "X-GM-LABELS":
+				list, _ := items[i+1].([]any)
+				for j := range list {
+					l, _ := field(list, j)
+					labels = append(labels, utf7Decode(l))
+				}
+			}
+		}
+		if m != nil {
+			m.Thread = thread
+			m.Labels = labels
+		}
+	}
+
+	return nil
+}
+
+// GmailThreads returns the page of the conversations with an email matching
+// raw, see GmailSearch, by their X-GM-THRID. Like Threads, they are in the
+// order of their newest email and hold every email of the mailbox.
+func (e *Core) GmailThreads(ctx context.Context, raw string, page Page) (threads []Thread, err error) {
+	e.log.Debug("threading gmail", "query", raw)
+
+	err = e.gmail(ctx, Shared, func(client *imapclient.Client, g *gmailConn) error {
+		matches, err := e.gmailSearch(ctx, g, rawCriteria(raw)...)
+		if err != nil {
+			return err
+		}
+
+		// only the thread ids of the matches are needed to find the others
+		var ids []string
+		for _, chunk := range chunks(matches) {
+			msgs := make([]Message, len(chunk))
+			for i, uid := range chunk {
+				msgs[i].UID = uid
+			}
+			err = e.fetchGmail(ctx, g, uidSet(chunk), msgs)
+			if err != nil {
+				return err
+			}
+			for _, m := range msgs {
+				if m.Thread != "" && !slices.Contains(ids, m.Thread) {
+					ids = append(ids, m.Thread)
+				}
+			}
+		}
+
+		conversations := make([][]uint32, 0, len(ids))
+		for _, id := range ids {
+			uids, err := e.gmailSearch(ctx, g, atom("X-GM-THRID"), atom(id))
+			if err != nil {
+				return err
+			}
+			conversations = append(conversations, uids)
+		}
+		slices.SortFunc(conversations, func(a, b []uint32) int {
+			return cmp.Compare(slices.Max(a), slices.Max(b))
+		})
+
+		// the page is one of threads, Page.apply takes their indexes
+		indexes := make([]uint32, len(conversations))
+		for i := range indexes {
+			indexes[i] = uint32(i)
+		}
+		indexes = page.apply(indexes)
+		if len(indexes) == 0 {
+			return ErrNotFound
+		}
+
+		var uids []uint32
+		for _, i := range indexes {
+			uids = append(uids, conversations[i]...)
+		}
+		msgs, err := e.gmailMessages(ctx, client, g, uids)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range indexes {
+			var t *Thread
+			for _, uid := range conversations[i] {
+				j := slices.IndexFunc(msgs, func(m Message) bool { return m.UID == uid })
+				if j < 0 {
+					continue
+				}
+				if t == nil {
+					threads = append(threads, Thread{ID: msgs[j].Thread, Subject: msgs[j].Subject})
+					t = &threads[len(threads)-1]
+				}
+				t.Messages = append(t.Messages, msgs[j])
+			}
+		}
+		for i := range threads {
+			slices.SortStableFunc(threads[i].Messages, func(a, b Message) int {
+				return a.Date.Compare(b.Date)
+			})
+			threads[i].Subject = threads[i].Messages[0].Subject
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return threads, nil
+}
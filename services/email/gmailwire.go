@@ -0,0 +1,514 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/emersion/go-sasl"
+)
+
+// gmailConn is a bare IMAP connection for the X-GM-* commands of Gmail,
+// imapclient can neither send them nor parse their responses. It only
+// knows enough of the protocol for these commands.
+type gmailConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	tag     int
+	mailbox string
+}
+
+// atom is written as is, other strings are quoted or sent as literals.
+type atom string
+
+// statusError is a NO or BAD completion, the connection stays usable.
+type statusError struct {
+	status string
+	text   string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%s %s", e.status, e.text)
+}
+
+func (e *Core) dialGmail(ctx context.Context) (_ *gmailConn, err error) {
+	err = e.budget.take(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			e.budget.put()
+		}
+	}()
+
+	target := net.JoinHostPort(e.conf.Host, e.conf.Port)
+	e.log.Debug("new gmail connection", "target", target)
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive},
+		Config:    &tls.Config{NextProtos: []string{"imap"}},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+
+	g := &gmailConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	_, err = g.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	saslClient, err := e.SASL()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = g.authenticate(ctx, saslClient)
+	e.observe("AUTHENTICATE", err)
+	if err != nil {
+		conn.Close()
+		var serr statusError
+		if errors.As(err, &serr) {
+			return nil, fmt.Errorf("%w: %w", ErrAuth, err)
+		}
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (g *gmailConn) authenticate(ctx context.Context, c sasl.Client) error {
+	mech, ir, err := c.Start()
+	if err != nil {
+		return err
+	}
+
+	args := []any{atom("AUTHENTICATE"), atom(mech)}
+	if ir != nil {
+		args = append(args, atom(saslString(ir)))
+	}
+	_, err = g.run(ctx, args, func(challenge string) (string, error) {
+		b, err := base64.StdEncoding.DecodeString(challenge)
+		if err != nil {
+			return "", err
+		}
+		resp, err := c.Next(b)
+		if err != nil {
+			// cancel the exchange, the server then fails the command
+			return "*", nil
+		}
+		// unlike an initial response, an empty one is an empty line
+		return base64.StdEncoding.EncodeToString(resp), nil
+	})
+
+	return err
+}
+
+func saslString(b []byte) string {
+	if len(b) == 0 {
+		return "="
+	}
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func (g *gmailConn) selectMailbox(ctx context.Context, mailbox string) error {
+	if g.mailbox == mailbox {
+		return nil
+	}
+
+	g.mailbox = ""
+	_, err := g.command(ctx, atom("SELECT"), utf7Encode(mailbox))
+	if err != nil {
+		return err
+	}
+	g.mailbox = mailbox
+
+	return nil
+}
+
+// command runs a command and returns its untagged responses, NO and BAD
+// completions are returned as statusError.
+func (g *gmailConn) command(ctx context.Context, args ...any) ([][]any, error) {
+	return g.run(ctx, args, nil)
+}
+
+// run sends args and reads the responses up to the completion, continue
+// requests are answered by cont.
+func (g *gmailConn) run(ctx context.Context, args []any, cont func(string) (string, error)) (_ [][]any, err error) {
+	// the deadline of ctx too is applied once it passes, so the command
+	// fails with ctx.Err rather than an i/o timeout
+	stop := context.AfterFunc(ctx, func() {
+		g.conn.SetDeadline(time.Now())
+	})
+	defer func() {
+		if !stop() && err != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	g.tag++
+	tag := "G" + strconv.Itoa(g.tag)
+	err = g.write(append([]any{atom(tag)}, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	var res [][]any
+	for {
+		fields, err := g.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			return nil, errors.New("empty response")
+		}
+
+		switch fields[0] {
+		case "*":
+			res = append(res, fields[1:])
+		case "+":
+			if cont == nil {
+				return nil, errors.New("unexpected continuation request")
+			}
+			resp, err := cont(lineText(fields[1:]))
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.WriteString(g.conn, resp+"\r\n")
+			if err != nil {
+				return nil, err
+			}
+		case tag:
+			status, _ := field(fields, 1)
+			if status != "OK" {
+				return nil, statusError{status: status, text: lineText(fields[2:])}
+			}
+			return res, nil
+		default:
+			return nil, fmt.Errorf("unexpected response %q", fields[0])
+		}
+	}
+}
+
+// write sends args separated by spaces, lists are []any. Strings needing
+// a literal wait for the continuation request of the server.
+func (g *gmailConn) write(args []any) error {
+	var buf bytes.Buffer
+	var err error
+	var writeArgs func(args []any)
+	writeArgs = func(args []any) {
+		for i, a := range args {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			switch v := a.(type) {
+			case atom:
+				buf.WriteString(string(v))
+			case []any:
+				buf.WriteByte('(')
+				writeArgs(v)
+				buf.WriteByte(')')
+			case string:
+				if quotable(v) {
+					buf.WriteString(strconv.Quote(v))
+					continue
+				}
+				fmt.Fprintf(&buf, "{%d}\r\n", len(v))
+				if err == nil {
+					err = g.literal(&buf)
+				}
+				buf.WriteString(v)
+			default:
+				fmt.Fprint(&buf, v)
+			}
+		}
+	}
+	writeArgs(args)
+	if err != nil {
+		return err
+	}
+	buf.WriteString("\r\n")
+	_, err = g.conn.Write(buf.Bytes())
+
+	return err
+}
+
+// literal sends buf, which ends with a literal's length, and waits for the
+// server to accept it.
+func (g *gmailConn) literal(buf *bytes.Buffer) error {
+	_, err := g.conn.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	buf.Reset()
+
+	fields, err := g.readLine()
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 || fields[0] != "+" {
+		return fmt.Errorf("literal rejected: %s", lineText(fields))
+	}
+
+	return nil
+}
+
+// quotable reports whether s can be sent as a quoted string, strconv.Quote
+// then only escapes quotes and backslashes.
+func quotable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] >= 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readLine reads a response line into fields: strings for atoms, quoted
+// strings and literals, and []any for lists. The text of status responses
+// and continuation requests is kept as one string.
+func (g *gmailConn) readLine() ([]any, error) {
+	var stack [][]any
+	var cur []any
+	for {
+		b, err := g.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch b {
+		case ' ':
+		case '\r', '\n':
+			if b == '\r' {
+				_, err = g.r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+			}
+			if len(stack) > 0 {
+				return nil, errors.New("unbalanced parenthesis in response")
+			}
+			return cur, nil
+		case '(':
+			stack = append(stack, cur)
+			cur = nil
+		case ')':
+			if len(stack) == 0 {
+				return nil, errors.New("unbalanced parenthesis in response")
+			}
+			cur, stack = append(stack[len(stack)-1], cur), stack[:len(stack)-1]
+		case '"':
+			s, err := g.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			cur = append(cur, s)
+		case '{':
+			s, err := g.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			cur = append(cur, s)
+		default:
+			g.r.UnreadByte()
+			s, err := g.readAtom()
+			if err != nil {
+				return nil, err
+			}
+			cur = append(cur, s)
+			if len(stack) == 0 && statusText(cur) {
+				text, err := g.r.ReadString('\n')
+				if err != nil {
+					return nil, err
+				}
+				return append(cur, strings.TrimSpace(text)), nil
+			}
+		}
+	}
+}
+
+// statusText reports whether the rest of the line is free text: after
+// "+", or after the status of a tagged or untagged status response.
+func statusText(fields []any) bool {
+	switch len(fields) {
+	case 1:
+		return fields[0] == "+"
+	case 2:
+		switch fields[1] {
+		case "OK", "NO", "BAD", "BYE", "PREAUTH":
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *gmailConn) readAtom() (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := g.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == ' ' || b == '(' || b == ')' || b == '\r' || b == '\n' {
+			g.r.UnreadByte()
+			return sb.String(), nil
+		}
+		sb.WriteByte(b)
+	}
+}
+
+func (g *gmailConn) readQuoted() (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := g.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			b, err = g.r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+		}
+		sb.WriteByte(b)
+	}
+}
+
+func (g *gmailConn) readLiteral() (string, error) {
+	size, err := g.r.ReadString('}')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(size, "}"))
+	if err != nil {
+		return "", fmt.Errorf("invalid literal size %q", size)
+	}
+	crlf := make([]byte, 2)
+	_, err = io.ReadFull(g.r, crlf)
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, n)
+	_, err = io.ReadFull(g.r, b)
+
+	return string(b), err
+}
+
+func (g *gmailConn) Close() error {
+	return g.conn.Close()
+}
+
+// field returns fields[i] when it is a string.
+func field(fields []any, i int) (string, bool) {
+	if i >= len(fields) {
+		return "", false
+	}
+	s, ok := fields[i].(string)
+
+	return s, ok
+}
+
+func lineText(fields []any) string {
+	s, _ := field(fields, len(fields)-1)
+	return s
+}
+
+// utf7Encode encodes a mailbox or label name in the modified UTF-7 of
+// RFC 3501.
+func utf7Encode(s string) string {
+	var sb strings.Builder
+	var run []rune
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		var b []byte
+		for _, u := range utf16.Encode(run) {
+			b = append(b, byte(u>>8), byte(u))
+		}
+		sb.WriteByte('&')
+		sb.WriteString(strings.ReplaceAll(base64.RawStdEncoding.EncodeToString(b), "/", ","))
+		sb.WriteByte('-')
+		run = run[:0]
+	}
+
+	for _, r := range s {
+		if r < 0x20 || r > 0x7e {
+			run = append(run, r)
+			continue
+		}
+		flush()
+		if r == '&' {
+			sb.WriteString("&-")
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	flush()
+
+	return sb.String()
+}
+
+// utf7Decode decodes modified UTF-7, invalid sequences are kept as is.
+func utf7Decode(s string) string {
+	var sb strings.Builder
+	for {
+		start := strings.IndexByte(s, '&')
+		if start < 0 {
+			return sb.String() + s
+		}
+		sb.WriteString(s[:start])
+		s = s[start+1:]
+
+		end := strings.IndexByte(s, '-')
+		if end < 0 {
+			return sb.String() + "&" + s
+		}
+		if end == 0 {
+			sb.WriteByte('&')
+			s = s[1:]
+			continue
+		}
+
+		b, err := base64.RawStdEncoding.DecodeString(strings.ReplaceAll(s[:end], ",", "/"))
+		if err != nil || len(b)%2 != 0 {
+			sb.WriteString("&" + s[:end+1])
+			s = s[end+1:]
+			continue
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		for _, r := range utf16.Decode(u) {
+			if r == utf8.RuneError {
+				continue
+			}
+			sb.WriteRune(r)
+		}
+		s = s[end+1:]
+	}
+}
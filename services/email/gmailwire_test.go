@@ -0,0 +1,476 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// exchange is a command a fakeGmail expects, literals included, and the
+// lines it answers with.
+type exchange struct {
+	command string
+	reply   []string
+}
+
+var literalSize = regexp.MustCompile(`\{(\d+)\}$`)
+
+// fakeGmail serves script over a pipe to the returned connection: it
+// accepts the literals of the commands and checks each of them against
+// the script.
+func fakeGmail(t *testing.T, script ...exchange) *gmailConn {
+	t.Helper()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+
+	go func() {
+		defer close(done)
+		defer server.Close()
+
+		r := bufio.NewReader(server)
+		for _, x := range script {
+			command, err := readCommand(r, server)
+			if err != nil {
+				t.Errorf("expected %q, got error %v", x.command, err)
+				return
+			}
+			if command != x.command {
+				t.Errorf("expected %q, got %q", x.command, command)
+			}
+			for _, line := range x.reply {
+				_, err = io.WriteString(server, line+"\r\n")
+				if err != nil {
+					t.Errorf("failed to reply to %q: %v", command, err)
+					return
+				}
+			}
+		}
+		// hold the connection open until the client is done with it
+		io.Copy(io.Discard, r)
+	}()
+
+	return &gmailConn{conn: client, r: bufio.NewReader(client)}
+}
+
+// readCommand reads a command line, accepting its literals.
+func readCommand(r *bufio.Reader, w io.Writer) (string, error) {
+	var sb strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		sb.WriteString(line)
+
+		m := literalSize.FindStringSubmatch(line)
+		if m == nil {
+			return sb.String(), nil
+		}
+		n, _ := strconv.Atoi(m[1])
+		_, err = io.WriteString(w, "+ Ready for literal data\r\n")
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString("\r\n")
+		sb.Write(b)
+	}
+}
+
+func testCore(t *testing.T) *Core {
+	t.Helper()
+
+	e, err := newCore(Conf{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestGmailAuthenticate(t *testing.T) {
+	xoauth2 := b64("user=me@gmail.com\x01auth=Bearer tok\x01\x01")
+
+	tests := []struct {
+		name   string
+		client sasl.Client
+		script []exchange
+		status string
+	}{
+		{
+			name:   "plain",
+			client: sasl.NewPlainClient("", "me", "pw"),
+			script: []exchange{{
+				command: "G1 AUTHENTICATE PLAIN " + b64("\x00me\x00pw"),
+				reply:   []string{"* CAPABILITY IMAP4rev1 X-GM-EXT-1", "G1 OK me authenticated (Success)"},
+			}},
+		},
+		{
+			name:   "xoauth2",
+			client: NewXOAuth2Client("me@gmail.com", "tok"),
+			script: []exchange{{
+				command: "G1 AUTHENTICATE XOAUTH2 " + xoauth2,
+				reply:   []string{"G1 OK Success"},
+			}},
+		},
+		{
+			name:   "xoauth2 rejected",
+			client: NewXOAuth2Client("me@gmail.com", "tok"),
+			script: []exchange{
+				{
+					command: "G1 AUTHENTICATE XOAUTH2 " + xoauth2,
+					reply:   []string{"+ " + b64(`{"status":"401","schemes":"Bearer","scope":"https://mail.google.com/"}`)},
+				},
+				{
+					// the error challenge is answered with an empty line
+					command: "",
+					reply:   []string{"G1 NO [AUTHENTICATIONFAILED] Invalid credentials (Failure)"},
+				},
+			},
+			status: "NO",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := fakeGmail(t, tt.script...)
+
+			err := g.authenticate(context.Background(), tt.client)
+			var serr statusError
+			switch {
+			case tt.status == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.status != "" && !errors.As(err, &serr):
+				t.Fatalf("expected a %s completion, got %v", tt.status, err)
+			case tt.status != "" && serr.status != tt.status:
+				t.Errorf("expected a %s completion, got %s", tt.status, serr.status)
+			}
+		})
+	}
+}
+
+func TestGmailSearch(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		command string
+		reply   []string
+		uids    []uint32
+	}{
+		{
+			name:    "quoted",
+			raw:     `from:jira subject:"build failed" newer_than:2d`,
+			command: `G1 UID SEARCH X-GM-RAW "from:jira subject:\"build failed\" newer_than:2d"`,
+			reply:   []string{"* SEARCH 7 3 5", "G1 OK SEARCH completed (Success)"},
+			uids:    []uint32{3, 5, 7},
+		},
+		{
+			name:    "backslash",
+			raw:     `label:a\b`,
+			command: `G1 UID SEARCH X-GM-RAW "label:a\\b"`,
+			reply:   []string{"* SEARCH 12", "G1 OK SEARCH completed (Success)"},
+			uids:    []uint32{12},
+		},
+		{
+			name:    "literal",
+			raw:     "subject:café",
+			command: "G1 UID SEARCH CHARSET UTF-8 X-GM-RAW {13}\r\nsubject:café",
+			reply:   []string{"* SEARCH", "G1 OK SEARCH completed (Success)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testCore(t)
+			g := fakeGmail(t, exchange{command: tt.command, reply: tt.reply})
+
+			uids, err := e.gmailSearch(context.Background(), g, rawCriteria(tt.raw)...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(uids, tt.uids) {
+				t.Errorf("expected uids %v, got %v", tt.uids, uids)
+			}
+		})
+	}
+}
+
+func TestGmailSearchBad(t *testing.T) {
+	e := testCore(t)
+	g := fakeGmail(t,
+		exchange{
+			command: `G1 UID SEARCH X-GM-RAW "in:"`,
+			reply:   []string{"G1 BAD Could not parse command"},
+		},
+		exchange{
+			command: `G2 UID SEARCH X-GM-RAW "in:inbox"`,
+			reply:   []string{"* SEARCH 1", "G2 OK SEARCH completed (Success)"},
+		},
+	)
+
+	_, err := e.gmailSearch(context.Background(), g, rawCriteria("in:")...)
+	var serr statusError
+	if !errors.As(err, &serr) || serr.status != "BAD" || serr.text != "Could not parse command" {
+		t.Fatalf("expected the BAD completion, got %v", err)
+	}
+
+	// the connection stays usable
+	uids, err := e.gmailSearch(context.Background(), g, rawCriteria("in:inbox")...)
+	if err != nil || !slices.Equal(uids, []uint32{1}) {
+		t.Errorf("expected uid 1, got %v, %v", uids, err)
+	}
+}
+
+func TestGmailStoreLabels(t *testing.T) {
+	e := testCore(t)
+	g := fakeGmail(t, exchange{
+		command: `G1 UID STORE 1:2,5 +X-GM-LABELS (\Starred "Work/Caf&AOk-" "say \"hi\"")`,
+		reply: []string{
+			`* 1 FETCH (X-GM-LABELS (\Inbox \Starred "Work/Caf&AOk-" "say \"hi\"") UID 1)`,
+			`* 2 FETCH (X-GM-LABELS (\Starred "Work/Caf&AOk-" "say \"hi\"") UID 2)`,
+			`* 4 FETCH (X-GM-LABELS (\Starred "Work/Caf&AOk-" "say \"hi\"") UID 5)`,
+			"G1 OK Success",
+		},
+	})
+
+	err := e.storeGmail(context.Background(), g, uidSet([]uint32{1, 2, 5}), "+X-GM-LABELS", []string{`\Starred`, "Work/Café", `say "hi"`})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGmailFetch(t *testing.T) {
+	e := testCore(t)
+	g := fakeGmail(t, exchange{
+		command: "G1 UID FETCH 1:3 (UID X-GM-THRID X-GM-LABELS)",
+		reply: []string{
+			`* 1 FETCH (UID 1 X-GM-THRID 1278455344230334865 X-GM-LABELS (\Inbox "Work/Caf&AOk-" {5}`,
+			`a)b c))`,
+			"* 2 FETCH (X-GM-LABELS () UID 2 X-GM-THRID 42)",
+			"* 3 FETCH (UID 9 X-GM-THRID 7 X-GM-LABELS (\\Important))",
+			"G1 OK Success",
+		},
+	})
+
+	msgs := []Message{{UID: 1}, {UID: 2}, {UID: 3}}
+	err := e.fetchGmail(context.Background(), g, uidSet([]uint32{1, 2, 3}), msgs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []struct {
+		thread string
+		labels []string
+	}{
+		{"1278455344230334865", []string{`\Inbox`, "Work/Café", "a)b c"}},
+		{"42", nil},
+		// the response of uid 9 is for no message of the set
+		{"", nil},
+	}
+	for i, m := range msgs {
+		if m.Thread != expected[i].thread || !slices.Equal(m.Labels, expected[i].labels) {
+			t.Errorf("uid %d: expected %q %q, got %q %q", m.UID, expected[i].thread, expected[i].labels, m.Thread, m.Labels)
+		}
+	}
+}
+
+func TestGmailSelectMailbox(t *testing.T) {
+	g := fakeGmail(t,
+		exchange{
+			command: `G1 SELECT "[Gmail]/Caf&AOk-"`,
+			reply:   []string{"* 3 EXISTS", "* OK [UIDVALIDITY 11] UIDs valid.", "G1 OK [READ-WRITE] [Gmail]/Caf&AOk- selected. (Success)"},
+		},
+		exchange{
+			command: `G2 SELECT "Gone"`,
+			reply:   []string{"G2 NO [NONEXISTENT] Unknown Mailbox: Gone (Failure)"},
+		},
+		exchange{
+			command: `G3 SELECT "[Gmail]/Caf&AOk-"`,
+			reply:   []string{"G3 OK [READ-WRITE] [Gmail]/Caf&AOk- selected. (Success)"},
+		},
+	)
+	ctx := context.Background()
+
+	for _, mailbox := range []string{"[Gmail]/Café", "[Gmail]/Café"} {
+		// the second one is already selected and sends nothing
+		err := g.selectMailbox(ctx, mailbox)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	err := g.selectMailbox(ctx, "Gone")
+	var serr statusError
+	if !errors.As(err, &serr) || serr.status != "NO" {
+		t.Fatalf("expected a NO completion, got %v", err)
+	}
+	if g.mailbox != "" {
+		t.Errorf("expected no selected mailbox after a failed SELECT, got %q", g.mailbox)
+	}
+
+	err = g.selectMailbox(ctx, "[Gmail]/Café")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestGmailCanceled(t *testing.T) {
+	e := testCore(t)
+	// the server never answers
+	g := fakeGmail(t, exchange{command: `G1 UID SEARCH X-GM-RAW "is:unread"`})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := e.gmailSearch(ctx, g, rawCriteria("is:unread")...)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline of ctx, got %v", err)
+	}
+}
+
+func TestUTF7(t *testing.T) {
+	tests := []struct {
+		decoded string
+		encoded string
+	}{
+		{"INBOX", "INBOX"},
+		{"Work/Café", "Work/Caf&AOk-"},
+		{"R&D", "R&-D"},
+		{"日本語", "&ZeVnLIqe-"},
+		{"~peter/mail/台北/日本語", "~peter/mail/&U,BTFw-/&ZeVnLIqe-"},
+		{"😀", "&2D3eAA-"},
+	}
+
+	for _, tt := range tests {
+		if got := utf7Encode(tt.decoded); got != tt.encoded {
+			t.Errorf("utf7Encode(%q): expected %q, got %q", tt.decoded, tt.encoded, got)
+		}
+		if got := utf7Decode(tt.encoded); got != tt.decoded {
+			t.Errorf("utf7Decode(%q): expected %q, got %q", tt.encoded, tt.decoded, got)
+		}
+	}
+
+	// invalid sequences are kept as is
+	for _, s := range []string{"&Jjo", "&A-", "a&"} {
+		if got := utf7Decode(s); got != s {
+			t.Errorf("utf7Decode(%q): expected it unchanged, got %q", s, got)
+		}
+	}
+}
+
+func TestConnBudget(t *testing.T) {
+	newBudget := func(max, cores int) *connBudget {
+		b := &connBudget{slots: make(chan struct{}, max)}
+		for range cores {
+			b.slots <- struct{}{}
+			b.cores = append(b.cores, &Core{budget: b})
+		}
+		return b
+	}
+	open := func(e *Core) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+		e.gmailConn = &gmailConn{conn: client}
+	}
+	ctx := context.Background()
+
+	t.Run("full", func(t *testing.T) {
+		b := newBudget(2, 2)
+		err := b.take(ctx, b.cores[0])
+		if !errors.Is(err, ErrClientError) {
+			t.Errorf("expected a client error without room for a Gmail connection, got %v", err)
+		}
+	})
+
+	t.Run("reclaim", func(t *testing.T) {
+		b := newBudget(3, 2)
+		a, c := b.cores[0], b.cores[1]
+		err := b.take(ctx, a)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		open(a)
+
+		// the idle connection of a makes room for the one of c
+		err = b.take(ctx, c)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if a.gmailConn != nil {
+			t.Error("expected the idle connection to be closed")
+		}
+		if len(b.slots) != 3 {
+			t.Errorf("expected 3 connections, got %d", len(b.slots))
+		}
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		b := newBudget(3, 2)
+		a, c := b.cores[0], b.cores[1]
+		err := b.take(ctx, a)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		open(a)
+
+		// a is running a command, c waits for it to be done
+		a.gmailMu.Lock()
+		time.AfterFunc(2*reclaimDelay, a.gmailMu.Unlock)
+		start := time.Now()
+		err = b.take(ctx, c)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if time.Since(start) < 2*reclaimDelay {
+			t.Error("expected to wait for the busy connection")
+		}
+
+		a.gmailMu.Lock()
+		defer a.gmailMu.Unlock()
+		timeout, cancel := context.WithTimeout(ctx, reclaimDelay/2)
+		defer cancel()
+		err = b.take(timeout, a)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the deadline of ctx, got %v", err)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		b := newBudget(3, 1)
+		a := b.cores[0]
+		err := b.take(ctx, a)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		open(a)
+		a.closeGmail()
+		if len(b.slots) != 1 {
+			t.Errorf("expected the closed connection to be given back, got %d in use", len(b.slots))
+		}
+	})
+}
@@ -0,0 +1,547 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// Methods of the iCalendar invitations, RFC 5546.
+const (
+	MethodRequest = "REQUEST"
+	MethodCancel  = "CANCEL"
+)
+
+// Event is a VEVENT of an iCalendar part, RFC 5545. Method is the one of
+// its calendar: REQUEST invites or updates, CANCEL calls the event off.
+type Event struct {
+	// ID is the UID of the event, the same in its updates and cancellation
+	ID        string    `json:"id" yaml:"id"`
+	Method    string    `json:"method,omitempty" yaml:"method,omitempty"`
+	Sequence  int       `json:"sequence" yaml:"sequence"`
+	Status    string    `json:"status,omitempty" yaml:"status,omitempty"`
+	Summary   string    `json:"summary" yaml:"summary"`
+	Organizer string    `json:"organizer,omitempty" yaml:"organizer,omitempty"`
+	Attendees []string  `json:"attendees,omitempty" yaml:"attendees,omitempty"`
+	Location  string    `json:"location,omitempty" yaml:"location,omitempty"`
+	Start     time.Time `json:"start" yaml:"start"`
+	End       time.Time `json:"end" yaml:"end"`
+	// AllDay events have dates, Start and End are midnight in time.Local
+	AllDay bool   `json:"all_day,omitempty" yaml:"all_day,omitempty"`
+	RRule  string `json:"rrule,omitempty" yaml:"rrule,omitempty"`
+}
+
+// Canceled reports whether the event is called off.
+func (ev Event) Canceled() bool {
+	return ev.Method == MethodCancel || ev.Status == "CANCELLED"
+}
+
+// Upcoming reports whether the event, or with an RRULE one of its
+// occurrences, may still be ahead of now.
+func (ev Event) Upcoming(now time.Time) bool {
+	if ev.End.After(now) || ev.Start.After(now) {
+		return true
+	}
+	if ev.RRule == "" {
+		return false
+	}
+
+	until, ok := ruleParam(ev.RRule, "UNTIL")
+	if !ok {
+		// COUNT is not expanded, the rule may still have occurrences
+		return true
+	}
+	t, _, err := parseICalTime(until, "", ev.Start.Location())
+
+	return err != nil || !t.Before(now)
+}
+
+func ruleParam(rule, name string) (string, bool) {
+	for _, p := range strings.Split(rule, ";") {
+		k, v, _ := strings.Cut(p, "=")
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// isCalendar reports whether a part of an email, of the media type and
+// file name, is an iCalendar object.
+func isCalendar(mediaType, filename string) bool {
+	switch strings.ToLower(mediaType) {
+	case "text/calendar", "application/ics":
+		return true
+	}
+
+	return strings.EqualFold(path.Ext(filename), ".ics")
+}
+
+type icalProp struct {
+	params map[string]string
+	value  string
+}
+
+// ParseCalendar returns the events of the iCalendar object read from r,
+// method is the one of its Content-Type, used when the calendar has none.
+// TZID are IANA names or, for the ones of other systems, the standard
+// offset of their VTIMEZONE, daylight saving time is not applied.
+func ParseCalendar(r io.Reader, method string) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read calendar: %w", err)
+	}
+
+	var (
+		events []Event
+		// times holds DTSTART, DTEND and DURATION of every event, they
+		// are read once the VTIMEZONE, which may come later, are known
+		times  []map[string]icalProp
+		zones  = map[string]*time.Location{}
+		tzid   string
+		offset string
+		// stack holds the components the line is in, VCALENDAR first
+		stack []string
+	)
+	for _, line := range lines {
+		name, params, value, ok := parseContentLine(line)
+		if !ok {
+			continue
+		}
+
+		switch name {
+		case "BEGIN":
+			stack = append(stack, strings.ToUpper(value))
+			if len(stack) == 2 && stack[1] == "VEVENT" {
+				events = append(events, Event{})
+				times = append(times, map[string]icalProp{})
+			}
+			continue
+		case "END":
+			if len(stack) == 0 || !strings.EqualFold(stack[len(stack)-1], value) {
+				return nil, fmt.Errorf("unexpected END:%s", value)
+			}
+			if strings.EqualFold(value, "STANDARD") && tzid != "" && offset != "" {
+				if loc, ok := fixedZone(tzid, offset); ok {
+					zones[tzid] = loc
+				}
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		switch {
+		case len(stack) == 1 && name == "METHOD":
+			method = value
+		case len(stack) == 2 && stack[1] == "VTIMEZONE" && name == "TZID":
+			tzid = value
+		case len(stack) == 3 && stack[2] == "STANDARD" && name == "TZOFFSETTO":
+			offset = value
+		case len(stack) == 2 && stack[1] == "VEVENT":
+			ev := &events[len(events)-1]
+			switch name {
+			case "UID":
+				ev.ID = value
+			case "SUMMARY":
+				ev.Summary = unescapeText(value)
+			case "LOCATION":
+				ev.Location = unescapeText(value)
+			case "STATUS":
+				ev.Status = strings.ToUpper(value)
+			case "SEQUENCE":
+				ev.Sequence, _ = strconv.Atoi(value)
+			case "RRULE":
+				ev.RRule = value
+			case "ORGANIZER":
+				ev.Organizer = calAddress(params, value)
+			case "ATTENDEE":
+				ev.Attendees = append(ev.Attendees, calAddress(params, value))
+			case "DTSTART", "DTEND", "DURATION":
+				times[len(times)-1][name] = icalProp{params: params, value: value}
+			}
+		}
+	}
+
+	for i := range events {
+		events[i].Method = strings.ToUpper(method)
+		err = events[i].setTimes(times[i], zones)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event %q: %w", events[i].ID, err)
+		}
+	}
+
+	return events, nil
+}
+
+func (ev *Event) setTimes(props map[string]icalProp, zones map[string]*time.Location) error {
+	start, ok := props["DTSTART"]
+	if !ok {
+		return errors.New("DTSTART is missing")
+	}
+
+	var err error
+	ev.Start, ev.AllDay, err = parseICalProp(start, zones)
+	if err != nil {
+		return err
+	}
+
+	if end, ok := props["DTEND"]; ok {
+		ev.End, _, err = parseICalProp(end, zones)
+		return err
+	}
+	if d, ok := props["DURATION"]; ok {
+		dur, err := parseDuration(d.value)
+		if err != nil {
+			return err
+		}
+		ev.End = ev.Start.Add(dur)
+		return nil
+	}
+
+	// RFC 5545 3.6.1, a date lasts the day and a date-time no time
+	ev.End = ev.Start
+	if ev.AllDay {
+		ev.End = ev.Start.AddDate(0, 0, 1)
+	}
+
+	return nil
+}
+
+func parseICalProp(p icalProp, zones map[string]*time.Location) (time.Time, bool, error) {
+	var loc *time.Location
+	if tzid := p.params["TZID"]; tzid != "" {
+		loc = zones[tzid]
+		if loc == nil {
+			var err error
+			loc, err = time.LoadLocation(strings.TrimPrefix(tzid, "/"))
+			if err != nil {
+				// unknown zones are read as floating times
+				loc = nil
+			}
+		}
+	}
+
+	return parseICalTime(p.value, p.params["VALUE"], loc)
+}
+
+// parseICalTime parses a DATE, or a DATE-TIME in UTC, loc or without loc
+// the local time zone. It reports whether value is a date.
+func parseICalTime(value, kind string, loc *time.Location) (time.Time, bool, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	if strings.EqualFold(kind, "DATE") || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+
+	return t, false, err
+}
+
+var durationRe = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseDuration parses an iCalendar DURATION such as P1D or PT1H30M.
+func parseDuration(value string) (time.Duration, error) {
+	m := durationRe.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	var d time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		n, _ := strconv.Atoi(m[i+2])
+		d += time.Duration(n) * unit
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+
+	return d, nil
+}
+
+// fixedZone returns a zone named tzid at offset, a TZOFFSETTO such as
+// +0100 or -053000.
+func fixedZone(tzid, offset string) (*time.Location, bool) {
+	if len(offset) < 5 || (offset[0] != '+' && offset[0] != '-') {
+		return nil, false
+	}
+	h, err1 := strconv.Atoi(offset[1:3])
+	m, err2 := strconv.Atoi(offset[3:5])
+	s := 0
+	var err3 error
+	if len(offset) >= 7 {
+		s, err3 = strconv.Atoi(offset[5:7])
+	}
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, false
+	}
+
+	secs := h*3600 + m*60 + s
+	if offset[0] == '-' {
+		secs = -secs
+	}
+
+	return time.FixedZone(tzid, secs), true
+}
+
+// unfold reads the content lines of r, joining the ones folded over
+// several lines.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if len(lines) > 0 && line != "" && (line[0] == ' ' || line[0] == '\t') {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, sc.Err()
+}
+
+// parseContentLine splits `NAME;PARAM=value:value` into its parts, the
+// name and the parameter names are upper case.
+func parseContentLine(line string) (name string, params map[string]string, value string, ok bool) {
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return "", nil, "", false
+	}
+	name = strings.ToUpper(line[:i])
+	params = map[string]string{}
+
+	rest := line[i:]
+	for strings.HasPrefix(rest, ";") {
+		rest = rest[1:]
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return "", nil, "", false
+		}
+		key := strings.ToUpper(rest[:eq])
+		rest = rest[eq+1:]
+
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, "", false
+			}
+			v, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, ";:")
+			if end < 0 {
+				return "", nil, "", false
+			}
+			v, rest = rest[:end], rest[end:]
+		}
+		// a list of values is only kept up to its first one
+		v, _, _ = strings.Cut(v, ",")
+		params[key] = v
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return "", nil, "", false
+	}
+
+	return name, params, rest[1:], true
+}
+
+var textEscapes = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+func unescapeText(s string) string {
+	return textEscapes.Replace(s)
+}
+
+// calAddress formats an ORGANIZER or ATTENDEE as `Name <address>`.
+func calAddress(params map[string]string, value string) string {
+	addr := value
+	if len(addr) > len("mailto:") && strings.EqualFold(addr[:len("mailto:")], "mailto:") {
+		addr = addr[len("mailto:"):]
+	}
+	if cn := params["CN"]; cn != "" {
+		return cn + " <" + addr + ">"
+	}
+
+	return addr
+}
+
+// Invite is an event of an invitation with the email it came in.
+type Invite struct {
+	UID     uint32   `json:"uid" yaml:"uid"`
+	Seq     uint32   `json:"seq" yaml:"seq"`
+	From    []string `json:"from" yaml:"from"`
+	Subject string   `json:"subject" yaml:"subject"`
+	Event   `yaml:",inline"`
+}
+
+// Invites returns the events of the emails matching query that have an
+// iCalendar part, the page applies to those emails. Only the body
+// structure of the others is fetched.
+func (e *Core) Invites(ctx context.Context, query Query, page Page) (_ []Invite, err error) {
+	e.log.Debug("looking for invites", "query", query)
+
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	res, err := client.Search(query.criteria(), nil).Wait()
+	e.observe("SEARCH", err)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+	seqnums := res.AllSeqNums()
+	slices.Sort(seqnums)
+
+	var calendars []uint32
+	for _, chunk := range chunks(seqnums) {
+		cals, err := e.withCalendar(client, imap.SeqSetNum(chunk...))
+		if err != nil {
+			return nil, err
+		}
+		calendars = append(calendars, cals...)
+	}
+	slices.Sort(calendars)
+
+	calendars = page.apply(calendars)
+	if len(calendars) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return e.fetchInvites(client, calendars)
+}
+
+// InvitesAfter returns the events of the emails matching query with a UID
+// above after that have an iCalendar part. The UID returned is the highest
+// of the mailbox, the one to go on after to only look at new emails.
+func (e *Core) InvitesAfter(ctx context.Context, query Query, after uint32) (_ []Invite, _ uint32, err error) {
+	e.log.Debug("looking for new invites", "query", query, "after", after)
+
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	last, err := client.UIDSearch(&imap.SearchCriteria{UID: []imap.UIDSet{imap.UIDSetNum(0)}}, nil).Wait()
+	e.observe("SEARCH", err)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+	highest := after
+	for _, uid := range last.AllUIDs() {
+		highest = max(highest, uint32(uid))
+	}
+
+	uids, err := e.uidsAfter(client, query.criteria(), after)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var calendars []uint32
+	for _, chunk := range chunks(uids) {
+		cals, err := e.withCalendar(client, imap.UIDSetNum(chunk...))
+		if err != nil {
+			return nil, 0, err
+		}
+		calendars = append(calendars, cals...)
+	}
+	if len(calendars) == 0 {
+		return nil, highest, nil
+	}
+	slices.Sort(calendars)
+
+	invites, err := e.fetchInvites(client, calendars)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return invites, highest, nil
+}
+
+// withCalendar returns the sequence numbers of the emails of set that have
+// an iCalendar part, going by their body structure.
+func (e *Core) withCalendar(client *imapclient.Client, set imap.NumSet) ([]uint32, error) {
+	bufs, err := client.Fetch(set, &imap.FetchOptions{
+		BodyStructure: &imap.FetchItemBodyStructure{Extended: true},
+	}).Collect()
+	e.observe("FETCH", err)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+
+	var calendars []uint32
+	for _, buf := range bufs {
+		if hasCalendar(buf.BodyStructure) {
+			calendars = append(calendars, buf.SeqNum)
+		}
+	}
+
+	return calendars, nil
+}
+
+// fetchInvites reads the events of the emails of seqnums.
+func (e *Core) fetchInvites(client *imapclient.Client, seqnums []uint32) ([]Invite, error) {
+	var invites []Invite
+	for _, chunk := range chunks(seqnums) {
+		msgs, err := e.fetchBodies(client, imap.SeqSetNum(chunk...))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			for _, ev := range m.Events {
+				invites = append(invites, Invite{UID: m.UID, Seq: m.Seq, From: m.From, Subject: m.Subject, Event: ev})
+			}
+		}
+	}
+
+	return invites, nil
+}
+
+func hasCalendar(bs imap.BodyStructure) bool {
+	if bs == nil {
+		return false
+	}
+
+	found := false
+	bs.Walk(func(_ []int, part imap.BodyStructure) bool {
+		if p, ok := part.(*imap.BodyStructureSinglePart); ok && isCalendar(p.MediaType(), p.Filename()) {
+			found = true
+		}
+		return !found
+	})
+
+	return found
+}
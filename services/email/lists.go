@@ -0,0 +1,414 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// SMTPConf is the server the unsubscribe emails are sent with, Username
+// and Password default to the ones of the account and From to Username.
+type SMTPConf struct {
+	Host     string `json:"host" yaml:"host"`
+	Port     string `json:"port" yaml:"port"`
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	From     string `json:"from,omitempty" yaml:"from,omitempty"`
+}
+
+// List is a mailing list or newsletter, the emails with its List-Id or,
+// without one, from the same sender with a List-Unsubscribe header.
+type List struct {
+	// ID is the List-Id, or the address of the sender without one
+	ID       string    `json:"id" yaml:"id"`
+	Name     string    `json:"name,omitempty" yaml:"name,omitempty"`
+	From     string    `json:"from" yaml:"from"`
+	Count    int       `json:"count" yaml:"count"`
+	LastSeen time.Time `json:"last_seen" yaml:"last_seen"`
+	// UID is the one of the newest email, whose List-Unsubscribe is used
+	UID uint32 `json:"uid" yaml:"uid"`
+	// Unsubscribe are the URIs of List-Unsubscribe, OneClick is set when
+	// List-Unsubscribe-Post allows a POST to the http one, RFC 8058
+	Unsubscribe []string `json:"unsubscribe,omitempty" yaml:"unsubscribe,omitempty"`
+	OneClick    bool     `json:"one_click,omitempty" yaml:"one_click,omitempty"`
+}
+
+// Unsubscription is how a list is unsubscribed from: a POST of
+// List-Unsubscribe=One-Click to an http URI, or an email to a mailto one.
+type Unsubscription struct {
+	List   string `json:"list" yaml:"list"`
+	Method string `json:"method" yaml:"method"`
+	Target string `json:"target" yaml:"target"`
+}
+
+const (
+	UnsubscribePost = "post"
+	UnsubscribeMail = "mailto"
+)
+
+var listHeaders = []string{"List-Id", "List-Unsubscribe", "List-Unsubscribe-Post"}
+
+// Lists returns the lists of the emails matching query that have a List-Id
+// or a List-Unsubscribe header, the ones with the most emails first.
+func (e *Core) Lists(ctx context.Context, query Query) (_ []List, err error) {
+	e.log.Debug("listing lists", "query", query)
+
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	criteria := query.criteria()
+	criteria.Or = append(criteria.Or, [2]imap.SearchCriteria{
+		{Header: []imap.SearchCriteriaHeaderField{{Key: "List-Id"}}},
+		{Header: []imap.SearchCriteriaHeaderField{{Key: "List-Unsubscribe"}}},
+	})
+	res, err := client.UIDSearch(criteria, nil).Wait()
+	e.observe("SEARCH", err)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+	uids := res.AllUIDs()
+	slices.Sort(uids)
+
+	lists := map[string]*List{}
+	report := progress(ctx, len(uids))
+	done := 0
+	for _, chunk := range chunks(uids) {
+		bufs, err := client.Fetch(imap.UIDSetNum(chunk...), &imap.FetchOptions{
+			Envelope: true,
+			UID:      true,
+			BodySection: []*imap.FetchItemBodySection{
+				{Peek: true, Specifier: imap.PartSpecifierHeader, HeaderFields: listHeaders},
+			},
+		}).Collect()
+		e.observe("FETCH", err)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+		}
+
+		for _, buf := range bufs {
+			for _, raw := range buf.BodySection {
+				addToList(lists, newMessage(buf), raw)
+			}
+		}
+		done += len(chunk)
+		report("lists", done, len(uids))
+	}
+
+	if len(lists) == 0 {
+		return nil, ErrNotFound
+	}
+
+	result := make([]List, 0, len(lists))
+	for _, l := range lists {
+		result = append(result, *l)
+	}
+	slices.SortFunc(result, func(a, b List) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), b.LastSeen.Compare(a.LastSeen), cmp.Compare(a.ID, b.ID))
+	})
+
+	return result, nil
+}
+
+// addToList counts m, whose list headers are in raw, in its list.
+func addToList(lists map[string]*List, m Message, raw []byte) {
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return
+	}
+
+	from := ""
+	if len(m.From) > 0 {
+		from = m.From[0]
+	}
+	id, name := parseListID(h.Get("List-Id"))
+	if id == "" {
+		id = senderAddress(from)
+	}
+	unsubscribe := parseListUnsubscribe(h.Get("List-Unsubscribe"))
+	if id == "" || (h.Get("List-Id") == "" && len(unsubscribe) == 0) {
+		return
+	}
+
+	l, ok := lists[id]
+	if !ok {
+		l = &List{ID: id}
+		lists[id] = l
+	}
+	l.Count++
+	// the newest email has the current way to unsubscribe
+	if m.UID < l.UID {
+		return
+	}
+	l.UID = m.UID
+	l.LastSeen = m.Date
+	l.From = from
+	if name != "" {
+		l.Name = name
+	}
+	l.Unsubscribe = unsubscribe
+	l.OneClick = strings.EqualFold(strings.TrimSpace(h.Get("List-Unsubscribe-Post")), "List-Unsubscribe=One-Click") && l.postURI() != ""
+}
+
+// parseListID splits a List-Id, RFC 2919, such as `News <news.example.com>`.
+func parseListID(v string) (id, name string) {
+	v = strings.TrimSpace(v)
+	start, end := strings.LastIndexByte(v, '<'), strings.LastIndexByte(v, '>')
+	if start < 0 || end < start {
+		return strings.ToLower(v), ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(v[start+1 : end])), strings.Trim(strings.TrimSpace(v[:start]), `"`)
+}
+
+// parseListUnsubscribe returns the URIs of a List-Unsubscribe header,
+// RFC 2369, which are in angle brackets separated by commas.
+func parseListUnsubscribe(v string) []string {
+	var uris []string
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "<") || !strings.HasSuffix(part, ">") {
+			continue
+		}
+		// folding may have left white space in the URI
+		uri := strings.Join(strings.Fields(part[1:len(part)-1]), "")
+		if uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+
+	return uris
+}
+
+func senderAddress(from string) string {
+	a, err := mail.ParseAddress(from)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(a.Address)
+}
+
+// postURI returns the https URI of the one-click POST, RFC 8058 does not
+// allow it in plain text.
+func (l List) postURI() string {
+	return l.webURI("https")
+}
+
+// linkURI returns the page to open to unsubscribe.
+func (l List) linkURI() string {
+	return l.webURI("https", "http")
+}
+
+func (l List) webURI(schemes ...string) string {
+	for _, uri := range l.Unsubscribe {
+		u, err := url.Parse(uri)
+		if err == nil && slices.Contains(schemes, u.Scheme) && u.Host != "" {
+			return uri
+		}
+	}
+
+	return ""
+}
+
+func (l List) mailtoURI() string {
+	for _, uri := range l.Unsubscribe {
+		if len(uri) > len("mailto:") && strings.EqualFold(uri[:len("mailto:")], "mailto:") {
+			return uri
+		}
+	}
+
+	return ""
+}
+
+// Unsubscription returns how l is unsubscribed from, preferring the
+// one-click POST. Lists that only have a link to open in a browser cannot
+// be unsubscribed from here.
+func (l List) Unsubscription() (Unsubscription, error) {
+	if uri := l.postURI(); l.OneClick && uri != "" {
+		return Unsubscription{List: l.ID, Method: UnsubscribePost, Target: uri}, nil
+	}
+	if uri := l.mailtoURI(); uri != "" {
+		return Unsubscription{List: l.ID, Method: UnsubscribeMail, Target: uri}, nil
+	}
+	if uri := l.linkURI(); uri != "" {
+		return Unsubscription{}, fmt.Errorf("%s has no one-click unsubscribe, open %s", l.ID, uri)
+	}
+
+	return Unsubscription{}, fmt.Errorf("%s has no List-Unsubscribe", l.ID)
+}
+
+// Unsubscribe unsubscribes from l as told by its Unsubscription.
+func (e *Core) Unsubscribe(ctx context.Context, l List) (Unsubscription, error) {
+	u, err := l.Unsubscription()
+	if err != nil {
+		return u, err
+	}
+	e.log.Debug("unsubscribing", "list", l.ID, "method", u.Method, "target", u.Target)
+
+	switch u.Method {
+	case UnsubscribePost:
+		err = e.postUnsubscribe(ctx, u.Target)
+	case UnsubscribeMail:
+		err = e.mailUnsubscribe(ctx, u.Target)
+	}
+
+	return u, err
+}
+
+// postUnsubscribe sends the one-click POST of RFC 8058, without cookies or
+// credentials.
+func (e *Core) postUnsubscribe(ctx context.Context, uri string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unsubscribe failed with status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// mailUnsubscribe sends the email of a mailto URI, RFC 6068, with the SMTP
+// server of the account.
+func (e *Core) mailUnsubscribe(ctx context.Context, uri string) error {
+	conf := e.conf.SMTP
+	if conf == nil {
+		return fmt.Errorf("%s asks for an email, set smtp for the account to send it", uri)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid mailto uri %q: %w", uri, err)
+	}
+	to, err := url.PathUnescape(u.Opaque)
+	// only the first of several addresses is written to
+	to, _, _ = strings.Cut(to, ",")
+	if err != nil || to == "" {
+		return fmt.Errorf("invalid mailto uri %q", uri)
+	}
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid mailto uri %q: %w", uri, err)
+	}
+	q := u.Query()
+	// the header fields of the uri could add others with a line break
+	subject := cmp.Or(q.Get("subject"), "unsubscribe")
+	if strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid mailto uri %q: line break in the subject", uri)
+	}
+
+	username := cmp.Or(conf.Username, e.conf.Username)
+	password := cmp.Or(conf.Password, e.conf.Password)
+	fromAddr, err := mail.ParseAddress(cmp.Or(conf.From, username))
+	if err != nil {
+		return fmt.Errorf("invalid smtp from address: %w", err)
+	}
+
+	var h mail.Header
+	h.SetAddressList("From", []*mail.Address{fromAddr})
+	h.SetAddressList("To", []*mail.Address{toAddr})
+	h.SetSubject(subject)
+	h.SetDate(time.Now())
+	h.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	var msg bytes.Buffer
+	body, err := mail.CreateSingleInlineWriter(&msg, h)
+	if err == nil {
+		_, err = io.WriteString(body, cmp.Or(q.Get("body"), "unsubscribe"))
+	}
+	if err == nil {
+		err = body.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write unsubscribe email: %w", err)
+	}
+
+	addr := net.JoinHostPort(conf.Host, conf.Port)
+	var d net.Dialer
+	var conn net.Conn
+	// 465 is SMTP over TLS, other ports upgrade with STARTTLS
+	if conf.Port == "465" {
+		conn, err = (&tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: conf.Host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, conf.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: conf.Host})
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrNetwork, err)
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok && password != "" {
+		err = c.Auth(smtp.PlainAuth("", username, password, conf.Host))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrAuth, err)
+		}
+	}
+
+	err = c.Mail(fromAddr.Address)
+	if err == nil {
+		err = c.Rcpt(toAddr.Address)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send unsubscribe email: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send unsubscribe email: %w", err)
+	}
+	_, err = w.Write(msg.Bytes())
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send unsubscribe email: %w", err)
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,276 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+)
+
+func TestUnsubscription(t *testing.T) {
+	tests := []struct {
+		name   string
+		list   List
+		method string
+		target string
+		err    string
+	}{
+		{
+			name:   "one-click",
+			list:   List{ID: "news.example.com", OneClick: true, Unsubscribe: []string{"mailto:u@example.com", "https://example.com/u?id=1"}},
+			method: UnsubscribePost,
+			target: "https://example.com/u?id=1",
+		},
+		{
+			name:   "one-click over http",
+			list:   List{ID: "news.example.com", OneClick: true, Unsubscribe: []string{"http://example.com/u?id=1", "mailto:u@example.com"}},
+			method: UnsubscribeMail,
+			target: "mailto:u@example.com",
+		},
+		{
+			name:   "mailto",
+			list:   List{ID: "news.example.com", Unsubscribe: []string{"https://example.com/u", "MAILTO:u@example.com?subject=stop"}},
+			method: UnsubscribeMail,
+			target: "MAILTO:u@example.com?subject=stop",
+		},
+		{
+			name: "http link",
+			list: List{ID: "news.example.com", OneClick: true, Unsubscribe: []string{"http://example.com/u"}},
+			err:  "news.example.com has no one-click unsubscribe, open http://example.com/u",
+		},
+		{
+			name: "none",
+			list: List{ID: "news.example.com"},
+			err:  "news.example.com has no List-Unsubscribe",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := tt.list.Unsubscription()
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if u.Method != tt.method || u.Target != tt.target {
+				t.Errorf("expected %s %s, got %s %s", tt.method, tt.target, u.Method, u.Target)
+			}
+		})
+	}
+}
+
+func TestPostUnsubscribe(t *testing.T) {
+	var posts atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.Method != http.MethodPost:
+			t.Errorf("expected a POST, got %s", r.Method)
+		case string(body) != "List-Unsubscribe=One-Click":
+			t.Errorf("unexpected body %q", body)
+		case r.Header.Get("Content-Type") != "application/x-www-form-urlencoded":
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		case r.Header.Get("Cookie") != "" || r.Header.Get("Authorization") != "":
+			t.Error("expected no cookies or credentials")
+		}
+		if r.URL.Query().Get("id") == "gone" {
+			http.Error(w, "unknown subscriber", http.StatusNotFound)
+		}
+	})
+
+	srv := httptest.NewTLSServer(handler)
+	defer srv.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	e := testCore(t)
+	e.httpClient = srv.Client()
+	ctx := context.Background()
+
+	u, err := e.Unsubscribe(ctx, List{ID: "news.example.com", OneClick: true, Unsubscribe: []string{srv.URL + "/u?id=1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.Method != UnsubscribePost || posts.Load() != 1 {
+		t.Errorf("expected a one-click POST, got %s and %d requests", u.Method, posts.Load())
+	}
+
+	_, err = e.Unsubscribe(ctx, List{ID: "news.example.com", OneClick: true, Unsubscribe: []string{srv.URL + "/u?id=gone"}})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected the status of the failed POST, got %v", err)
+	}
+
+	// the one-click POST is not sent in plain text
+	posts.Store(0)
+	_, err = e.Unsubscribe(ctx, List{ID: "news.example.com", OneClick: true, Unsubscribe: []string{plain.URL + "/u?id=1"}})
+	if err == nil || posts.Load() != 0 {
+		t.Errorf("expected no POST over http, got %v and %d requests", err, posts.Load())
+	}
+}
+
+// fakeSMTP accepts one email and sends what it got, the addresses of MAIL
+// and RCPT followed by the data, on the returned channel.
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	got := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+		reply("220 localhost ESMTP")
+
+		var sb strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				reply("250-localhost")
+				reply("250 HELP")
+			case "MAIL", "RCPT":
+				sb.WriteString(arg + "\n")
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					sb.WriteString(line)
+				}
+				reply("250 OK")
+			case "QUIT":
+				reply("221 bye")
+				got <- sb.String()
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	return port, got
+}
+
+func TestMailUnsubscribe(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		to      string
+		subject string
+		body    string
+		err     string
+	}{
+		{
+			name:    "default",
+			uri:     "mailto:leave@example.com",
+			to:      "leave@example.com",
+			subject: "unsubscribe",
+			body:    "unsubscribe",
+		},
+		{
+			name:    "fields",
+			uri:     "mailto:leave%2Bnews@example.com,other@example.com?subject=d%C3%A9sabonner%20moi&body=stop%0D%0Aplease",
+			to:      "leave+news@example.com",
+			subject: "désabonner moi",
+			body:    "stop\r\nplease",
+		},
+		{
+			name: "header in the subject",
+			uri:  "mailto:leave@example.com?subject=unsubscribe%0D%0ABcc:%20victim@example.com",
+			err:  "line break in the subject",
+		},
+		{
+			name: "header in the address",
+			uri:  "mailto:leave@example.com%0D%0ABcc:%20victim@example.com",
+			err:  "invalid mailto uri",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, got := fakeSMTP(t)
+			e := testCore(t)
+			e.conf.SMTP = &SMTPConf{Host: "127.0.0.1", Port: port, From: "Me <me@example.com>"}
+
+			err := e.mailUnsubscribe(context.Background(), tt.uri)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			envelope, data, _ := strings.Cut(<-got, "\n"+"TO:")
+			if envelope != "FROM:<me@example.com>" {
+				t.Errorf("unexpected sender %q", envelope)
+			}
+			rcpt, data, _ := strings.Cut(data, "\n")
+			if rcpt != "<"+tt.to+">" {
+				t.Errorf("expected recipient %q, got %q", tt.to, rcpt)
+			}
+
+			r, err := mail.CreateReader(strings.NewReader(data))
+			if err != nil {
+				t.Fatalf("failed to parse the email: %v", err)
+			}
+			if bcc := r.Header.Get("Bcc"); bcc != "" {
+				t.Errorf("unexpected Bcc %q", bcc)
+			}
+			to, _ := r.Header.AddressList("To")
+			if len(to) != 1 || to[0].Address != tt.to {
+				t.Errorf("expected To %q, got %v", tt.to, to)
+			}
+			subject, _ := r.Header.Subject()
+			if subject != tt.subject {
+				t.Errorf("expected subject %q, got %q", tt.subject, subject)
+			}
+			p, err := r.NextPart()
+			if err != nil {
+				t.Fatalf("failed to read the body: %v", err)
+			}
+			// DATA ends the last line
+			body, _ := io.ReadAll(p.Body)
+			if strings.TrimSuffix(string(body), "\r\n") != tt.body {
+				t.Errorf("expected body %q, got %q", tt.body, body)
+			}
+		})
+	}
+}
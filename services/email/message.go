@@ -0,0 +1,126 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Message is an email as returned by searches and reads, Body and Events
+// are only set by Read.
+type Message struct {
+	UID     uint32    `json:"uid" yaml:"uid"`
+	Seq     uint32    `json:"seq" yaml:"seq"`
+	From    []string  `json:"from" yaml:"from"`
+	To      []string  `json:"to" yaml:"to"`
+	Subject string    `json:"subject" yaml:"subject"`
+	Date    time.Time `json:"date" yaml:"date"`
+	Flags   []string  `json:"flags" yaml:"flags"`
+	Size    int64     `json:"size" yaml:"size"`
+	Body    string    `json:"body,omitempty" yaml:"body,omitempty"`
+	// Events are the ones of the iCalendar parts, the invitations
+	Events []Event `json:"events,omitempty" yaml:"events,omitempty"`
+	// MessageID is without angle brackets, as are references
+	MessageID string `json:"message_id,omitempty" yaml:"message_id,omitempty"`
+	// Labels and Thread are only set by the searches of Gmail
+	Labels []string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Thread string   `json:"thread,omitempty" yaml:"thread,omitempty"`
+
+	// references are the parents of the message, oldest first, from the
+	// References and In-Reply-To headers
+	references []string
+}
+
+func newMessage(buf *imapclient.FetchMessageBuffer) Message {
+	m := Message{
+		UID:  uint32(buf.UID),
+		Seq:  buf.SeqNum,
+		Size: buf.RFC822Size,
+	}
+	m.setEnvelope(buf.Envelope)
+	m.setFlags(buf.Flags)
+	for _, header := range buf.BodySection {
+		m.setReferences(header)
+	}
+
+	return m
+}
+
+func (m *Message) setEnvelope(env *imap.Envelope) {
+	if env == nil {
+		return
+	}
+
+	m.Subject = env.Subject
+	m.Date = env.Date
+	m.From = addresses(env.From)
+	m.To = addresses(env.To)
+	m.MessageID = msgID(env.MessageID)
+	for _, id := range env.InReplyTo {
+		m.addReference(msgID(id))
+	}
+}
+
+// setReferences reads the References header of a header section, the
+// In-Reply-To one is in the envelope.
+func (m *Message) setReferences(raw []byte) {
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return
+	}
+	header := mail.Header{Header: message.Header{Header: h}}
+	refs, err := header.MsgIDList("References")
+	if err != nil || len(refs) == 0 {
+		return
+	}
+
+	// In-Reply-To, if set, is the last of the references
+	parents := m.references
+	m.references = nil
+	for _, id := range refs {
+		m.addReference(id)
+	}
+	for _, id := range parents {
+		m.addReference(id)
+	}
+}
+
+func (m *Message) addReference(id string) {
+	if id != "" && id != m.MessageID && (len(m.references) == 0 || m.references[len(m.references)-1] != id) {
+		m.references = append(m.references, id)
+	}
+}
+
+func msgID(id string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">")
+}
+
+func (m *Message) setFlags(flags []imap.Flag) {
+	m.Flags = make([]string, len(flags))
+	for i, f := range flags {
+		m.Flags[i] = string(f)
+	}
+}
+
+func addresses(addrs []imap.Address) []string {
+	res := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		addr := a.Addr()
+		if addr == "" {
+			continue
+		}
+		if a.Name != "" {
+			addr = a.Name + " <" + addr + ">"
+		}
+		res = append(res, addr)
+	}
+
+	return res
+}
@@ -0,0 +1,252 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/emersion/go-sasl"
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"golang.org/x/oauth2"
+)
+
+const (
+	AuthLogin       = "login"
+	AuthXOAuth2     = "xoauth2"
+	AuthOAuthBearer = "oauthbearer"
+)
+
+var (
+	ErrNoToken = errors.New("no oauth2 token, run `wmb auth login`")
+)
+
+// OAuthConf describes the OAuth2 client used to obtain IMAP/SMTP access
+// tokens. Provider fills in the endpoints and scopes of well known
+// providers, any explicitly set field takes precedence.
+type OAuthConf struct {
+	Provider      string   `json:"provider" yaml:"provider"`
+	ClientID      string   `json:"client_id" yaml:"client_id"`
+	ClientSecret  string   `json:"client_secret" yaml:"client_secret"`
+	AuthURL       string   `json:"auth_url" yaml:"auth_url"`
+	TokenURL      string   `json:"token_url" yaml:"token_url"`
+	DeviceAuthURL string   `json:"device_auth_url" yaml:"device_auth_url"`
+	Scopes        []string `json:"scopes" yaml:"scopes"`
+}
+
+var providers = map[string]OAuthConf{
+	"google": {
+		AuthURL:       "https://accounts.google.com/o/oauth2/auth",
+		TokenURL:      "https://oauth2.googleapis.com/token",
+		DeviceAuthURL: "https://oauth2.googleapis.com/device/code",
+		Scopes:        []string{"https://mail.google.com/"},
+	},
+	"microsoft": {
+		AuthURL:       "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+		TokenURL:      "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		DeviceAuthURL: "https://login.microsoftonline.com/common/oauth2/v2.0/devicecode",
+		Scopes: []string{
+			"https://outlook.office.com/IMAP.AccessAsUser.All",
+			"https://outlook.office.com/SMTP.Send",
+			"offline_access",
+		},
+	},
+}
+
+// Config returns the oauth2 config for the account, redirectURL is only
+// used by the loopback flow and may be empty.
+func (o *OAuthConf) Config(redirectURL string) (*oauth2.Config, error) {
+	c := *o
+	if c.Provider != "" {
+		p, ok := providers[c.Provider]
+		if !ok {
+			return nil, fmt.Errorf("unknown oauth2 provider %q", c.Provider)
+		}
+		if c.AuthURL == "" {
+			c.AuthURL = p.AuthURL
+		}
+		if c.TokenURL == "" {
+			c.TokenURL = p.TokenURL
+		}
+		if c.DeviceAuthURL == "" {
+			c.DeviceAuthURL = p.DeviceAuthURL
+		}
+		if len(c.Scopes) == 0 {
+			c.Scopes = p.Scopes
+		}
+	}
+
+	if c.ClientID == "" || c.TokenURL == "" {
+		return nil, errors.New("oauth2 client_id and token_url are required")
+	}
+
+	return &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:       c.AuthURL,
+			TokenURL:      c.TokenURL,
+			DeviceAuthURL: c.DeviceAuthURL,
+		},
+		RedirectURL: redirectURL,
+		Scopes:      c.Scopes,
+	}, nil
+}
+
+// TokenStore persists secrets, it is satisfied by secret.Store.
+type TokenStore interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val []byte) error
+}
+
+func TokenKey(account string) string {
+	return "oauth2/" + account
+}
+
+func LoadToken(store TokenStore, account string) (*oauth2.Token, error) {
+	data, err := store.Get(TokenKey(account))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoToken, err)
+	}
+
+	tok := &oauth2.Token{}
+	err = json.Unmarshal(data, tok)
+	if err != nil {
+		return nil, fmt.Errorf("failed to LoadToken json.Unmarshal: %w", err)
+	}
+
+	return tok, nil
+}
+
+func SaveToken(store TokenStore, account string, tok *oauth2.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("failed to SaveToken json.Marshal: %w", err)
+	}
+
+	return store.Set(TokenKey(account), data)
+}
+
+// OAuthContext returns a context carrying the http client used for all
+// token requests.
+func OAuthContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, cleanhttp.DefaultClient())
+}
+
+// storedTokenSource refreshes tokens on demand and writes every new token
+// back to the store, so a refresh done by the daemon survives restarts.
+type storedTokenSource struct {
+	account string
+	store   TokenStore
+	src     oauth2.TokenSource
+
+	mu   sync.Mutex
+	last string
+}
+
+func newTokenSource(conf Conf) (oauth2.TokenSource, error) {
+	if conf.OAuth == nil {
+		return nil, fmt.Errorf("%s auth requires an oauth section", conf.Auth)
+	}
+	if conf.Tokens == nil {
+		return nil, ErrNoToken
+	}
+
+	cfg, err := conf.OAuth.Config("")
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := LoadToken(conf.Tokens, conf.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storedTokenSource{
+		account: conf.Name,
+		store:   conf.Tokens,
+		src:     cfg.TokenSource(OAuthContext(context.Background()), tok),
+		last:    tok.AccessToken,
+	}, nil
+}
+
+func (s *storedTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.AccessToken != s.last {
+		err = SaveToken(s.store, s.account, tok)
+		if err != nil {
+			return nil, err
+		}
+		s.last = tok.AccessToken
+	}
+
+	return tok, nil
+}
+
+// SASL returns the SASL client matching the configured auth mechanism, it
+// can be used for both IMAP AUTHENTICATE and SMTP AUTH.
+func (e *Core) SASL() (sasl.Client, error) {
+	switch e.conf.Auth {
+	case AuthXOAuth2, AuthOAuthBearer:
+	default:
+		return sasl.NewPlainClient("", e.conf.Username, e.conf.Password), nil
+	}
+
+	if e.tokens == nil {
+		return nil, ErrNoToken
+	}
+
+	tok, err := e.tokens.Token()
+	if err != nil {
+		// the token endpoint answered, so the grant itself was rejected
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			return nil, fmt.Errorf("%w: failed to refresh oauth2 token: %w", ErrAuth, err)
+		}
+		return nil, fmt.Errorf("%w: failed to refresh oauth2 token: %w", ErrNetwork, err)
+	}
+
+	if e.conf.Auth == AuthOAuthBearer {
+		// RFC 7628 has the client send the host and port it connected to
+		port, _ := strconv.Atoi(e.conf.Port)
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: e.conf.Username,
+			Token:    tok.AccessToken,
+			Host:     e.conf.Host,
+			Port:     port,
+		}), nil
+	}
+
+	return NewXOAuth2Client(e.conf.Username, tok.AccessToken), nil
+}
+
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+// NewXOAuth2Client implements the XOAUTH2 mechanism used by Gmail and
+// Microsoft 365.
+func NewXOAuth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	ir := []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+// Next answers the error challenge with an empty response, the server
+// then fails the command with the actual status.
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
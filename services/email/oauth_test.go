@@ -0,0 +1,271 @@
+package email
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+	"golang.org/x/oauth2"
+)
+
+// memStore is an in memory TokenStore.
+type memStore map[string][]byte
+
+func (m memStore) Get(key string) ([]byte, error) {
+	val, ok := m[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+	return val, nil
+}
+
+func (m memStore) Set(key string, val []byte) error {
+	m[key] = val
+	return nil
+}
+
+// tokenEndpoint refreshes r1 into the fresh access token and r2, every
+// request is counted.
+func tokenEndpoint(t *testing.T, refreshes *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes.Add(1)
+		if r.PostFormValue("grant_type") != "refresh_token" || r.PostFormValue("refresh_token") != "r1" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "fresh",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"refresh_token": "r2",
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// staleStore holds an expired token for account, refreshed with r1.
+func staleStore(t *testing.T, account string) memStore {
+	t.Helper()
+
+	store := memStore{}
+	err := SaveToken(store, account, &oauth2.Token{
+		AccessToken:  "stale",
+		TokenType:    "Bearer",
+		RefreshToken: "r1",
+		Expiry:       time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+// fakeAuthIMAP announces SASL-IR and accepts any AUTHENTICATE, the
+// decoded initial responses are sent on the returned channel.
+func fakeAuthIMAP(t *testing.T) (net.Conn, <-chan string) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	got := make(chan string, 4)
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+
+	go func() {
+		defer close(done)
+		defer server.Close()
+
+		const caps = "IMAP4rev1 SASL-IR AUTH=XOAUTH2 AUTH=OAUTHBEARER"
+		io.WriteString(server, "* OK [CAPABILITY "+caps+"] ready\r\n")
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			// the capabilities are asked again after authenticating
+			if len(fields) == 2 && fields[1] == "CAPABILITY" {
+				io.WriteString(server, "* CAPABILITY "+caps+"\r\n"+fields[0]+" OK done\r\n")
+				continue
+			}
+			if len(fields) != 4 || fields[1] != "AUTHENTICATE" {
+				io.WriteString(server, fields[0]+" BAD unexpected command\r\n")
+				continue
+			}
+			ir, err := base64.StdEncoding.DecodeString(fields[3])
+			if err != nil {
+				t.Errorf("invalid initial response %q: %v", fields[3], err)
+			}
+			got <- fields[2] + " " + string(ir)
+			io.WriteString(server, fields[0]+" OK Success\r\n")
+		}
+	}()
+
+	return client, got
+}
+
+func TestOAuthConfig(t *testing.T) {
+	cfg, err := (&OAuthConf{Provider: "google", ClientID: "id", TokenURL: "https://example.com/token"}).Config("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Endpoint.TokenURL != "https://example.com/token" {
+		t.Errorf("expected the explicit token_url, got %q", cfg.Endpoint.TokenURL)
+	}
+	if cfg.Endpoint.DeviceAuthURL != providers["google"].DeviceAuthURL || len(cfg.Scopes) != 1 {
+		t.Errorf("expected the provider defaults, got %+v", cfg)
+	}
+
+	_, err = (&OAuthConf{Provider: "yahoo", ClientID: "id"}).Config("")
+	if err == nil {
+		t.Error("expected an unknown provider to fail")
+	}
+	_, err = (&OAuthConf{Provider: "google"}).Config("")
+	if err == nil {
+		t.Error("expected a missing client_id to fail")
+	}
+}
+
+func TestOAuthAuthenticate(t *testing.T) {
+	tests := []struct {
+		auth string
+		ir   string
+	}{
+		{
+			auth: AuthXOAuth2,
+			ir:   "XOAUTH2 user=me@example.com\x01auth=Bearer fresh\x01\x01",
+		},
+		{
+			auth: AuthOAuthBearer,
+			ir:   "OAUTHBEARER n,a=me@example.com,\x01host=imap.example.com\x01port=993\x01auth=Bearer fresh\x01\x01",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.auth, func(t *testing.T) {
+			var refreshes atomic.Int32
+			srv := tokenEndpoint(t, &refreshes)
+			store := staleStore(t, "me")
+
+			e, err := newCore(Conf{
+				Name:     "me",
+				Host:     "imap.example.com",
+				Port:     "993",
+				Username: "me@example.com",
+				Auth:     tt.auth,
+				OAuth:    &OAuthConf{ClientID: "id", TokenURL: srv.URL},
+				Tokens:   store,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, got := fakeAuthIMAP(t)
+			e.client = imapclient.New(conn, nil)
+
+			// the expired token is refreshed before authenticating
+			err = e.authenticate()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ir := <-got; ir != tt.ir {
+				t.Errorf("expected %q, got %q", tt.ir, ir)
+			}
+
+			// and written back, so the refresh survives a restart
+			tok, err := LoadToken(store, "me")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.AccessToken != "fresh" || tok.RefreshToken != "r2" {
+				t.Errorf("expected the refreshed token to be stored, got %q and %q", tok.AccessToken, tok.RefreshToken)
+			}
+
+			// a valid token is reused
+			err = e.authenticate()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ir := <-got; ir != tt.ir {
+				t.Errorf("expected %q, got %q", tt.ir, ir)
+			}
+			if refreshes.Load() != 1 {
+				t.Errorf("expected a single refresh, got %d", refreshes.Load())
+			}
+		})
+	}
+}
+
+func TestOAuthRefreshFailure(t *testing.T) {
+	var refreshes atomic.Int32
+	srv := tokenEndpoint(t, &refreshes)
+
+	newConf := func(store memStore, tokenURL string) Conf {
+		return Conf{
+			Name:     "me",
+			Username: "me@example.com",
+			Auth:     AuthXOAuth2,
+			OAuth:    &OAuthConf{ClientID: "id", TokenURL: tokenURL},
+			Tokens:   store,
+		}
+	}
+
+	// a revoked grant is an authentication failure
+	store := memStore{}
+	err := SaveToken(store, "me", &oauth2.Token{AccessToken: "stale", RefreshToken: "revoked", Expiry: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newCore(newConf(store, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.SASL()
+	if !errors.Is(err, ErrAuth) {
+		t.Errorf("expected %v, got %v", ErrAuth, err)
+	}
+	tok, _ := LoadToken(store, "me")
+	if tok == nil || tok.RefreshToken != "revoked" {
+		t.Errorf("expected the stored token to be kept, got %v", tok)
+	}
+
+	// an unreachable endpoint is a network failure
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	e, err = newCore(newConf(staleStore(t, "me"), down.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.SASL()
+	if !errors.Is(err, ErrNetwork) {
+		t.Errorf("expected %v, got %v", ErrNetwork, err)
+	}
+
+	// without a stored token there is nothing to refresh
+	_, err = newCore(newConf(memStore{}, srv.URL))
+	if !errors.Is(err, ErrNoToken) {
+		t.Errorf("expected %v, got %v", ErrNoToken, err)
+	}
+}
@@ -0,0 +1,217 @@
+package email
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// OTPScan is how many of the newest matching emails OTPs looks at when it
+// does not go on from a previous call.
+const OTPScan = 10
+
+// OTPPattern finds codes and links in the emails of the senders matching
+// From, a case-insensitive substring that matches every sender when empty.
+// Code and Link are regular expressions whose first group, or whole match
+// without one, is the code or link.
+type OTPPattern struct {
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
+	Code string `json:"code,omitempty" yaml:"code,omitempty"`
+	Link string `json:"link,omitempty" yaml:"link,omitempty"`
+}
+
+// defaultOTPPatterns are tried after the configured ones.
+var defaultOTPPatterns = []OTPPattern{
+	{Code: `(?i)(?:code|passcode|password|pin|otp)\W{0,5}(?:is\W{0,3})?\b(\d{4,8}|\d{3}[- ]\d{3})\b`},
+	{Code: `(?i)\b(\d{4,8})\b is your\b`},
+	{Code: `(?m)^\s*(\d{4,8})\s*$`},
+	{Link: `(?i)https?://[^\s<>"')\]]*(?:verify|verification|confirm|magic|login|signin|sign-in|auth|token|activate)[^\s<>"')\]]*`},
+}
+
+// OTP is a one-time passcode or a verification link found in an email.
+type OTP struct {
+	UID     uint32    `json:"uid" yaml:"uid"`
+	From    []string  `json:"from" yaml:"from"`
+	Subject string    `json:"subject" yaml:"subject"`
+	Date    time.Time `json:"date" yaml:"date"`
+	Code    string    `json:"code,omitempty" yaml:"code,omitempty"`
+	Link    string    `json:"link,omitempty" yaml:"link,omitempty"`
+}
+
+// Value is the code, or the link when there is none.
+func (o OTP) Value() string {
+	if o.Code != "" {
+		return o.Code
+	}
+
+	return o.Link
+}
+
+// Extractor finds the OTP of emails with its patterns.
+type Extractor struct {
+	patterns []compiledOTPPattern
+}
+
+type compiledOTPPattern struct {
+	from string
+	code *regexp.Regexp
+	link *regexp.Regexp
+}
+
+// NewExtractor compiles patterns, followed by the default ones for common
+// wordings of codes and links.
+func NewExtractor(patterns []OTPPattern) (*Extractor, error) {
+	x := &Extractor{}
+	for i, p := range slices.Concat(patterns, defaultOTPPatterns) {
+		c := compiledOTPPattern{from: strings.ToLower(p.From)}
+		var err error
+		if p.Code != "" {
+			c.code, err = regexp.Compile(p.Code)
+			if err != nil {
+				return nil, fmt.Errorf("invalid code pattern %d: %w", i, err)
+			}
+		}
+		if p.Link != "" {
+			c.link, err = regexp.Compile(p.Link)
+			if err != nil {
+				return nil, fmt.Errorf("invalid link pattern %d: %w", i, err)
+			}
+		}
+		x.patterns = append(x.patterns, c)
+	}
+
+	return x, nil
+}
+
+// Extract returns the first code and link the patterns of the sender of m
+// find in its subject and body.
+func (x *Extractor) Extract(m Message) (OTP, bool) {
+	from := strings.ToLower(strings.Join(m.From, " "))
+	text := m.Subject + "\n" + m.Body
+
+	o := OTP{UID: m.UID, From: m.From, Subject: m.Subject, Date: m.Date}
+	for _, p := range x.patterns {
+		if !strings.Contains(from, p.from) {
+			continue
+		}
+		if o.Code == "" && p.code != nil {
+			o.Code = submatch(p.code, text)
+		}
+		if o.Link == "" && p.link != nil {
+			o.Link = strings.TrimRight(submatch(p.link, text), ".,;:!?")
+		}
+	}
+
+	return o, o.Value() != ""
+}
+
+func submatch(re *regexp.Regexp, text string) string {
+	m := re.FindStringSubmatch(text)
+	switch {
+	case m == nil:
+		return ""
+	case len(m) > 1:
+		return m[1]
+	default:
+		return m[0]
+	}
+}
+
+// OTPs returns the codes and links of the emails matching query with a UID
+// above after, newest first, or of the last OTPScan ones when after is 0.
+// The UID returned is the highest of the mailbox, the one to go on after
+// to only look at new emails.
+func (e *Core) OTPs(ctx context.Context, query Query, after uint32) (_ []OTP, _ uint32, err error) {
+	e.log.Debug("looking for otp", "query", query, "after", after)
+
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	last, err := client.UIDSearch(&imap.SearchCriteria{UID: []imap.UIDSet{imap.UIDSetNum(0)}}, nil).Wait()
+	e.observe("SEARCH", err)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+	highest := after
+	for _, uid := range last.AllUIDs() {
+		highest = max(highest, uint32(uid))
+	}
+	// nothing came in, which is most polls of otp --wait
+	if after > 0 && highest == after {
+		return nil, highest, nil
+	}
+
+	uids, err := e.uidsAfter(client, query.criteria(), after)
+	if err != nil {
+		return nil, 0, err
+	}
+	if after == 0 && len(uids) > OTPScan {
+		uids = uids[len(uids)-OTPScan:]
+	}
+	if len(uids) == 0 {
+		return nil, highest, nil
+	}
+
+	msgs, err := e.fetchBodies(client, imap.UIDSetNum(uids...))
+	if err != nil {
+		return nil, 0, err
+	}
+	slices.SortFunc(msgs, func(a, b Message) int {
+		return cmp.Compare(b.UID, a.UID)
+	})
+
+	var otps []OTP
+	for _, m := range msgs {
+		if o, ok := e.otp.Extract(m); ok {
+			otps = append(otps, o)
+		}
+	}
+
+	return otps, highest, nil
+}
+
+// fetchBodies fetches the envelope and the text body of set.
+func (e *Core) fetchBodies(client *imapclient.Client, set imap.NumSet) ([]Message, error) {
+	bufs, err := client.Fetch(set, &imap.FetchOptions{
+		Envelope:    true,
+		UID:         true,
+		Flags:       true,
+		RFC822Size:  true,
+		BodySection: []*imap.FetchItemBodySection{{Peek: true}},
+	}).Collect()
+	e.observe("FETCH", err)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+
+	msgs := make([]Message, 0, len(bufs))
+	for _, buf := range bufs {
+		m := newMessage(buf)
+		for _, raw := range buf.BodySection {
+			m.Body, m.Events, err = e.parseBody(bytes.NewReader(raw))
+			if err != nil {
+				e.log.Warn("failed to parse email body", "uid", m.UID, "error", err)
+			}
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
@@ -0,0 +1,174 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxConnections bounds the connections of an account, Conf.Connections
+// and the ones dialed for the X-GM-* commands of Gmail. Servers commonly
+// limit them to about ten.
+const MaxConnections = 5
+
+// reclaimDelay is how often a command waiting for a connection of the
+// budget looks for an idle one to close.
+const reclaimDelay = 100 * time.Millisecond
+
+// Pool spreads the leases of one account over Conf.Connections supervised
+// connections, so a slow command does not hold up the others.
+type Pool struct {
+	cores []*Core
+}
+
+// NewPool opens the connections of conf in the background, it only fails on
+// configuration errors.
+func NewPool(conf Conf) (*Pool, error) {
+	n := max(conf.Connections, 1)
+	if n > MaxConnections {
+		return nil, fmt.Errorf("%d connections requested, at most %d are allowed", n, MaxConnections)
+	}
+
+	p := &Pool{}
+	b := &connBudget{slots: make(chan struct{}, MaxConnections)}
+	for range n {
+		e, err := NewSupervised(conf)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		b.slots <- struct{}{}
+		e.budget = b
+		p.cores = append(p.cores, e)
+	}
+	b.cores = p.cores
+
+	return p, nil
+}
+
+// Lease picks the connection that can run the commands soonest: an idle
+// one with mailbox already selected, then any idle one, and otherwise the
+// least busy one. See Core.Lease.
+func (p *Pool) Lease(ctx context.Context, mailbox string, access Access) (*Core, context.Context, func(), error) {
+	e := p.pick(mailbox)
+	ctx, release, err := e.Lease(ctx, mailbox, access)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return e, ctx, release, nil
+}
+
+func (p *Pool) pick(mailbox string) *Core {
+	if mailbox == "" {
+		mailbox = p.cores[0].home()
+	}
+
+	var idle, least *Core
+	leastLoad := 0
+	for _, e := range p.cores {
+		load := e.sched.load()
+		if load == 0 {
+			if e.sched.current() == mailbox {
+				return e
+			}
+			if idle == nil {
+				idle = e
+			}
+		}
+		if least == nil || load < leastLoad {
+			least, leastLoad = e, load
+		}
+	}
+	if idle != nil {
+		return idle
+	}
+
+	return least
+}
+
+// OnMove sets f on every connection, see Core.OnMove.
+func (p *Pool) OnMove(f func(Moved)) {
+	for _, e := range p.cores {
+		e.OnMove(f)
+	}
+}
+
+// Status returns the status of the first connection, the others share its
+// configuration and fail the same way.
+func (p *Pool) Status() Status {
+	return p.cores[0].Status()
+}
+
+func (p *Pool) Close() error {
+	var errs []error
+	for _, e := range p.cores {
+		errs = append(errs, e.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// connBudget counts the connections of a pool against MaxConnections: one
+// for each core, and the Gmail ones its cores dial on demand. A nil budget,
+// the one of a core outside a pool, is unbounded.
+type connBudget struct {
+	slots chan struct{}
+	cores []*Core
+}
+
+// take reserves a connection for e, closing the idle Gmail connection of
+// another core when the budget is spent.
+func (b *connBudget) take(ctx context.Context, e *Core) error {
+	if b == nil {
+		return nil
+	}
+	if cap(b.slots) == len(b.cores) {
+		return fmt.Errorf("%w: the %d connections of the account leave none for the Gmail commands, configure fewer", ErrClientError, len(b.cores))
+	}
+
+	for {
+		select {
+		case b.slots <- struct{}{}:
+			return nil
+		default:
+		}
+		if b.reclaim(e) {
+			continue
+		}
+
+		select {
+		case b.slots <- struct{}{}:
+			return nil
+		case <-time.After(reclaimDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reclaim closes the Gmail connection of a core other than e that is not
+// running a command.
+func (b *connBudget) reclaim(e *Core) bool {
+	for _, o := range b.cores {
+		if o == e || !o.gmailMu.TryLock() {
+			continue
+		}
+		open := o.gmailConn != nil
+		o.closeGmail()
+		o.gmailMu.Unlock()
+		if open {
+			return true
+		}
+	}
+
+	return false
+}
+
+// put gives back a connection reserved by take.
+func (b *connBudget) put() {
+	if b != nil {
+		<-b.slots
+	}
+}
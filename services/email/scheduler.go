@@ -0,0 +1,254 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Access is how a command depends on the selected mailbox of a connection.
+type Access int
+
+const (
+	// Independent commands, such as NOOP, work whatever mailbox is selected.
+	Independent Access = iota
+	// Shared commands depend on the selected mailbox but keep its sequence
+	// numbers, SEARCH, FETCH and STORE are pipelined with each other.
+	Shared
+	// Exclusive commands change the selected mailbox or its sequence
+	// numbers, such as SELECT or MOVE, and run alone.
+	Exclusive
+)
+
+func (a Access) String() string {
+	switch a {
+	case Independent:
+		return "independent"
+	case Shared:
+		return "shared"
+	default:
+		return "exclusive"
+	}
+}
+
+// scheduler orders the commands sent over one connection. Waiting commands
+// are started in arrival order, as many at a time as their access allows.
+type scheduler struct {
+	mu sync.Mutex
+	// mailbox is the one the connection has, or is about to have, selected
+	mailbox   string
+	running   int
+	exclusive bool
+	// interrupted holds off new commands until the one whose connection
+	// is being closed is done, see isolate
+	interrupted bool
+	queue       []*waiter
+}
+
+type waiter struct {
+	mailbox string
+	access  Access
+	granted Access
+	ready   chan struct{}
+}
+
+// admit returns the access a command gets if it can start now. A shared
+// command for another mailbox has to select it first, so it runs alone.
+func (s *scheduler) admit(mailbox string, access Access) (Access, bool) {
+	if s.exclusive || s.interrupted {
+		return 0, false
+	}
+	if access == Shared && mailbox != s.mailbox {
+		access = Exclusive
+	}
+	if access == Exclusive && s.running > 0 {
+		return 0, false
+	}
+
+	return access, true
+}
+
+func (s *scheduler) start(mailbox string, access Access) {
+	s.running++
+	if access == Exclusive {
+		s.exclusive = true
+		s.mailbox = mailbox
+	}
+}
+
+// acquire waits until a command with access to mailbox can run, the
+// returned func ends it.
+func (s *scheduler) acquire(ctx context.Context, mailbox string, access Access) (func(), error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if len(s.queue) == 0 {
+		if granted, ok := s.admit(mailbox, access); ok {
+			s.start(mailbox, granted)
+			s.mu.Unlock()
+			return s.releaser(granted), nil
+		}
+	}
+	w := &waiter{mailbox: mailbox, access: access, ready: make(chan struct{})}
+	s.queue = append(s.queue, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaser(w.granted), nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	select {
+	case <-w.ready:
+		// started while giving up
+		s.mu.Unlock()
+		s.releaser(w.granted)()
+	default:
+		s.queue = slices.DeleteFunc(s.queue, func(q *waiter) bool { return q == w })
+		s.wake()
+		s.mu.Unlock()
+	}
+
+	return nil, ctx.Err()
+}
+
+// tryAcquire starts a command only if nothing is running or waiting.
+func (s *scheduler) tryAcquire(access Access) (func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) > 0 || s.running > 0 {
+		return nil, false
+	}
+	s.start(s.mailbox, access)
+
+	return s.releaser(access), true
+}
+
+func (s *scheduler) releaser(access Access) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			s.running--
+			if access == Exclusive {
+				s.exclusive = false
+			}
+			if s.running == 0 {
+				s.interrupted = false
+			}
+			s.wake()
+		})
+	}
+}
+
+// wake starts waiting commands from the head of the queue, it is called
+// with mu held.
+func (s *scheduler) wake() {
+	for len(s.queue) > 0 {
+		w := s.queue[0]
+		granted, ok := s.admit(w.mailbox, w.access)
+		if !ok {
+			return
+		}
+		s.start(w.mailbox, granted)
+		w.granted = granted
+		close(w.ready)
+		s.queue = s.queue[1:]
+	}
+}
+
+// isolate reports whether a single command is running, so interrupting
+// it by closing the connection does not abort others. Until it is done no
+// other command starts, it would be aborted too.
+func (s *scheduler) isolate() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running != 1 {
+		return false
+	}
+	s.interrupted = true
+
+	return true
+}
+
+// load is the number of running and waiting commands.
+func (s *scheduler) load() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.running + len(s.queue)
+}
+
+// current returns the mailbox selected by the connection, or the one the
+// running command is about to select.
+func (s *scheduler) current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mailbox
+}
+
+type leaseKey struct{}
+
+type lease struct {
+	core    *Core
+	mailbox string
+	access  Access
+}
+
+// Lease reserves the connection for a sequence of commands on mailbox, for
+// instance a SEARCH followed by a MOVE of its results, which must not see
+// the sequence numbers change in between. The commands are run with the
+// returned context and release is called once they are done.
+func (e *Core) Lease(ctx context.Context, mailbox string, access Access) (_ context.Context, release func(), err error) {
+	if mailbox == "" {
+		mailbox = e.home()
+	}
+
+	release, err = e.sched.acquire(ctx, mailbox, access)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return context.WithValue(ctx, leaseKey{}, &lease{core: e, mailbox: mailbox, access: access}), release, nil
+}
+
+// mailboxOf returns the mailbox commands run with ctx work on, the one of
+// its lease or else the default mailbox.
+func (e *Core) mailboxOf(ctx context.Context) string {
+	if l, ok := ctx.Value(leaseKey{}).(*lease); ok && l.core == e {
+		return l.mailbox
+	}
+
+	return e.home()
+}
+
+// acquire starts a command on mailbox, which defaults to the one of the
+// lease held by ctx or else to the default mailbox.
+func (e *Core) acquire(ctx context.Context, mailbox string, access Access) (func(), error) {
+	if l, ok := ctx.Value(leaseKey{}).(*lease); ok && l.core == e {
+		if l.access < access {
+			return nil, fmt.Errorf("%w: %s command in a %s lease", ErrClientError, access, l.access)
+		}
+		if mailbox != "" && mailbox != l.mailbox {
+			return nil, fmt.Errorf("%w: command on %s in a lease of %s", ErrClientError, mailbox, l.mailbox)
+		}
+		return func() {}, nil
+	}
+
+	if mailbox == "" {
+		mailbox = e.home()
+	}
+
+	return e.sched.acquire(ctx, mailbox, access)
+}
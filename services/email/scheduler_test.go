@@ -0,0 +1,409 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockDelay is how long a command is given to start before it is taken
+// to be waiting.
+const blockDelay = 20 * time.Millisecond
+
+type grant struct {
+	release func()
+	err     error
+}
+
+// acquireAsync starts acquire in the background, the grant is sent once
+// it returns.
+func acquireAsync(ctx context.Context, s *scheduler, mailbox string, access Access) <-chan grant {
+	ch := make(chan grant, 1)
+	go func() {
+		release, err := s.acquire(ctx, mailbox, access)
+		ch <- grant{release, err}
+	}()
+
+	return ch
+}
+
+func mustAcquire(t *testing.T, s *scheduler, mailbox string, access Access) func() {
+	t.Helper()
+
+	release, err := s.acquire(context.Background(), mailbox, access)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return release
+}
+
+func granted(t *testing.T, ch <-chan grant) func() {
+	t.Helper()
+
+	select {
+	case g := <-ch:
+		if g.err != nil {
+			t.Fatalf("unexpected error: %v", g.err)
+		}
+		return g.release
+	case <-time.After(time.Second):
+		t.Fatal("expected the command to start")
+		return nil
+	}
+}
+
+func waiting(t *testing.T, ch <-chan grant) {
+	t.Helper()
+
+	select {
+	case <-ch:
+		t.Fatal("expected the command to wait")
+	case <-time.After(blockDelay):
+	}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{mailbox: "INBOX"}
+}
+
+func TestSchedulerShared(t *testing.T) {
+	s := newScheduler()
+
+	// shared commands on the selected mailbox are pipelined
+	r1 := mustAcquire(t, s, "INBOX", Shared)
+	r2 := mustAcquire(t, s, "INBOX", Shared)
+	r3 := mustAcquire(t, s, "INBOX", Independent)
+	if s.load() != 3 {
+		t.Errorf("expected 3 running commands, got %d", s.load())
+	}
+
+	r1()
+	r2()
+	r3()
+	// releasing twice is harmless
+	r1()
+	if s.load() != 0 {
+		t.Errorf("expected no running commands, got %d", s.load())
+	}
+}
+
+func TestSchedulerExclusive(t *testing.T) {
+	s := newScheduler()
+	ctx := context.Background()
+
+	shared := mustAcquire(t, s, "INBOX", Shared)
+	exclusive := acquireAsync(ctx, s, "INBOX", Exclusive)
+	waiting(t, exclusive)
+
+	shared()
+	release := granted(t, exclusive)
+
+	// nothing starts next to an exclusive command
+	next := []<-chan grant{
+		acquireAsync(ctx, s, "INBOX", Shared),
+		acquireAsync(ctx, s, "INBOX", Independent),
+	}
+	for _, ch := range next {
+		waiting(t, ch)
+	}
+	if _, ok := s.tryAcquire(Independent); ok {
+		t.Error("expected tryAcquire to fail next to an exclusive command")
+	}
+
+	release()
+	for _, ch := range next {
+		granted(t, ch)()
+	}
+}
+
+func TestSchedulerMailboxSwitch(t *testing.T) {
+	s := newScheduler()
+	ctx := context.Background()
+
+	inbox := mustAcquire(t, s, "INBOX", Shared)
+
+	// a shared command on another mailbox has to select it, it runs alone
+	archive := acquireAsync(ctx, s, "Archive", Shared)
+	waiting(t, archive)
+	inbox()
+	release := granted(t, archive)
+	if s.current() != "Archive" {
+		t.Errorf("expected Archive to be selected, got %q", s.current())
+	}
+
+	other := acquireAsync(ctx, s, "Archive", Shared)
+	waiting(t, other)
+	release()
+	granted(t, other)()
+
+	// the selected mailbox stays, commands on it are shared again
+	r1 := mustAcquire(t, s, "Archive", Shared)
+	r2 := mustAcquire(t, s, "Archive", Shared)
+	r1()
+	r2()
+}
+
+func TestSchedulerFIFO(t *testing.T) {
+	s := newScheduler()
+	ctx := context.Background()
+
+	shared := mustAcquire(t, s, "INBOX", Shared)
+
+	var mu sync.Mutex
+	var order []int
+	queue := func(i int, access Access) <-chan grant {
+		ch := make(chan grant, 1)
+		go func() {
+			release, err := s.acquire(ctx, "INBOX", access)
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			ch <- grant{release, err}
+		}()
+		// the commands are queued in this order
+		waiting(t, ch)
+		return ch
+	}
+
+	// the exclusive command is not overtaken by the shared ones behind it,
+	// though they could run next to the one that is running
+	exclusive := queue(1, Exclusive)
+	second := queue(2, Shared)
+	third := queue(3, Shared)
+
+	shared()
+	release := granted(t, exclusive)
+	waiting(t, second)
+	release()
+	granted(t, second)()
+	granted(t, third)()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 3 || order[0] != 1 {
+		t.Errorf("expected the exclusive command to start first, got %v", order)
+	}
+}
+
+func TestSchedulerCancelQueued(t *testing.T) {
+	s := newScheduler()
+
+	shared := mustAcquire(t, s, "INBOX", Shared)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exclusive := acquireAsync(ctx, s, "INBOX", Exclusive)
+	waiting(t, exclusive)
+	behind := acquireAsync(context.Background(), s, "INBOX", Shared)
+	waiting(t, behind)
+
+	// the command behind the canceled one no longer waits for it
+	cancel()
+	g := <-exclusive
+	if !errors.Is(g.err, context.Canceled) || g.release != nil {
+		t.Fatalf("expected the command to be canceled, got %v", g.err)
+	}
+	granted(t, behind)()
+	shared()
+
+	if s.load() != 0 {
+		t.Errorf("expected no running or waiting commands, got %d", s.load())
+	}
+
+	// a done context does not queue at all
+	_, err := s.acquire(ctx, "INBOX", Shared)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+}
+
+func TestSchedulerCancelGranted(t *testing.T) {
+	s := newScheduler()
+
+	// cancel the waiting commands as they are being started, whichever
+	// wins, every command is released and nothing is left waiting
+	for range 200 {
+		release := mustAcquire(t, s, "INBOX", Exclusive)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		chs := []<-chan grant{
+			acquireAsync(ctx, s, "INBOX", Shared),
+			acquireAsync(ctx, s, "Archive", Shared),
+			acquireAsync(ctx, s, "INBOX", Exclusive),
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			release()
+		}()
+		go func() {
+			defer wg.Done()
+			cancel()
+		}()
+		wg.Wait()
+
+		for _, ch := range chs {
+			g := <-ch
+			if g.err == nil {
+				g.release()
+			} else if !errors.Is(g.err, context.Canceled) {
+				t.Fatalf("unexpected error: %v", g.err)
+			}
+		}
+		if s.load() != 0 {
+			t.Fatalf("expected no running or waiting commands, got %d", s.load())
+		}
+	}
+}
+
+func TestSchedulerIsolate(t *testing.T) {
+	s := newScheduler()
+	ctx := context.Background()
+
+	r1 := mustAcquire(t, s, "INBOX", Shared)
+	r2 := mustAcquire(t, s, "INBOX", Shared)
+	if s.isolate() {
+		t.Error("expected a pipelined command not to be interrupted")
+	}
+	r2()
+
+	if !s.isolate() {
+		t.Fatal("expected the single command to be interrupted")
+	}
+	// a shared command starting now would be aborted by the close
+	next := acquireAsync(ctx, s, "INBOX", Shared)
+	waiting(t, next)
+	if _, ok := s.tryAcquire(Independent); ok {
+		t.Error("expected tryAcquire to fail while a command is interrupted")
+	}
+
+	r1()
+	release := granted(t, next)
+	r := mustAcquire(t, s, "INBOX", Shared)
+	r()
+	release()
+}
+
+func TestSchedulerConcurrent(t *testing.T) {
+	s := newScheduler()
+	mailboxes := []string{"INBOX", "INBOX", "Archive"}
+	accesses := []Access{Independent, Shared, Shared, Exclusive}
+
+	var mu sync.Mutex
+	running := map[Access]int{}
+	mailbox := map[string]int{}
+
+	var wg sync.WaitGroup
+	for i := range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				access := accesses[(i+j)%len(accesses)]
+				name := mailboxes[(i*j)%len(mailboxes)]
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(j%5)*time.Millisecond)
+				release, err := s.acquire(ctx, name, access)
+				cancel()
+				if err != nil {
+					continue
+				}
+
+				mu.Lock()
+				running[access]++
+				if access != Independent {
+					mailbox[name]++
+				}
+				total := running[Independent] + running[Shared] + running[Exclusive]
+				if running[Exclusive] > 0 && total > 1 {
+					t.Errorf("exclusive command running next to %d others", total-1)
+				}
+				if access != Independent && len(mailbox) > 1 {
+					t.Errorf("commands running on %d mailboxes", len(mailbox))
+				}
+				mu.Unlock()
+
+				mu.Lock()
+				running[access]--
+				if access != Independent {
+					mailbox[name]--
+					if mailbox[name] == 0 {
+						delete(mailbox, name)
+					}
+				}
+				mu.Unlock()
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.load() != 0 {
+		t.Errorf("expected no running or waiting commands, got %d", s.load())
+	}
+}
+
+func TestPoolPick(t *testing.T) {
+	newPool := func(n int) *Pool {
+		p := &Pool{}
+		for range n {
+			p.cores = append(p.cores, &Core{mailbox: "INBOX", sched: scheduler{mailbox: "INBOX"}})
+		}
+		return p
+	}
+	busy := func(t *testing.T, e *Core, mailbox string, n int) {
+		for range n {
+			t.Cleanup(mustAcquire(t, &e.sched, mailbox, Shared))
+		}
+	}
+
+	t.Run("idle on mailbox", func(t *testing.T) {
+		p := newPool(3)
+		p.cores[1].sched.mailbox = "Archive"
+		if e := p.pick("Archive"); e != p.cores[1] {
+			t.Error("expected the idle connection with Archive selected")
+		}
+		// the default mailbox is the one of the first connection
+		if e := p.pick(""); e != p.cores[0] {
+			t.Error("expected the idle connection with INBOX selected")
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		p := newPool(3)
+		busy(t, p.cores[0], "INBOX", 1)
+		p.cores[2].sched.mailbox = "Archive"
+		if e := p.pick("INBOX"); e != p.cores[1] {
+			t.Error("expected the idle connection with INBOX selected")
+		}
+		if e := p.pick("Sent"); e != p.cores[1] {
+			t.Error("expected the first idle connection")
+		}
+	})
+
+	t.Run("least busy", func(t *testing.T) {
+		p := newPool(3)
+		busy(t, p.cores[0], "INBOX", 3)
+		busy(t, p.cores[1], "INBOX", 1)
+		busy(t, p.cores[2], "INBOX", 2)
+		if e := p.pick("INBOX"); e != p.cores[1] {
+			t.Error("expected the least busy connection")
+		}
+	})
+
+	t.Run("waiting", func(t *testing.T) {
+		p := newPool(2)
+		busy(t, p.cores[0], "INBOX", 1)
+		busy(t, p.cores[1], "INBOX", 1)
+		// the queue counts too
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		waiting(t, acquireAsync(ctx, &p.cores[0].sched, "INBOX", Exclusive))
+		if e := p.pick("INBOX"); e != p.cores[1] {
+			t.Error("expected the connection without waiting commands")
+		}
+	})
+}
@@ -0,0 +1,386 @@
+package email
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// Store is a local copy of a mailbox, kept up to date by Sync and searched
+// without the server. It is only valid for UIDValidity, emails are found
+// by UID as sequence numbers are only right just after a sync.
+type Store struct {
+	Mailbox     string    `json:"mailbox"`
+	UIDValidity uint32    `json:"uidvalidity"`
+	UIDNext     uint32    `json:"uidnext"`
+	ModSeq      uint64    `json:"modseq,omitempty"`
+	Synced      time.Time `json:"synced"`
+	// Messages are in UID order, with their bodies
+	Messages []Message `json:"messages"`
+
+	path string
+	// words is the full-text index, the sorted words of the subjects,
+	// senders and bodies and the UIDs of the emails containing them
+	words []string
+	index map[string][]uint32
+}
+
+// SyncStats tells what a Sync changed in a Store.
+type SyncStats struct {
+	Mailbox string `json:"mailbox" yaml:"mailbox"`
+	// Reset is set when the store was dropped for a new UIDVALIDITY
+	Reset   bool `json:"reset" yaml:"reset"`
+	Added   int  `json:"added" yaml:"added"`
+	Updated int  `json:"updated" yaml:"updated"`
+	Removed int  `json:"removed" yaml:"removed"`
+	Total   int  `json:"total" yaml:"total"`
+}
+
+// OpenStore reads the store of mailbox at path, a missing file is an empty
+// store that was never synced.
+func OpenStore(path, mailbox string) (*Store, error) {
+	s := &Store{Mailbox: mailbox, path: path}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse store %s: %w", path, err)
+	}
+	if s.Mailbox != mailbox {
+		return nil, fmt.Errorf("store %s holds %s instead of %s", path, s.Mailbox, mailbox)
+	}
+	s.reindex()
+
+	return s, nil
+}
+
+// Save writes the store, the file is replaced at once so readers never see
+// half of it.
+func (s *Store) Save() error {
+	err := os.MkdirAll(filepath.Dir(s.path), 0o700)
+	if err != nil {
+		return fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+
+	return nil
+}
+
+// synced reports whether the store was ever synced.
+func (s *Store) synced() bool {
+	return !s.Synced.IsZero()
+}
+
+// Search returns the page of emails matching query like SearchMessages,
+// without their bodies, except that Subject is a full-text query: every
+// word of it has to start a word of the subject, the senders or the body.
+func (s *Store) Search(query Query, page Page) ([]Message, error) {
+	if !s.synced() {
+		return nil, fmt.Errorf("%w: %s was never synced", ErrClientError, s.Mailbox)
+	}
+
+	var matches map[uint32]bool
+	for _, w := range words(query.Subject) {
+		found := make(map[uint32]bool)
+		for i := sort.SearchStrings(s.words, w); i < len(s.words) && strings.HasPrefix(s.words[i], w); i++ {
+			for _, uid := range s.index[s.words[i]] {
+				if matches == nil || matches[uid] {
+					found[uid] = true
+				}
+			}
+		}
+		matches = found
+	}
+
+	from := strings.ToLower(query.From)
+	var seqnums []uint32
+	for i, m := range s.Messages {
+		if matches != nil && !matches[m.UID] {
+			continue
+		}
+		if from != "" && !slices.ContainsFunc(m.From, func(f string) bool { return strings.Contains(strings.ToLower(f), from) }) {
+			continue
+		}
+		if !slices.ContainsFunc(query.Flags, func(f string) bool { return !hasFlag(m.Flags, f) }) &&
+			!slices.ContainsFunc(query.NotFlags, func(f string) bool { return hasFlag(m.Flags, f) }) {
+			seqnums = append(seqnums, uint32(i+1))
+		}
+	}
+
+	seqnums = page.apply(seqnums)
+	if len(seqnums) == 0 {
+		return nil, ErrNotFound
+	}
+
+	res := make([]Message, len(seqnums))
+	for i, seq := range seqnums {
+		res[i] = s.Messages[seq-1]
+		res[i].Body, res[i].Events = "", nil
+	}
+
+	return res, nil
+}
+
+// Message returns the email with uid, with its body.
+func (s *Store) Message(uid uint32) (*Message, error) {
+	i, ok := s.find(uid)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	m := s.Messages[i]
+	return &m, nil
+}
+
+func (s *Store) find(uid uint32) (int, bool) {
+	return slices.BinarySearchFunc(s.Messages, uid, func(m Message, uid uint32) int {
+		return cmp.Compare(m.UID, uid)
+	})
+}
+
+func hasFlag(flags []string, flag string) bool {
+	return slices.ContainsFunc(flags, func(f string) bool { return strings.EqualFold(f, flag) })
+}
+
+// reindex numbers the emails in UID order and rebuilds the full-text index.
+func (s *Store) reindex() {
+	slices.SortFunc(s.Messages, func(a, b Message) int {
+		return cmp.Compare(a.UID, b.UID)
+	})
+
+	s.index = make(map[string][]uint32)
+	for i := range s.Messages {
+		m := &s.Messages[i]
+		m.Seq = uint32(i + 1)
+		for _, w := range words(m.Subject + " " + strings.Join(m.From, " ") + " " + m.Body) {
+			uids := s.index[w]
+			if len(uids) == 0 || uids[len(uids)-1] != m.UID {
+				s.index[w] = append(uids, m.UID)
+			}
+		}
+	}
+
+	s.words = make([]string, 0, len(s.index))
+	for w := range s.index {
+		s.words = append(s.words, w)
+	}
+	sort.Strings(s.words)
+}
+
+// words splits text in lowercase words of letters and digits.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Sync brings s up to date with its mailbox: the emails after UIDNext are
+// fetched with their bodies, the flags of the others are refreshed, only
+// the changed ones with CHANGEDSINCE when the server supports CONDSTORE,
+// and expunged ones are dropped. A new UIDVALIDITY starts over. When it
+// fails, s keeps the emails fetched so far and can be saved.
+func (e *Core) Sync(ctx context.Context, s *Store) (_ SyncStats, err error) {
+	e.log.Debug("syncing", "mailbox", s.Mailbox, "uidnext", s.UIDNext, "modseq", s.ModSeq)
+
+	release, err := e.acquire(ctx, s.Mailbox, Shared)
+	if err != nil {
+		return SyncStats{}, err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return SyncStats{}, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	defer s.reindex()
+
+	stats := SyncStats{Mailbox: s.Mailbox}
+	if v := e.UIDValidity(); v != s.UIDValidity {
+		if s.UIDValidity != 0 {
+			e.log.Info("mailbox was recreated, syncing it again", "mailbox", s.Mailbox, "uidvalidity", v)
+			stats.Reset = true
+		}
+		*s = Store{Mailbox: s.Mailbox, UIDValidity: v, UIDNext: 1, path: s.path}
+	}
+	condstore := client.Caps().Has(imap.CapCondStore)
+
+	// HIGHESTMODSEQ is taken before the flags are fetched, a flag changed
+	// afterwards is above it and fetched by the next sync
+	var highest uint64
+	if condstore {
+		data, err := client.Status(s.Mailbox, &imap.StatusOptions{HighestModSeq: true}).Wait()
+		e.observe("STATUS", err)
+		if err != nil {
+			return SyncStats{}, fmt.Errorf("%w: %w", ErrClientError, err)
+		}
+		highest = data.HighestModSeq
+	}
+
+	stats.Updated, err = e.syncFlags(client, s, condstore)
+	if err != nil {
+		return SyncStats{}, err
+	}
+
+	stats.Added, err = e.syncNew(ctx, client, s)
+	if err != nil {
+		return SyncStats{}, err
+	}
+	if condstore {
+		s.ModSeq = highest
+	}
+
+	// the client has no QRESYNC to be told what was expunged since the
+	// last sync, fewer emails in the mailbox than in s means some were
+	if mb := client.Mailbox(); mb == nil || len(s.Messages) != int(mb.NumMessages) {
+		stats.Removed, err = e.syncExpunged(client, s)
+		if err != nil {
+			return SyncStats{}, err
+		}
+	}
+
+	s.Synced = time.Now()
+	stats.Total = len(s.Messages)
+
+	return stats, nil
+}
+
+// syncFlags refreshes the flags of the emails already in s.
+func (e *Core) syncFlags(client *imapclient.Client, s *Store, condstore bool) (int, error) {
+	if len(s.Messages) == 0 {
+		return 0, nil
+	}
+
+	options := &imap.FetchOptions{UID: true, Flags: true}
+	if condstore && s.ModSeq > 0 {
+		options.ModSeq = true
+		options.ChangedSince = s.ModSeq
+	}
+	set := imap.UIDSet{{Start: 1, Stop: imap.UID(s.UIDNext - 1)}}
+	msgs, err := client.Fetch(set, options).Collect()
+	e.observe("FETCH", err)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+
+	updated := 0
+	for _, buf := range msgs {
+		i, ok := s.find(uint32(buf.UID))
+		if !ok {
+			continue
+		}
+		prev := s.Messages[i].Flags
+		s.Messages[i].setFlags(buf.Flags)
+		if !slices.Equal(prev, s.Messages[i].Flags) {
+			updated++
+		}
+	}
+
+	return updated, nil
+}
+
+// syncNew fetches the emails from UIDNext on, in chunks of ChunkSize.
+func (e *Core) syncNew(ctx context.Context, client *imapclient.Client, s *Store) (int, error) {
+	uids, err := e.uidsAfter(client, &imap.SearchCriteria{}, max(s.UIDNext, 1)-1)
+	if err != nil {
+		return 0, err
+	}
+
+	report := progress(ctx, len(uids))
+	added := 0
+	for _, chunk := range chunks(uids) {
+		msgs, err := client.Fetch(imap.UIDSetNum(chunk...), &imap.FetchOptions{
+			Envelope:    true,
+			UID:         true,
+			Flags:       true,
+			RFC822Size:  true,
+			BodySection: []*imap.FetchItemBodySection{{Peek: true}},
+		}).Collect()
+		e.observe("FETCH", err)
+		if err != nil {
+			return added, fmt.Errorf("%w: %w", ErrClientError, err)
+		}
+
+		for _, buf := range msgs {
+			m := newMessage(buf)
+			// a malformed email is kept without its body rather than
+			// failing the sync
+			for _, raw := range buf.BodySection {
+				m.Body, m.Events, err = e.parseBody(bytes.NewReader(raw))
+				if err != nil {
+					e.log.Warn("failed to parse email body", "uid", m.UID, "error", err)
+				}
+			}
+			s.Messages = append(s.Messages, m)
+			s.UIDNext = max(s.UIDNext, m.UID+1)
+		}
+		added += len(msgs)
+		report("sync", added, len(uids))
+	}
+
+	return added, nil
+}
+
+// syncExpunged drops the emails of s that are no longer in the mailbox.
+func (e *Core) syncExpunged(client *imapclient.Client, s *Store) (int, error) {
+	res, err := client.UIDSearch(&imap.SearchCriteria{}, nil).Wait()
+	e.observe("SEARCH", err)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+
+	exists := make(map[uint32]bool)
+	for _, uid := range res.AllUIDs() {
+		exists[uint32(uid)] = true
+	}
+	n := len(s.Messages)
+	s.Messages = slices.DeleteFunc(s.Messages, func(m Message) bool { return !exists[m.UID] })
+
+	return n - len(s.Messages), nil
+}
@@ -0,0 +1,289 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-message/charset"
+	"github.com/thesoulless/watchmyback/internal/metrics"
+)
+
+const (
+	dialTimeout  = 15 * time.Second
+	keepAlive    = 30 * time.Second
+	noopTimeout  = 10 * time.Second
+	pingInterval = 1 * time.Minute
+	minBackoff   = 1 * time.Second
+	maxBackoff   = 5 * time.Minute
+)
+
+type State string
+
+const (
+	StateDisconnected State = "disconnected"
+	StateConnecting   State = "connecting"
+	StateConnected    State = "connected"
+	StateAuthFailed   State = "auth-failed"
+	StateClosed       State = "closed"
+)
+
+// Status describes the connection of a Core, it is reported by `wmb status`.
+type Status struct {
+	State       State      `json:"state" yaml:"state"`
+	Since       time.Time  `json:"since" yaml:"since"`
+	Mailbox     string     `json:"mailbox,omitempty" yaml:"mailbox,omitempty"`
+	LastOK      *time.Time `json:"last_ok,omitempty" yaml:"last_ok,omitempty"`
+	LastError   string     `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty" yaml:"last_error_at,omitempty"`
+	Reconnects  int        `json:"reconnects" yaml:"reconnects"`
+	NextRetry   *time.Time `json:"next_retry,omitempty" yaml:"next_retry,omitempty"`
+}
+
+func (e *Core) Status() Status {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+
+	return e.status
+}
+
+func (e *Core) setState(state State, err error) {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+
+	if e.status.State != state {
+		e.status.State = state
+		e.status.Since = time.Now()
+	}
+	now := time.Now()
+	if state == StateConnected {
+		e.status.LastOK = &now
+		e.status.Mailbox = e.sched.current()
+		e.status.NextRetry = nil
+	}
+	if err != nil {
+		e.status.LastError = err.Error()
+		e.status.LastErrorAt = &now
+	}
+}
+
+// connect dials a new connection, replacing the current one.
+func (e *Core) connect() error {
+	target := net.JoinHostPort(e.conf.Host, e.conf.Port)
+	e.log.Debug("new email client", "target", target)
+	e.setState(StateConnecting, nil)
+
+	if e.client != nil {
+		e.client.Close()
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}
+	conn, err := tls.DialWithDialer(dialer, "tcp", target, &tls.Config{NextProtos: []string{"imap"}})
+	if err != nil {
+		e.log.Error("error connecting to the imap server", "error", err)
+		err = fmt.Errorf("%w: %w", ErrNetwork, err)
+		e.setState(StateDisconnected, err)
+		return err
+	}
+
+	// a server that accepts the connection but never greets is as dead as
+	// one that refuses it
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	e.client = imapclient.New(conn, &imapclient.Options{
+		WordDecoder: &mime.WordDecoder{CharsetReader: charset.Reader},
+	})
+	err = e.client.WaitGreeting()
+	if err != nil {
+		e.client.Close()
+		err = fmt.Errorf("%w: %w", ErrNetwork, err)
+		e.setState(StateDisconnected, err)
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return nil
+}
+
+// healthCheck brings the session back to the selected state, reconnecting,
+// logging in and selecting the mailbox of the scheduler as needed.
+// Authentication failures are returned as ErrAuth, connection failures as
+// ErrNetwork.
+func (e *Core) healthCheck() error {
+	e.log.Debug("health check")
+
+	if e.client == nil {
+		err := e.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	mailbox := e.sched.current()
+	switch e.client.State() {
+	case imap.ConnStateSelected:
+		if m := e.client.Mailbox(); m != nil && m.Name == mailbox {
+			return nil
+		}
+	case imap.ConnStateAuthenticated:
+	case imap.ConnStateNotAuthenticated:
+		err := e.resume()
+		if err != nil {
+			return err
+		}
+	default:
+		e.statusMu.Lock()
+		e.status.Reconnects++
+		e.statusMu.Unlock()
+		metrics.Reconnects.WithLabelValues(e.conf.Name).Inc()
+
+		err := e.connect()
+		if err != nil {
+			return err
+		}
+		err = e.resume()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := e.selectMailbox(mailbox)
+	if err != nil {
+		// a NO for a missing mailbox is not a connection problem
+		var imapErr *imap.Error
+		if !errors.As(err, &imapErr) {
+			err = fmt.Errorf("%w: %w", ErrNetwork, err)
+			e.setState(StateDisconnected, err)
+		}
+		return err
+	}
+
+	e.setState(StateConnected, nil)
+	return nil
+}
+
+// resume authenticates a fresh connection.
+func (e *Core) resume() error {
+	err := e.authenticate()
+	if err != nil {
+		err = e.classify(err)
+		if errors.Is(err, ErrAuth) {
+			e.setState(StateAuthFailed, err)
+		} else {
+			e.setState(StateDisconnected, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// classify wraps err with ErrAuth when the server or the token endpoint
+// rejected the credentials, and with ErrNetwork otherwise.
+func (e *Core) classify(err error) error {
+	if errors.Is(err, ErrAuth) || errors.Is(err, ErrNetwork) {
+		return err
+	}
+
+	var imapErr *imap.Error
+	if errors.As(err, &imapErr) || errors.Is(err, ErrNoToken) {
+		return fmt.Errorf("%w: %w", ErrAuth, err)
+	}
+
+	return fmt.Errorf("%w: %w", ErrNetwork, err)
+}
+
+// ping sends a NOOP and closes the connection if the server does not answer
+// in time, so half-dead TCP connections are detected.
+func (e *Core) ping() error {
+	cmd := e.client.Noop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-errCh:
+		e.observe("NOOP", err)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrNetwork, err)
+		}
+		return nil
+	case <-time.After(noopTimeout):
+		e.observe("NOOP", context.DeadlineExceeded)
+		e.client.Close()
+		return fmt.Errorf("%w: NOOP timed out after %s", ErrNetwork, noopTimeout)
+	}
+}
+
+// check is run periodically by the supervisor, a connection busy with
+// commands is alive and is left alone.
+func (e *Core) check() error {
+	release, ok := e.sched.tryAcquire(Exclusive)
+	if !ok {
+		return nil
+	}
+	defer release()
+
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	default:
+	}
+
+	err := e.healthCheck()
+	if err != nil {
+		return err
+	}
+
+	err = e.ping()
+	if err != nil {
+		e.setState(StateDisconnected, err)
+		return err
+	}
+
+	e.setState(StateConnected, nil)
+	return nil
+}
+
+func (e *Core) supervise() {
+	backoff := minBackoff
+	for {
+		wait := pingInterval
+		err := e.check()
+		switch {
+		case err == nil:
+			backoff = minBackoff
+		case errors.Is(err, ErrAuth):
+			// retrying quickly will not fix credentials
+			e.log.Error("authentication failed", "account", e.conf.Name, "error", err)
+			wait = maxBackoff
+		default:
+			e.log.Warn("connection lost, reconnecting", "account", e.conf.Name, "in", backoff, "error", err)
+			wait = backoff
+			backoff = min(backoff*2, maxBackoff)
+		}
+
+		if err != nil {
+			e.statusMu.Lock()
+			retry := time.Now().Add(wait)
+			e.status.NextRetry = &retry
+			e.statusMu.Unlock()
+		}
+
+		select {
+		case <-e.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
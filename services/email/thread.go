@@ -0,0 +1,408 @@
+package email
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// Thread is a conversation, its messages in reply order.
+type Thread struct {
+	ID       string    `json:"id" yaml:"id"`
+	Subject  string    `json:"subject" yaml:"subject"`
+	Messages []Message `json:"messages" yaml:"messages"`
+}
+
+// Threads groups the emails of the selected mailbox in conversations and
+// returns the page of the ones with an email matching query, in the order
+// of their newest email like SearchMessages. The server threads them when
+// it supports THREAD, with REFERENCES rather than ORDEREDSUBJECT, and the
+// client otherwise with the JWZ algorithm over the headers of every email.
+func (e *Core) Threads(ctx context.Context, query Query, page Page) (_ []Thread, err error) {
+	e.log.Debug("threading", "query", query)
+
+	for _, f := range slices.Concat(query.Flags, query.NotFlags) {
+		err = ValidFlag(f)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+		}
+	}
+
+	release, err := e.acquire(ctx, "", Shared)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	res, err := client.UIDSearch(query.criteria(), nil).Wait()
+	e.observe("SEARCH", err)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+	}
+	matches := make(map[imap.UID]bool)
+	for _, uid := range res.AllUIDs() {
+		matches[uid] = true
+	}
+	if len(matches) == 0 {
+		return nil, ErrNotFound
+	}
+
+	var trees [][]imap.UID
+	var byUID map[imap.UID]Message
+	if alg := threadAlgorithm(client.Caps()); alg != "" {
+		e.log.Debug("threading on the server", "algorithm", alg)
+		data, err := client.UIDThread(&imapclient.ThreadOptions{Algorithm: alg, SearchCriteria: &imap.SearchCriteria{}}).Wait()
+		e.observe("THREAD", err)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrClientError, err)
+		}
+		for _, d := range data {
+			trees = append(trees, flattenThread(d, nil))
+		}
+	} else {
+		msgs, err := e.fetchAll(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		trees = jwz(msgs)
+		byUID = make(map[imap.UID]Message, len(msgs))
+		for _, m := range msgs {
+			byUID[imap.UID(m.UID)] = m
+		}
+	}
+
+	var selected [][]imap.UID
+	for _, t := range trees {
+		if slices.ContainsFunc(t, func(uid imap.UID) bool { return matches[uid] }) {
+			selected = append(selected, t)
+		}
+	}
+	slices.SortFunc(selected, func(a, b []imap.UID) int {
+		return cmp.Compare(slices.Max(a), slices.Max(b))
+	})
+
+	// the page is one of threads, Page.apply takes their indexes
+	indexes := make([]uint32, len(selected))
+	for i := range indexes {
+		indexes[i] = uint32(i)
+	}
+	indexes = page.apply(indexes)
+
+	if byUID == nil {
+		var uids []imap.UID
+		for _, i := range indexes {
+			uids = append(uids, selected[i]...)
+		}
+		byUID = make(map[imap.UID]Message, len(uids))
+		report := progress(ctx, len(uids))
+		for _, chunk := range chunks(uids) {
+			msgs, err := e.fetchHeaders(client, imap.UIDSetNum(chunk...))
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range msgs {
+				byUID[imap.UID(m.UID)] = m
+			}
+			report("fetch", len(byUID), len(uids))
+		}
+	}
+
+	threads := make([]Thread, 0, len(indexes))
+	for _, i := range indexes {
+		var t Thread
+		for _, uid := range selected[i] {
+			if m, ok := byUID[uid]; ok {
+				t.Messages = append(t.Messages, m)
+			}
+		}
+		if len(t.Messages) == 0 {
+			continue
+		}
+		t.ID = strconv.FormatUint(uint64(t.Messages[0].UID), 10)
+		t.Subject = t.Messages[0].Subject
+		threads = append(threads, t)
+	}
+	if len(threads) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return threads, nil
+}
+
+func threadAlgorithm(caps imap.CapSet) imap.ThreadAlgorithm {
+	algs := caps.ThreadAlgorithms()
+	for _, alg := range []imap.ThreadAlgorithm{imap.ThreadReferences, imap.ThreadOrderedSubject} {
+		if slices.Contains(algs, alg) {
+			return alg
+		}
+	}
+
+	return ""
+}
+
+// flattenThread appends the UIDs of d to uids, parents before replies.
+func flattenThread(d imapclient.ThreadData, uids []imap.UID) []imap.UID {
+	for _, uid := range d.Chain {
+		uids = append(uids, imap.UID(uid))
+	}
+	for _, sub := range d.SubThreads {
+		uids = flattenThread(sub, uids)
+	}
+
+	return uids
+}
+
+// fetchAll fetches the headers of every email of the selected mailbox.
+func (e *Core) fetchAll(ctx context.Context, client *imapclient.Client) ([]Message, error) {
+	total := int(client.Mailbox().NumMessages)
+	report := progress(ctx, total)
+
+	var res []Message
+	for start := 1; start <= total; start += ChunkSize {
+		set := imap.SeqSet{{Start: uint32(start), Stop: uint32(min(start+ChunkSize-1, total))}}
+		msgs, err := e.fetchHeaders(client, set)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, msgs...)
+		report("fetch", len(res), total)
+	}
+
+	return res, nil
+}
+
+// container is a node of the JWZ algorithm, msg is nil for emails that are
+// only referenced.
+type container struct {
+	msg      *Message
+	parent   *container
+	children []*container
+}
+
+// ancestorOf reports whether c is d or one of its parents.
+func (c *container) ancestorOf(d *container) bool {
+	for ; d != nil; d = d.parent {
+		if d == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *container) adopt(child *container) {
+	child.unlink()
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+func (c *container) unlink() {
+	if c.parent == nil {
+		return
+	}
+
+	c.parent.children = slices.DeleteFunc(c.parent.children, func(s *container) bool { return s == c })
+	c.parent = nil
+}
+
+func (c *container) subject() string {
+	if c.msg != nil {
+		return c.msg.Subject
+	}
+	if len(c.children) > 0 {
+		return c.children[0].subject()
+	}
+
+	return ""
+}
+
+func (c *container) date() time.Time {
+	if c.msg != nil {
+		return c.msg.Date
+	}
+
+	var first time.Time
+	for _, child := range c.children {
+		if d := child.date(); first.IsZero() || d.Before(first) {
+			first = d
+		}
+	}
+
+	return first
+}
+
+// uids appends the UIDs of the thread of c to uids, replies in date order.
+func (c *container) uids(uids []imap.UID) []imap.UID {
+	if c.msg != nil {
+		uids = append(uids, imap.UID(c.msg.UID))
+	}
+
+	slices.SortStableFunc(c.children, func(a, b *container) int {
+		return a.date().Compare(b.date())
+	})
+	for _, child := range c.children {
+		uids = child.uids(uids)
+	}
+
+	return uids
+}
+
+// jwz threads msgs as described on https://www.jwz.org/doc/threading.html
+// and returns the UIDs of each thread.
+func jwz(msgs []Message) [][]imap.UID {
+	// containers in the order they are created, so the result does not
+	// depend on the iteration order of ids
+	var all []*container
+	ids := make(map[string]*container)
+	get := func(id string) *container {
+		c, ok := ids[id]
+		if !ok {
+			c = &container{}
+			ids[id] = c
+			all = append(all, c)
+		}
+		return c
+	}
+
+	for i := range msgs {
+		m := &msgs[i]
+		id := m.MessageID
+		if c, ok := ids[id]; id == "" || ok && c.msg != nil {
+			id = fmt.Sprintf("uid-%d", m.UID)
+		}
+		c := get(id)
+		c.msg = m
+
+		var prev *container
+		for _, ref := range m.references {
+			r := get(ref)
+			if prev != nil && r.parent == nil && !r.ancestorOf(prev) {
+				prev.adopt(r)
+			}
+			prev = r
+		}
+		// the last reference is the parent, whatever the references of
+		// other emails suggested
+		c.unlink()
+		if prev != nil && !c.ancestorOf(prev) {
+			prev.adopt(c)
+		}
+	}
+
+	var roots []*container
+	for _, c := range all {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+	roots = groupBySubject(prune(roots, true))
+
+	res := make([][]imap.UID, len(roots))
+	for i, r := range roots {
+		res[i] = r.uids(nil)
+	}
+
+	return res
+}
+
+// prune drops the containers without an email, their replies take their
+// place. At the root this only happens for a single reply, so that the
+// replies to a missing email stay together.
+func prune(cs []*container, root bool) []*container {
+	var res []*container
+	for _, c := range cs {
+		c.children = prune(c.children, false)
+		switch {
+		case c.msg != nil:
+			res = append(res, c)
+		case len(c.children) == 0:
+		case !root || len(c.children) == 1:
+			for _, child := range c.children {
+				child.parent = c.parent
+			}
+			res = append(res, c.children...)
+		default:
+			res = append(res, c)
+		}
+	}
+
+	return res
+}
+
+// groupBySubject merges the threads with the same subject once Re: and
+// Fwd: are stripped, for replies sent without references. The thread of
+// an email that is not a reply is preferred as the root.
+func groupBySubject(roots []*container) []*container {
+	heads := make(map[string]*container)
+	for _, r := range roots {
+		subject, reply := baseSubject(r.subject())
+		if subject == "" {
+			continue
+		}
+		head, ok := heads[subject]
+		if !ok {
+			heads[subject] = r
+			continue
+		}
+		_, headReply := baseSubject(head.subject())
+		if r.msg == nil && head.msg != nil || headReply && !reply && (r.msg == nil) == (head.msg == nil) {
+			heads[subject] = r
+		}
+	}
+
+	var res []*container
+	for _, r := range roots {
+		subject, _ := baseSubject(r.subject())
+		head := heads[subject]
+		if subject == "" || head == r {
+			res = append(res, r)
+			continue
+		}
+
+		if r.msg == nil {
+			for _, child := range slices.Clone(r.children) {
+				head.adopt(child)
+			}
+			continue
+		}
+		head.adopt(r)
+	}
+
+	return res
+}
+
+// baseSubject lowercases subject and strips its Re:, Fwd: and [list]
+// prefixes, reply tells whether there were any.
+func baseSubject(subject string) (base string, reply bool) {
+	s := strings.ToLower(strings.TrimSpace(subject))
+	for {
+		prev := s
+		s = strings.TrimSpace(strings.TrimSuffix(s, "(fwd)"))
+		for _, prefix := range []string{"re:", "fwd:", "fw:"} {
+			if rest, ok := strings.CutPrefix(s, prefix); ok {
+				s, reply = strings.TrimSpace(rest), true
+			}
+		}
+		if strings.HasPrefix(s, "[") {
+			if end := strings.IndexByte(s, ']'); end > 0 && strings.TrimSpace(s[end+1:]) != "" {
+				s = strings.TrimSpace(s[end+1:])
+			}
+		}
+		if s == prev {
+			return s, reply
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// Moved describes messages moved from one mailbox to another. UIDs are the
+// ones in To, the server only tells them when it supports UIDPLUS. The
+// messages it did not tell are counted in Untracked, they cannot be moved
+// back.
+type Moved struct {
+	At          time.Time   `json:"at" yaml:"at"`
+	From        string      `json:"from" yaml:"from"`
+	To          string      `json:"to" yaml:"to"`
+	UIDValidity uint32      `json:"uidvalidity" yaml:"uidvalidity"`
+	UIDs        imap.UIDSet `json:"-" yaml:"-"`
+	Count       int         `json:"count" yaml:"count"`
+	Untracked   int         `json:"untracked,omitempty" yaml:"untracked,omitempty"`
+}
+
+// add records the MOVE or COPY response for n messages, a server sending no
+// UIDs leaves them untracked as they cannot be found again.
+func (m *Moved) add(validity uint32, dest imap.NumSet, n int) {
+	m.Count += n
+
+	uids, ok := dest.(imap.UIDSet)
+	if !ok || validity == 0 {
+		m.Untracked += n
+		return
+	}
+	if _, ok := uids.Nums(); !ok {
+		m.Untracked += n
+		return
+	}
+
+	m.UIDValidity = validity
+	m.UIDs = append(m.UIDs, uids...)
+}
+
+// Undoable reports whether any message of m can be moved back.
+func (m Moved) Undoable() bool {
+	return m.Untracked < m.Count
+}
+
+// OnMove sets f to be told about the messages moved by Move, Archive and
+// Trash, it must be called before the connection is used.
+func (e *Core) OnMove(f func(Moved)) {
+	e.onMove = f
+}
+
+func (e *Core) moved(m Moved) {
+	if e.onMove != nil {
+		e.onMove(m)
+	}
+}
+
+// Undo moves the messages of m back where they came from. It fails when To
+// was recreated since, its UIDs would then point at other messages.
+func (e *Core) Undo(ctx context.Context, m Moved) (err error) {
+	release, err := e.acquire(ctx, m.To, Exclusive)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	client, err := e.ready(ctx)
+	if err != nil {
+		return err
+	}
+	defer e.interrupt(ctx, client, &err)()
+
+	if v := e.UIDValidity(); v != m.UIDValidity {
+		return fmt.Errorf("%w: %s was recreated since the move, UIDVALIDITY is %d instead of %d", ErrClientError, m.To, v, m.UIDValidity)
+	}
+
+	e.log.Debug("undoing move", "from", m.From, "to", m.To, "uids", m.UIDs)
+	_, _, err = e.moveUIDs(client, m.UIDs, m.From)
+
+	return err
+}
+
+// trashMailbox returns the configured Trash mailbox, or asks the server for
+// the one with the \Trash special use.
+func (e *Core) trashMailbox(client *imapclient.Client) (string, error) {
+	if e.conf.Trash != "" {
+		return e.conf.Trash, nil
+	}
+
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	if e.trash != "" {
+		return e.trash, nil
+	}
+
+	e.trash = "Trash"
+	if !client.Caps().Has(imap.CapSpecialUse) {
+		return e.trash, nil
+	}
+
+	mailboxes, err := client.List("", "*", &imap.ListOptions{ReturnSpecialUse: true}).Collect()
+	e.observe("LIST", err)
+	if err != nil {
+		e.trash = ""
+		return "", err
+	}
+	for _, mb := range mailboxes {
+		for _, attr := range mb.Attrs {
+			if attr == imap.MailboxAttrTrash {
+				e.trash = mb.Mailbox
+			}
+		}
+	}
+
+	return e.trash, nil
+}
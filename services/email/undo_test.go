@@ -0,0 +1,30 @@
+package email
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestMovedAdd(t *testing.T) {
+	var m Moved
+	m.add(7, imap.UIDSetNum(10, 11), 2)
+	// a server without UIDPLUS tells nothing about the second chunk
+	m.add(0, nil, 3)
+
+	if m.Count != 5 || m.Untracked != 3 {
+		t.Errorf("expected 5 emails with 3 untracked, got %d and %d", m.Count, m.Untracked)
+	}
+	if m.UIDValidity != 7 || m.UIDs.String() != "10:11" {
+		t.Errorf("expected 10:11 in 7, got %s in %d", m.UIDs, m.UIDValidity)
+	}
+	if !m.Undoable() {
+		t.Error("expected the tracked emails to be undoable")
+	}
+
+	m = Moved{}
+	m.add(0, nil, 1)
+	if m.Undoable() {
+		t.Error("expected a move without UIDs not to be undoable")
+	}
+}